@@ -0,0 +1,53 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/boreevyuri/postmanq/logger"
+)
+
+// управляет найденными почтовыми серверами доменов
+// GET /mx/ и GET /mx/<домен> отдают состояние TLS серверов всех доменов или одного домена
+// DELETE /mx/<домен> удаляет найденные серверы домена,
+// используется, если почтовый сервис сменил MX записи или поиск его серверов завершился ошибкой
+func (s *Service) handleMailServer(w http.ResponseWriter, r *http.Request) {
+	hostname := strings.ToLower(strings.TrimPrefix(r.URL.Path, "/mx/"))
+	if strings.Contains(hostname, "/") {
+		writeResponse(w, http.StatusBadRequest, &response{Error: "invalid domain"})
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		s.showMailServer(w, hostname)
+	case http.MethodDelete:
+		s.flushMailServer(w, hostname)
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodDelete)
+		writeResponse(w, http.StatusMethodNotAllowed, &response{Error: "method not allowed"})
+	}
+}
+
+// отдает состояние TLS серверов домена
+func (s *Service) showMailServer(w http.ResponseWriter, hostname string) {
+	states, ok := s.mailServers.TLSStates(hostname)
+	if !ok {
+		writeResponse(w, http.StatusNotFound, &response{Error: "mail server not found"})
+		return
+	}
+	writeResponse(w, http.StatusOK, &response{TLS: states})
+}
+
+// удаляет найденные почтовые серверы домена
+func (s *Service) flushMailServer(w http.ResponseWriter, hostname string) {
+	if len(hostname) == 0 {
+		writeResponse(w, http.StatusBadRequest, &response{Error: "domain should be defined"})
+		return
+	}
+	if !s.mailServers.FlushMailServer(hostname) {
+		writeResponse(w, http.StatusNotFound, &response{Error: "mail server not found"})
+		return
+	}
+	logger.Info("api service flush mail server %s", hostname)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,131 @@
+package api
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/boreevyuri/postmanq/common"
+	"github.com/boreevyuri/postmanq/logger"
+)
+
+// ответ на запрос
+type response struct {
+	// идентификатор письма, если принято одно письмо
+	ID string `json:"id,omitempty"`
+
+	// идентификаторы писем, если принят массив писем
+	IDs []string `json:"ids,omitempty"`
+
+	// ошибка
+	Error string `json:"error,omitempty"`
+
+	// состояние TLS почтовых серверов
+	TLS []*common.MxTLSState `json:"tls,omitempty"`
+}
+
+// создает обработчики запросов
+func (s *Service) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/messages", s.authorize(http.HandlerFunc(s.handleMessages)))
+	mux.Handle("/mx/", s.authorize(http.HandlerFunc(s.handleMailServer)))
+	return mux
+}
+
+// проверяет токен в заголовке Authorization, токен передается только со схемой Bearer
+func (s *Service) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(header, bearerScheme)
+		if !strings.HasPrefix(header, bearerScheme) || subtle.ConstantTimeCompare([]byte(token), []byte(s.Config.Token)) != 1 {
+			logger.Warn("api service reject unauthorized request from %s", r.RemoteAddr)
+			writeResponse(w, http.StatusUnauthorized, &response{Error: "unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// принимает одно письмо или массив писем и кладет их в очередь
+func (s *Service) handleMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeResponse(w, http.StatusMethodNotAllowed, &response{Error: "method not allowed"})
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, s.Config.MaxBodySize))
+	if err != nil {
+		status := http.StatusBadRequest
+		if err.Error() == errBodyTooLarge {
+			status = http.StatusRequestEntityTooLarge
+		}
+		writeResponse(w, status, &response{Error: err.Error()})
+		return
+	}
+	body = bytes.TrimSpace(body)
+	batch := len(body) > 0 && body[0] == '['
+	var messages []*common.MailMessage
+	if batch {
+		err = json.Unmarshal(body, &messages)
+	} else {
+		message := new(common.MailMessage)
+		err = json.Unmarshal(body, message)
+		messages = []*common.MailMessage{message}
+	}
+	if err != nil {
+		writeResponse(w, http.StatusBadRequest, &response{Error: fmt.Sprintf("body should be mail json, error - %v", err)})
+		return
+	}
+
+	// письма проверяются по тем же правилам, что и перед отправкой,
+	// поэтому в очередь не попадет письмо, которое заведомо не будет отправлено
+	for i, message := range messages {
+		// служебные поля заполняет только сервис
+		message.ResetState()
+		err = message.Validate()
+		if err != nil {
+			if batch {
+				err = fmt.Errorf("mail#%d: %v", i, err)
+			}
+			writeResponse(w, http.StatusUnprocessableEntity, &response{Error: err.Error()})
+			return
+		}
+	}
+
+	ids := make([]string, 0, len(messages))
+	for _, message := range messages {
+		if len(message.ID) == 0 {
+			message.ID = common.NewID()
+		}
+		err = s.publisher.PublishMail(s.Config.Exchange, message)
+		if err != nil {
+			logger.Warn("api service can't publish mail#%s, error - %v", message.ID, err)
+			// письма, уже положенные в очередь, будут отправлены, поэтому возвращаем их идентификаторы
+			writeResponse(w, http.StatusServiceUnavailable, &response{IDs: ids, Error: err.Error()})
+			return
+		}
+		logger.Info("api service publish mail#%s: envelope - %s, recipient - %s", message.ID, message.Envelope, strings.Join(message.AllRecipients(), ", "))
+		ids = append(ids, message.ID)
+	}
+
+	if batch {
+		writeResponse(w, http.StatusAccepted, &response{IDs: ids})
+	} else {
+		writeResponse(w, http.StatusAccepted, &response{ID: ids[0]})
+	}
+}
+
+// пишет ответ в формате json
+func writeResponse(w http.ResponseWriter, status int, res *response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(res)
+	if err != nil {
+		logger.Warn("api service can't write response, error - %v", err)
+	}
+}
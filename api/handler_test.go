@@ -0,0 +1,114 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/boreevyuri/postmanq/common"
+	"github.com/boreevyuri/postmanq/logger"
+)
+
+func TestMain(m *testing.M) {
+	// без запущенных писателей логов запись в лог блокирует обработчик
+	logger.Inst()
+	os.Exit(m.Run())
+}
+
+// сервис, который запоминает положенные в очередь письма
+type testPublisher struct {
+	messages []*common.MailMessage
+}
+
+// PublishMail запоминает письмо
+func (p *testPublisher) PublishMail(exchange string, message *common.MailMessage) error {
+	p.messages = append(p.messages, message)
+	return nil
+}
+
+// тело запроса, чтение которого прерывается ошибкой
+type brokenBody struct{}
+
+func (brokenBody) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset by peer")
+}
+
+// отправляет запрос на прием писем
+func postMessages(s *Service, body io.Reader) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/messages", body)
+	r.Header.Set("Authorization", bearerScheme+s.Config.Token)
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, r)
+	return w
+}
+
+func TestHandleMessagesResetState(t *testing.T) {
+	publisher := new(testPublisher)
+	s := &Service{Config: Config{Token: "secret", MaxBodySize: defaultMaxBodySize}, publisher: publisher}
+	w := postMessages(s, strings.NewReader(`{
+		"id": "mail-1",
+		"parentId": "mail-0",
+		"envelope": "sender@example.com",
+		"recipient": "user@example.com",
+		"body": "test",
+		"idempotencyKey": "order-1",
+		"idempotencyToken": "00112233445566778899aabbccddeeff",
+		"idempotencyChecked": true,
+		"createdDate": "2020-01-01T00:00:00Z",
+		"bindingType": 2,
+		"error": {"message": "550 5.1.1 unknown user", "code": 550},
+		"trySendingCount": 3,
+		"retryCount": 10,
+		"attempts": [{"code": 451, "message": "try again later"}]
+	}`))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d, body - %s", w.Code, http.StatusAccepted, w.Body)
+	}
+	if len(publisher.messages) != 1 {
+		t.Fatalf("%d mails are published, want 1", len(publisher.messages))
+	}
+	message := publisher.messages[0]
+	if message.ID != "mail-1" || message.IdempotencyKey != "order-1" {
+		t.Errorf("mail id = %s, idempotency key = %s, want fields from request kept", message.ID, message.IdempotencyKey)
+	}
+	// служебные поля из запроса не попадают в очередь
+	if len(message.ParentID) > 0 || len(message.IdempotencyToken) > 0 || !message.CreatedDate.IsZero() ||
+		message.BindingType != common.UnknownDelayedBinding || message.Error != nil ||
+		message.TrySendingCount != 0 || message.RetryCount != 0 || len(message.Attempts) > 0 {
+		t.Errorf("published mail keeps internal fields from request: %+v", message)
+	}
+}
+
+func TestHandleMessagesBodyErrors(t *testing.T) {
+	cases := []struct {
+		name   string
+		body   io.Reader
+		status int
+	}{
+		{"body too large", strings.NewReader(`{"envelope":"sender@example.com","recipient":"user@example.com","body":"` + strings.Repeat("a", 64) + `"}`), http.StatusRequestEntityTooLarge},
+		{"broken body", brokenBody{}, http.StatusBadRequest},
+		{"invalid json", strings.NewReader(`{"envelope":`), http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			publisher := new(testPublisher)
+			s := &Service{Config: Config{Token: "secret", MaxBodySize: 64}, publisher: publisher}
+			w := postMessages(s, c.body)
+			if w.Code != c.status {
+				t.Errorf("status = %d, want %d", w.Code, c.status)
+			}
+			res := new(response)
+			if err := json.NewDecoder(w.Body).Decode(res); err != nil || len(res.Error) == 0 {
+				t.Errorf("response has no error, decode error - %v", err)
+			}
+			if len(publisher.messages) > 0 {
+				t.Error("mail is published")
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package api
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/boreevyuri/postmanq/common"
+	"github.com/boreevyuri/postmanq/connector"
+	"github.com/boreevyuri/postmanq/consumer"
+	"github.com/boreevyuri/postmanq/logger"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	// максимальный размер запроса по умолчанию
+	defaultMaxBodySize = 32 << 20
+
+	// схема авторизации в заголовке Authorization
+	bearerScheme = "Bearer "
+
+	// ошибка http.MaxBytesReader при превышении максимального размера запроса
+	errBodyTooLarge = "http: request body too large"
+)
+
+var (
+	// сервис приема писем по HTTP
+	service *Service
+
+	// канал для приема событий отправки писем
+	events = make(chan *common.SendEvent)
+)
+
+// Service сервис приема писем по HTTP
+type Service struct {
+	Config Config `yaml:"api"`
+
+	// сервис, который кладет письма в очередь
+	publisher common.MailPublisher
+
+	// сервис, который хранит найденные почтовые серверы
+	mailServers common.MailServerCache
+
+	// сервер, принимающий запросы
+	server *http.Server
+}
+
+// Config настройки сервиса приема писем по HTTP
+type Config struct {
+	// адрес, на котором принимаются запросы, если не указан, сервис не запускается
+	Listen string `yaml:"listen"`
+
+	// токен, который клиент передает в заголовке Authorization: Bearer <token>
+	Token string `yaml:"token"`
+
+	// точка обмена, в которую кладутся письма, по умолчанию точка обмена первой связки
+	Exchange string `yaml:"exchange"`
+
+	// максимальный размер запроса в байтах
+	MaxBodySize int64 `yaml:"maxBodySize"`
+}
+
+// Inst создает новый сервис приема писем по HTTP
+func Inst() common.SendingService {
+	if service == nil {
+		service = new(Service)
+		service.publisher = consumer.Inst().(common.MailPublisher)
+		service.mailServers = connector.Inst()
+	}
+	return service
+}
+
+// OnInit инициализирует сервис
+func (s *Service) OnInit(event *common.ApplicationEvent) {
+	logger.Debug("init api service")
+	err := yaml.Unmarshal(event.Data, s)
+	if err == nil {
+		if len(s.Config.Listen) > 0 && len(s.Config.Token) == 0 {
+			logger.FailExit("api service requires token")
+		}
+		if s.Config.MaxBodySize == 0 {
+			s.Config.MaxBodySize = defaultMaxBodySize
+		}
+		if len(s.Config.Listen) > 0 {
+			s.server = &http.Server{Handler: s.routes()}
+		}
+	} else {
+		logger.FailExit("api service can't unmarshal config, error - %v", err)
+	}
+}
+
+// OnRun запускает прием запросов
+func (s *Service) OnRun() {
+	if s.server == nil {
+		return
+	}
+	listener, err := net.Listen("tcp", s.Config.Listen)
+	if err != nil {
+		logger.FailExit("api service can't listen %s, error - %v", s.Config.Listen, err)
+		return
+	}
+	logger.Info("api service listen %s", s.Config.Listen)
+	err = s.server.Serve(listener)
+	if err != nil && err != http.ErrServerClosed {
+		logger.Warn("api service stopped with error - %v", err)
+	}
+}
+
+// Events канал для приема событий отправки писем
+func (s *Service) Events() chan *common.SendEvent {
+	return events
+}
+
+// OnFinish перестает принимать запросы и дожидается ответа на уже принятые
+func (s *Service) OnFinish() {
+	if s.server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), common.App.Timeout().Shutdown)
+	defer cancel()
+	err := s.server.Shutdown(ctx)
+	if err != nil {
+		logger.Warn("api service can't finish requests, error - %v", err)
+	}
+}
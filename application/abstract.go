@@ -2,12 +2,20 @@ package application
 
 import (
 	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/boreevyuri/postmanq/common"
 	"github.com/boreevyuri/postmanq/logger"
 )
 
+const (
+	// время, в течение которого приложение ждет записи логов перед завершением
+	logFlushTimeout = 5 * time.Second
+)
+
 // Abstract базовое приложение
 type Abstract struct {
 	// путь до конфигурационного файла
@@ -22,6 +30,9 @@ type Abstract struct {
 	// флаг, сигнализирующий окончание работы приложения
 	done chan bool
 
+	// код, с которым завершится приложение
+	exitCode int
+
 	CommonTimeout common.Timeout `yaml:"timeouts"`
 }
 
@@ -35,46 +46,62 @@ func (a *Abstract) run(app common.Application, event *common.ApplicationEvent) {
 	app.SetDone(make(chan bool))
 	// создаем каналы для событий
 	app.SetEvents(make(chan *common.ApplicationEvent, 3))
+	go a.notifySignals(app)
 	go func() {
-		for {
-			select {
-			case event := <-app.Events():
-				if event.Kind == common.InitApplicationEventKind {
-					// пытаемся прочитать конфигурационный файл
-					bytes, err := ioutil.ReadFile(a.configFilename)
-					if err == nil {
-						event.Data = bytes
-						app.Init(event)
-					} else {
-						logger.FailExit("application can't read configuration file, error -  %v", err)
-					}
-				}
-
-				for _, service := range app.Services() {
-					switch event.Kind {
-					case common.InitApplicationEventKind:
-						app.FireInit(event, service)
-					case common.RunApplicationEventKind:
-						app.FireRun(event, service)
-					case common.FinishApplicationEventKind:
-						app.FireFinish(event, service)
-					}
+		for event := range app.Events() {
+			if event.Kind == common.InitApplicationEventKind {
+				// пытаемся прочитать конфигурационный файл
+				bytes, err := ioutil.ReadFile(a.configFilename)
+				if err == nil {
+					event.Data = bytes
+					app.Init(event)
+				} else {
+					logger.FailExit("application can't read configuration file, error -  %v", err)
 				}
+			}
 
+			// сервисы останавливаются последовательно в порядке обработки письма,
+			// чтобы получатель успел дождаться писем, которые уже отправляются
+			for _, service := range app.Services() {
 				switch event.Kind {
 				case common.InitApplicationEventKind:
-					event.Kind = common.RunApplicationEventKind
-					app.Events() <- event
+					app.FireInit(event, service)
+				case common.RunApplicationEventKind:
+					app.FireRun(event, service)
 				case common.FinishApplicationEventKind:
-					time.Sleep(30 * time.Second)
-					app.Done() <- true
+					app.FireFinish(event, service)
 				}
 			}
+
+			switch event.Kind {
+			case common.InitApplicationEventKind:
+				event.Kind = common.RunApplicationEventKind
+				app.Events() <- event
+			case common.FinishApplicationEventKind:
+				a.exitCode = event.ExitCode
+				app.Done() <- true
+				return
+			}
 		}
-		close(app.Events())
 	}()
 	app.Events() <- event
 	<-app.Done()
+	// асинхронный логер мог еще не записать сообщения об остановке сервисов
+	logger.Flush(logFlushTimeout)
+	os.Exit(a.exitCode)
+}
+
+// слушает сигналы завершения и останавливает приложение
+// повторный сигнал завершает приложение, не дожидаясь остановки сервисов
+func (a *Abstract) notifySignals(app common.Application) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	logger.Info("application receive signal %v, stopping...", sig)
+	app.Events() <- common.NewApplicationEvent(common.FinishApplicationEventKind)
+	sig = <-signals
+	logger.Warn("application receive signal %v again, exit immediately", sig)
+	os.Exit(common.FailureExitCode)
 }
 
 // SetConfigFilename устанавливает путь к файлу с настройками
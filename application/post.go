@@ -3,6 +3,7 @@ package application
 import (
 	"runtime"
 
+	"github.com/boreevyuri/postmanq/api"
 	"github.com/boreevyuri/postmanq/common"
 	"github.com/boreevyuri/postmanq/connector"
 	"github.com/boreevyuri/postmanq/consumer"
@@ -10,6 +11,7 @@ import (
 	"github.com/boreevyuri/postmanq/limiter"
 	"github.com/boreevyuri/postmanq/logger"
 	"github.com/boreevyuri/postmanq/mailer"
+	"github.com/boreevyuri/postmanq/msa"
 	yaml "gopkg.in/yaml.v2"
 )
 
@@ -37,6 +39,8 @@ func (p *Post) Run() {
 	}
 	p.services = []interface{}{
 		logger.Inst(),
+		api.Inst(),
+		msa.Inst(),
 		consumer.Inst(),
 		guardian.Inst(),
 		limiter.Inst(),
@@ -67,7 +71,8 @@ func (p *Post) FireRun(event *common.ApplicationEvent, abstractService interface
 }
 
 // FireFinish останавливает сервисы приложения
+// сервис останавливается синхронно, следующий сервис останавливается только после него
 func (p *Post) FireFinish(event *common.ApplicationEvent, abstractService interface{}) {
 	service := abstractService.(common.SendingService)
-	go service.OnFinish()
+	service.OnFinish()
 }
@@ -31,6 +31,18 @@ type SMTPClient struct {
 	// реальный smtp клиент
 	Worker *smtp.Client
 
+	// почтовый сервер, к которому подключен клиент
+	Hostname string
+
+	// ip, с которого установлено соединение
+	Address string
+
+	// используется ли TLS соединение
+	TLS bool
+
+	// сигнализирует, что сервер принимает письма по LMTP и отвечает после письма за каждого получателя
+	LMTP bool
+
 	// дата создания или изменения статуса клиента
 	ModifyDate time.Time
 
@@ -74,3 +86,17 @@ func (s *SMTPClient) Wakeup() {
 		s.timer = nil
 	}
 }
+
+// Quit завершает сессию с почтовым сервисом командой QUIT
+// если сервис не ответит за указанное время, соединение будет разорвано
+func (s *SMTPClient) Quit(timeout time.Duration) {
+	if s.Status != DisconnectedSMTPClientStatus {
+		s.Wakeup()
+		s.SetTimeout(timeout)
+		err := s.Worker.Quit()
+		if err != nil {
+			s.Worker.Close()
+		}
+	}
+	s.Status = DisconnectedSMTPClientStatus
+}
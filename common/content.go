@@ -0,0 +1,124 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// MailContent содержимое письма, из которого PostmanQ сам собирает тело письма
+// используется вместо "body", если приложению неудобно собирать MIME самому
+type MailContent struct {
+	// отправитель для заголовка From "from" из очереди, например "Иван Петров <ivan@example.com>", по умолчанию envelope
+	From string `json:"from,omitempty"`
+
+	// получатели для заголовка To "to" из очереди, по умолчанию получатели письма
+	To []string `json:"to,omitempty"`
+
+	// тема письма "subject" из очереди
+	Subject string `json:"subject,omitempty"`
+
+	// текстовая версия письма "text" из очереди
+	Text string `json:"text,omitempty"`
+
+	// HTML версия письма "html" из очереди
+	HTML string `json:"html,omitempty"`
+
+	// идентификатор шаблона "template" из очереди, из шаблона берутся тема, текстовая и HTML версии письма,
+	// если они не указаны в самом письме
+	Template string `json:"template,omitempty"`
+
+	// переменные для шаблона "vars" из очереди
+	Vars map[string]interface{} `json:"vars,omitempty"`
+
+	// дополнительные заголовки "headers" из очереди, например Reply-To или List-Unsubscribe
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// картинки, на которые ссылается HTML версия письма по cid "inline" из очереди
+	Inline []*MailAttachment `json:"inline,omitempty"`
+
+	// вложения "attachments" из очереди
+	Attachments []*MailAttachment `json:"attachments,omitempty"`
+}
+
+// MailAttachment вложение письма
+type MailAttachment struct {
+	// имя файла "filename"
+	Filename string `json:"filename"`
+
+	// тип содержимого "contentType", по умолчанию определяется по расширению файла
+	ContentType string `json:"contentType,omitempty"`
+
+	// идентификатор для ссылки из HTML "contentId", например <img src="cid:logo">, обязателен для inline
+	ContentID string `json:"contentId,omitempty"`
+
+	// содержимое файла в base64 "content"
+	Content []byte `json:"content"`
+}
+
+var (
+	// заголовки, которые собираются из содержимого письма и не могут быть указаны в дополнительных заголовках
+	structuralHeaders = map[string]bool{
+		"Mime-Version":              true,
+		"Content-Type":              true,
+		"Content-Transfer-Encoding": true,
+		"From":                      true,
+		"To":                        true,
+		"Subject":                   true,
+	}
+
+	// заголовки со списком адресов, имена в адресах кодируются отдельно от самих адресов
+	addressHeaders = map[string]bool{
+		"Reply-To": true,
+		"Cc":       true,
+		"Sender":   true,
+	}
+)
+
+// IsAddressHeader сигнализирует, что значение заголовка - список адресов
+func IsAddressHeader(name string) bool {
+	return addressHeaders[textproto.CanonicalMIMEHeaderKey(name)]
+}
+
+// проверяет содержимое письма
+func (c *MailContent) validate() error {
+	if len(c.Text) == 0 && len(c.HTML) == 0 && len(c.Template) == 0 {
+		return errors.New("content has neither text nor html nor template")
+	}
+	if len(c.From) > 0 {
+		if _, err := mail.ParseAddress(c.From); err != nil {
+			return fmt.Errorf("from %s is invalid", c.From)
+		}
+	}
+	for _, to := range c.To {
+		if _, err := mail.ParseAddress(to); err != nil {
+			return fmt.Errorf("to %s is invalid", to)
+		}
+	}
+	for name, value := range c.Headers {
+		if len(name) == 0 || strings.ContainsAny(name, ": \t\r\n") || strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("header %q is invalid", name)
+		}
+		if structuralHeaders[textproto.CanonicalMIMEHeaderKey(name)] {
+			return fmt.Errorf("header %s can't be set in headers", name)
+		}
+		if IsAddressHeader(name) {
+			if _, err := mail.ParseAddressList(value); err != nil {
+				return fmt.Errorf("header %s is invalid", name)
+			}
+		}
+	}
+	for _, attachment := range c.Inline {
+		if len(attachment.ContentID) == 0 {
+			return fmt.Errorf("inline %s has no contentId", attachment.Filename)
+		}
+	}
+	for _, attachment := range c.Attachments {
+		if len(attachment.Filename) == 0 {
+			return errors.New("attachment has no filename")
+		}
+	}
+	return nil
+}
@@ -16,6 +16,14 @@ const (
 	FinishApplicationEventKind
 )
 
+const (
+	// SuccessExitCode приложение завершилось штатно
+	SuccessExitCode = 0
+
+	// FailureExitCode приложение завершилось из-за ошибки
+	FailureExitCode = 1
+)
+
 // ApplicationEvent событие приложения
 type ApplicationEvent struct {
 	// тип события
@@ -26,6 +34,9 @@ type ApplicationEvent struct {
 
 	// аргументы командной строки
 	Args map[string]interface{}
+
+	// код, с которым завершится приложение, используется событием завершения
+	ExitCode int
 }
 
 // GetBoolArg возвращает аргумент, как булевый тип
@@ -90,6 +101,34 @@ type SendEvent struct {
 
 	// очередь, в которую необходимо будет положить клиента после отправки письма
 	Queue *LimitedQueue
+
+	// попытка отправки письма, совершенная в рамках события
+	Attempt *MailAttempt
+
+	// получатели, отклоненные почтовым сервисом при отправке письма нескольким адресатам
+	Rejected []*RejectedRecipient
+
+	// доставка без SMTP, если письмо не отправляется почтовому сервису, а, например, сохраняется в maildir
+	Delivery LocalDelivery
+}
+
+// LocalDelivery доставка письма без SMTP
+type LocalDelivery interface {
+	// Deliver доставляет письмо одному получателю, возвращает ответ для истории письма
+	// письмо доставляется получателям по отдельности, поэтому при повторной отправке получатели, которым письмо уже доставлено, не получат его снова
+	Deliver(message *MailMessage, recipient string) (string, error)
+}
+
+// RejectedRecipient получатель, отклоненный почтовым сервисом
+type RejectedRecipient struct {
+	// адрес получателя
+	Recipient string
+
+	// ошибка с кодом ответа почтового сервиса, nil, если код не получен
+	Error *MailError
+
+	// попытка отправки письма получателю
+	Attempt *MailAttempt
 }
 
 // NewSendEvent создает событие отправки сообщения
@@ -101,3 +140,40 @@ func NewSendEvent(message *MailMessage) *SendEvent {
 	event.Iterator = NewIterator(Services)
 	return event
 }
+
+// AddAttempt добавляет попытку отправки в историю письма
+// данные о почтовом сервере берутся из клиента, если он уже получен
+func (e *SendEvent) AddAttempt(code int, message string) {
+	e.Attempt = e.newAttempt(code, message)
+	e.Message.Attempts = append(e.Message.Attempts, e.Attempt)
+}
+
+// Reject запоминает получателя, которого отклонил почтовый сервис
+// такой получатель не попадает в историю письма, т.к. письмо для него будет отправлено отдельно
+func (e *SendEvent) Reject(recipient string, err error) {
+	rejected := &RejectedRecipient{
+		Recipient: recipient,
+		Error:     ParseMailError(err),
+	}
+	if rejected.Error == nil {
+		rejected.Attempt = e.newAttempt(0, err.Error())
+	} else {
+		rejected.Attempt = e.newAttempt(rejected.Error.Code, rejected.Error.Message)
+	}
+	e.Rejected = append(e.Rejected, rejected)
+}
+
+// создает попытку отправки
+func (e *SendEvent) newAttempt(code int, message string) *MailAttempt {
+	attempt := &MailAttempt{
+		Date:    time.Now(),
+		Code:    code,
+		Message: message,
+	}
+	if e.Client != nil {
+		attempt.MxHostname = e.Client.Hostname
+		attempt.Address = e.Client.Address
+		attempt.TLS = e.Client.TLS
+	}
+	return attempt
+}
@@ -1,7 +1,9 @@
 package common
 
 import (
+	"crypto/rand"
 	"errors"
+	"fmt"
 	"regexp"
 	"strconv"
 	"strings"
@@ -11,8 +13,6 @@ import (
 const (
 	// MaxTryConnectionCount Максимальное количество попыток подключения к почтовику за отправку письма
 	MaxTryConnectionCount int = 30
-	// MaxSendingCount Максимальное количество попыток отправки письма
-	MaxSendingCount int = 96
 )
 
 var (
@@ -29,6 +29,7 @@ type Timeout struct {
 	Mail       time.Duration `yaml:"mail"`
 	Rcpt       time.Duration `yaml:"rcpt"`
 	Data       time.Duration `yaml:"data"`
+	Shutdown   time.Duration `yaml:"shutdown"`
 }
 
 // Init инициализирует значения таймаутов по умолчанию
@@ -54,6 +55,9 @@ func (t *Timeout) Init() {
 	if t.Data == 0 {
 		t.Data = 10 * time.Minute
 	}
+	if t.Shutdown == 0 {
+		t.Shutdown = 30 * time.Second
+	}
 }
 
 // DelayedBindingType тип отложенной очереди
@@ -99,10 +103,36 @@ type MailError struct {
 	Code int `json:"code"`
 }
 
+// MailAttempt попытка отправки письма
+type MailAttempt struct {
+	// дата попытки
+	Date time.Time `json:"date"`
+
+	// почтовый сервер, которому отправлялось письмо
+	MxHostname string `json:"mx,omitempty"`
+
+	// ip, с которого отправлялось письмо
+	Address string `json:"localIp,omitempty"`
+
+	// использовалось ли TLS соединение
+	TLS bool `json:"tls"`
+
+	// код ответа почтового сервиса
+	Code int `json:"code,omitempty"`
+
+	// текст ответа почтового сервиса или ошибки
+	Message string `json:"message,omitempty"`
+}
+
 // MailMessage письмо
 type MailMessage struct {
-	// идентификатор для логов
-	ID int64 `json:"-"`
+	// идентификатор письма "id" из очереди, если не указан, назначается при первом получении письма
+	// сохраняется при повторных отправках, поэтому по нему можно найти в логах все попытки отправки
+	ID string `json:"id"`
+
+	// идентификатор письма "parentId", из которого выделено письмо для части получателей
+	// у частей и копий для отклоненных получателей всегда новый идентификатор, даже если письмо делится повторно
+	ParentID string `json:"parentId,omitempty"`
 
 	// отправитель из "envelope" из очереди
 	Envelope string `json:"envelope"`
@@ -110,19 +140,43 @@ type MailMessage struct {
 	// получатель "recipient" из очереди
 	Recipient string `json:"recipient"`
 
+	// получатели "recipients" из очереди, используются вместо recipient для отправки письма нескольким адресатам
+	Recipients []string `json:"recipients,omitempty"`
+
 	// тело письма "body" из очереди
 	Body string `json:"body"`
 
+	// содержимое письма, из которого собирается тело, если "body" не указан
+	*MailContent
+
 	// домен отправителя, удобно сразу получить и использовать далее
 	HostnameFrom string `json:"-"`
 
 	// Домен получателя, удобно сразу получить и использовать далее
 	HostnameTo string `json:"-"`
 
-	// дата создания, используется в основном сервисом ограничений
-	CreatedDate time.Time `json:"-"`
+	// ключ идемпотентности "idempotencyKey" из очереди, необязательный параметр
+	// письмо с ключом, которое уже было обработано в пределах окна проверки, не отправляется
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+
+	// токен, выданный сервисом письму при первом получении и проверке ключа идемпотентности
+	// сохраняется при повторных, отложенных отправках и в частях письма, поэтому они не считаются повторами
+	// токен сверяется с хранилищем ключей, поэтому указанный приложением токен не отменяет проверку
+	IdempotencyToken string `json:"idempotencyToken,omitempty"`
+
+	// дата первого получения письма из очереди "createdDate"
+	CreatedDate time.Time `json:"createdDate"`
 
-	// тип очереди, в которою письмо уже было отправлено после неудачной отправки, ипользуется для цепочки очередей
+	// дата, после которой письмо не отправляется "expiresAt" из очереди, необязательный параметр
+	ExpiresAt time.Time `json:"expiresAt"`
+
+	// время жизни письма в секундах "ttl" из очереди, используется, если не указан expiresAt
+	TTL int `json:"ttl"`
+
+	// дата, раньше которой письмо не отправляется "sendAt" из очереди, необязательный параметр
+	SendAt time.Time `json:"sendAt"`
+
+	// тип отложенной очереди, в которую письмо кладется при превышении лимита
 	BindingType DelayedBindingType `json:"bindingType"`
 
 	// ошибка отправки "error" из очереди
@@ -130,13 +184,38 @@ type MailMessage struct {
 
 	// количество попыток отправки "trySendingCount" из очереди
 	TrySendingCount int `json:"trySendingCount"`
+
+	// количество повторных отправок по расписанию "retryCount" из очереди
+	RetryCount int `json:"retryCount"`
+
+	// история попыток отправки "attempts" из очереди
+	Attempts []*MailAttempt `json:"attempts"`
+}
+
+// NewID создает идентификатор письма - случайный UUID версии 4
+func NewID() string {
+	var uuid [16]byte
+	rand.Read(uuid[:])
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:])
 }
 
 // Init инициализирует письмо
+// идентификатор и дата создания назначаются только при первом получении письма
 func (m *MailMessage) Init() {
-	m.ID = time.Now().UnixNano()
-	m.TrySendingCount++
-	m.CreatedDate = time.Now()
+	if len(m.ID) == 0 {
+		m.ID = NewID()
+	}
+	if len(m.Recipients) > 0 {
+		m.Recipient = m.Recipients[0]
+	}
+	if m.CreatedDate.IsZero() {
+		m.CreatedDate = time.Now()
+	}
+	if m.ExpiresAt.IsZero() && m.TTL > 0 {
+		m.ExpiresAt = m.CreatedDate.Add(time.Duration(m.TTL) * time.Second)
+	}
 	if hostname, err := m.getHostnameFromEmail(m.Envelope); err == nil {
 		m.HostnameFrom = hostname
 	}
@@ -145,6 +224,83 @@ func (m *MailMessage) Init() {
 	}
 }
 
+// ResetState сбрасывает служебные поля, которые заполняет сервис при обработке письма
+// используется для писем от приложений, чтобы приложение не могло подделать историю отправки или пропустить проверки
+func (m *MailMessage) ResetState() {
+	m.ParentID = ""
+	m.IdempotencyToken = ""
+	m.CreatedDate = time.Time{}
+	m.BindingType = UnknownDelayedBinding
+	m.Error = nil
+	m.TrySendingCount = 0
+	m.RetryCount = 0
+	m.Attempts = nil
+}
+
+// Validate проверяет адреса отправителя и получателей письма и содержимое письма
+func (m *MailMessage) Validate() error {
+	if !EmailRegexp.MatchString(m.Envelope) {
+		return fmt.Errorf("envelope %s is invalid", m.Envelope)
+	}
+	for _, recipient := range m.AllRecipients() {
+		if !EmailRegexp.MatchString(recipient) {
+			return fmt.Errorf("recipient %s is invalid", recipient)
+		}
+	}
+	if m.MailContent != nil {
+		if len(m.Body) > 0 {
+			return errors.New("mail has both body and content")
+		}
+		return m.MailContent.validate()
+	}
+	return nil
+}
+
+// AllRecipients отдает всех получателей письма
+func (m *MailMessage) AllRecipients() []string {
+	if len(m.Recipients) > 0 {
+		return m.Recipients
+	}
+	return []string{m.Recipient}
+}
+
+// ForRecipients создает копию письма для части получателей
+// копия получает новый идентификатор, а идентификатор письма запоминается в ParentID
+func (m *MailMessage) ForRecipients(recipients []string) *MailMessage {
+	message := *m
+	message.ID = NewID()
+	message.ParentID = m.ID
+	message.Recipient = recipients[0]
+	if len(recipients) > 1 {
+		message.Recipients = recipients
+	} else {
+		message.Recipients = nil
+	}
+	message.Attempts = append([]*MailAttempt{}, m.Attempts...)
+	if m.MailContent != nil {
+		content := *m.MailContent
+		message.MailContent = &content
+	}
+	return &message
+}
+
+// IsDueAt сигнализирует, что к указанной дате письмо пора отправлять
+func (m *MailMessage) IsDueAt(date time.Time) bool {
+	return !date.Before(m.SendAt)
+}
+
+// IsExpiredAt сигнализирует, что к указанной дате письмо устареет
+func (m *MailMessage) IsExpiredAt(date time.Time) bool {
+	return !m.ExpiresAt.IsZero() && date.After(m.ExpiresAt)
+}
+
+// Expire помечает письмо устаревшим
+func (m *MailMessage) Expire() {
+	m.Error = &MailError{
+		Message: fmt.Sprintf("mail expired at %s after %d attempts", m.ExpiresAt.Format(time.RFC3339), len(m.Attempts)),
+	}
+}
+
 // получает домен из адреса "user@domain"
 func (m *MailMessage) getHostnameFromEmail(email string) (string, error) {
 	matches := EmailRegexp.FindAllStringSubmatch(email, -1)
@@ -154,23 +310,50 @@ func (m *MailMessage) getHostnameFromEmail(email string) (string, error) {
 	return "", errors.New("invalid email address")
 }
 
-// ReturnMail возвращает письмо обратно в очередь после ошибки во время отправки
-func ReturnMail(event *SendEvent, err error) {
-	// необходимо проверить сообщение на наличие кода ошибки
-	// обычно код идет первым
+// ParseMailError получает ошибку с кодом из ответа почтового сервиса
+// обычно код идет первым, если кода нет, возвращается nil
+func ParseMailError(err error) *MailError {
 	if err != nil {
 		errorMessage := err.Error()
 		parts := strings.Split(errorMessage, " ")
 		if len(parts) > 0 {
 			// пытаемся получить код
 			code, e := strconv.Atoi(strings.TrimSpace(parts[0]))
-			// и создать ошибку
-			// письмо с ошибкой вернется в другую очередь, отличную от письмо без ошибки
 			if e == nil {
-				event.Message.Error = &MailError{errorMessage, code}
+				return &MailError{errorMessage, code}
 			}
 		}
 	}
+	return nil
+}
+
+// ErrorSendEventResultFor отдает результат отправки письма для ошибки
+// письмо без кода ошибки или с 4XX ошибкой отправляется повторно
+func ErrorSendEventResultFor(mailError *MailError) SendEventResult {
+	if mailError == nil || mailError.Code >= 400 && mailError.Code < 500 {
+		return DelaySendEventResult
+	}
+	return ErrorSendEventResult
+}
+
+// ReturnMail возвращает письмо обратно в очередь после ошибки во время отправки
+func ReturnMail(event *SendEvent, err error) {
+	// необходимо проверить сообщение на наличие кода ошибки
+	// письмо с ошибкой вернется в другую очередь, отличную от письмо без ошибки
+	// ошибка предыдущей попытки сброшена получателем, поэтому ошибка без кода не получит ее код
+	mailError := ParseMailError(err)
+	if mailError != nil {
+		event.Message.Error = mailError
+	}
+
+	// запоминаем попытку отправки с настоящей ошибкой, даже если у нее нет кода
+	if err != nil {
+		var code int
+		if mailError != nil {
+			code = mailError.Code
+		}
+		event.AddAttempt(code, err.Error())
+	}
 
 	// если в событии уже создан клиент
 	if event.Client != nil {
@@ -181,13 +364,5 @@ func ReturnMail(event *SendEvent, err error) {
 	}
 
 	// отпускаем поток получателя сообщений из очереди
-	if event.Message.Error == nil {
-		event.Result <- DelaySendEventResult
-	} else {
-		if event.Message.Error.Code >= 400 && event.Message.Error.Code < 500 {
-			event.Result <- DelaySendEventResult
-		} else {
-			event.Result <- ErrorSendEventResult
-		}
-	}
+	event.Result <- ErrorSendEventResultFor(event.Message.Error)
 }
@@ -1,5 +1,7 @@
 package common
 
+import "time"
+
 // программа отправки почты получилась довольно сложной, т.к. она выполняет обработку и отправку писем,
 // работает с диском и с сетью, ведет логирование и проверяет ограничения перед отправкой
 // из - за такого насыщенного функционала, было принято решение разбить программу на логические части - сервисы
@@ -44,3 +46,42 @@ type GrepService interface {
 	Service
 	OnGrep(*ApplicationEvent)
 }
+
+// MailPublisher сервис, который кладет письма в очередь
+// используется сервисами, принимающими письма не из очереди
+type MailPublisher interface {
+	PublishMail(exchange string, message *MailMessage) error
+}
+
+// MailServerCache сервис, который хранит найденные почтовые серверы доменов
+type MailServerCache interface {
+	FlushMailServer(hostname string) bool
+	TLSStates(hostname string) ([]*MxTLSState, bool)
+}
+
+// MxTLSState состояние TLS почтового сервера
+type MxTLSState struct {
+	// домен получателя
+	Domain string `json:"domain"`
+
+	// доменное имя почтового сервера
+	Hostname string `json:"hostname"`
+
+	// режим TLS - none, opportunistic или required
+	Mode string `json:"mode"`
+
+	// способ проверки сертификата - dane-verified, pkix или none
+	Verification string `json:"verification"`
+
+	// количество неудачных попыток открыть TLS соединение подряд
+	Failures int `json:"failures"`
+
+	// дата последней неудачной попытки
+	FailedAt *time.Time `json:"failedAt,omitempty"`
+
+	// дата, после которой TLS соединение будет открыто снова
+	RetryAt *time.Time `json:"retryAt,omitempty"`
+
+	// ошибка последней неудачной попытки
+	Error string `json:"error,omitempty"`
+}
@@ -0,0 +1,133 @@
+package connector
+
+import (
+	"fmt"
+	"net"
+)
+
+// версия IP
+type ipVersion int
+
+const (
+	ipv4Version ipVersion = 4
+	ipv6Version ipVersion = 6
+)
+
+var (
+	// версии IP по названиям из настроек
+	ipVersions = map[string]ipVersion{
+		"ipv4": ipv4Version,
+		"ipv6": ipv6Version,
+	}
+)
+
+// отдает версию IP
+func versionOf(ip net.IP) ipVersion {
+	if ip.To4() != nil {
+		return ipv4Version
+	}
+	return ipv6Version
+}
+
+// IPPreference предпочтительная версия IP для отправки писем
+type IPPreference struct {
+	// версия IP по умолчанию, ipv4 или ipv6
+	Default string `yaml:"default"`
+
+	// версия IP для доменов получателей, в качестве ключа используется домен
+	Domains map[string]string `yaml:"domains"`
+
+	// версия IP по умолчанию
+	defaultVersion ipVersion
+
+	// версии IP для доменов
+	versions map[string]ipVersion
+}
+
+// проверяет настройки
+func (p *IPPreference) init() error {
+	if len(p.Default) == 0 {
+		p.Default = "ipv4"
+	}
+	version, ok := ipVersions[p.Default]
+	if !ok {
+		return fmt.Errorf("unknown ip version %s", p.Default)
+	}
+	p.defaultVersion = version
+	p.versions = make(map[string]ipVersion)
+	for domain, name := range p.Domains {
+		version, ok := ipVersions[name]
+		if !ok {
+			return fmt.Errorf("unknown ip version %s for %s", name, domain)
+		}
+		p.versions[domain] = version
+	}
+	return nil
+}
+
+// отдает версии IP для домена в порядке предпочтения
+func (p *IPPreference) order(hostname string) []ipVersion {
+	version, ok := p.versions[hostname]
+	if !ok {
+		version = p.defaultVersion
+	}
+	if version == ipv6Version {
+		return []ipVersion{ipv6Version, ipv4Version}
+	}
+	return []ipVersion{ipv4Version, ipv6Version}
+}
+
+// делит ip, с которых рассылаются письма, по версиям
+func (s *Service) initAddresses() error {
+	s.addresses = make(map[ipVersion][]string)
+	for _, address := range s.Addresses {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return fmt.Errorf("invalid ip %s", address)
+		}
+		version := versionOf(ip)
+		s.addresses[version] = append(s.addresses[version], address)
+	}
+	return s.IPPreference.init()
+}
+
+// выбирает ip, с которого будет отправлено письмо почтовому серверу
+// сначала выбирается предпочтительная для домена версия IP, другая версия выбирается, если у сервера нет адресов
+// предпочтительной версии или для нее не указаны ip в настройках
+func (s *Service) sourceAddress(id int, hostname string, mxServer *MxServer) string {
+	for _, version := range s.IPPreference.order(hostname) {
+		addresses := s.addresses[version]
+		if len(addresses) > 0 && mxServer.hasIPVersion(version) {
+			return addresses[id%len(addresses)]
+		}
+	}
+	return s.Addresses[id%s.addressesLen]
+}
+
+// сигнализирует, что у сервера есть адреса указанной версии
+// если адреса сервера неизвестны, например, у релея, подходит любая версия
+func (m *MxServer) hasIPVersion(version ipVersion) bool {
+	for _, ip := range m.ips {
+		if versionOf(ip) == version {
+			return true
+		}
+	}
+	return len(m.ips) == 0
+}
+
+// отдает адреса для соединения к серверу с ip той же версии, что и ip отправителя
+// ip релея и LMTP сервера не ищутся, поэтому соединение к ним открывается по имени сервера,
+// а к почтовым серверам домена - только по ip, найденным резолвером
+func (m *MxServer) dialAddresses(source string) []string {
+	if m.relay != nil || m.lmtp {
+		return []string{net.JoinHostPort(m.hostname, m.port)}
+	}
+	version := versionOf(net.ParseIP(source))
+	addresses := make([]string, 0, len(m.ips))
+	for _, ip := range m.ips {
+		if versionOf(ip) == version {
+			addresses = append(addresses, net.JoinHostPort(ip.String(), m.port))
+		}
+	}
+	return addresses
+}
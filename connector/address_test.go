@@ -0,0 +1,45 @@
+package connector
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestDialAddresses(t *testing.T) {
+	mxServer := newMxServer("mx.example.com", nil)
+	mxServer.ips = []net.IP{net.ParseIP("2001:db8::10"), net.ParseIP("192.0.2.10"), net.ParseIP("192.0.2.11")}
+	relay := newMxServer("relay.example.com", nil)
+	relay.port = "587"
+	relay.relay = &Relay{Host: "relay.example.com:587"}
+	cases := []struct {
+		name      string
+		mxServer  *MxServer
+		source    string
+		addresses []string
+	}{
+		{"ipv4 source", mxServer, "192.0.2.1", []string{"192.0.2.10:25", "192.0.2.11:25"}},
+		{"ipv6 source", mxServer, "2001:db8::1", []string{"[2001:db8::10]:25"}},
+		{"server without ips of source version", newMxServerWithIPs("2001:db8::10"), "192.0.2.1", []string{}},
+		{"relay without ips", relay, "192.0.2.1", []string{"relay.example.com:587"}},
+		// имя почтового сервера не резолвится в обход резолвера сервиса
+		{"mx without ips", newMxServerWithIPs(), "192.0.2.1", []string{}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			addresses := c.mxServer.dialAddresses(c.source)
+			if strings.Join(addresses, " ") != strings.Join(c.addresses, " ") {
+				t.Errorf("dialAddresses(%s) = %v, want %v", c.source, addresses, c.addresses)
+			}
+		})
+	}
+}
+
+// создает почтовый сервер с найденными ip
+func newMxServerWithIPs(ips ...string) *MxServer {
+	mxServer := newMxServer("mx.example.com", nil)
+	for _, ip := range ips {
+		mxServer.ips = append(mxServer.ips, net.ParseIP(ip))
+	}
+	return mxServer
+}
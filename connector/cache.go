@@ -0,0 +1,228 @@
+package connector
+
+import (
+	"net"
+	"sort"
+	"time"
+
+	"github.com/boreevyuri/postmanq/common"
+	"github.com/boreevyuri/postmanq/logger"
+)
+
+const (
+	// время жизни найденных почтовых серверов домена по умолчанию
+	defaultDNSTTL = time.Hour
+
+	// время, в течение которого домен не ищется заново после ошибки поиска, по умолчанию
+	defaultDNSNegativeTTL = 5 * time.Minute
+
+	// период проверки устаревших почтовых сервисов
+	refreshInterval = 10 * time.Second
+)
+
+// DNSConfig настройки поиска почтовых серверов
+// стандартный резолвер не отдает TTL DNS записей, поэтому время жизни найденных серверов задается в настройках
+type DNSConfig struct {
+	// время, в течение которого используются найденные почтовые серверы домена
+	TTL time.Duration `yaml:"ttl"`
+
+	// время, в течение которого домен, для которого не удалось найти почтовые серверы, не ищется заново
+	NegativeTTL time.Duration `yaml:"negativeTtl"`
+
+	// DNS серверы в виде ip или ip:port, по умолчанию используются серверы операционной системы
+	Nameservers []string `yaml:"nameservers"`
+
+	// время ожидания ответа DNS сервера
+	Timeout time.Duration `yaml:"timeout"`
+
+	// количество повторных запросов после временной ошибки
+	Retries int `yaml:"retries"`
+}
+
+// устанавливает значения по умолчанию
+func (d *DNSConfig) init() {
+	if d.TTL == 0 {
+		d.TTL = defaultDNSTTL
+	}
+	if d.NegativeTTL == 0 {
+		d.NegativeTTL = defaultDNSNegativeTTL
+	}
+	if d.Timeout == 0 {
+		d.Timeout = defaultDNSTimeout
+	}
+	if d.Retries == 0 {
+		d.Retries = defaultDNSRetries
+	}
+}
+
+// обновляет серверы почтового сервиса после поиска
+// серверы, которые остались в MX записях, сохраняются вместе с открытыми соединениями
+// если повторный поиск не удался, продолжают использоваться найденные ранее серверы
+// возвращает серверы, которых больше нет в MX записях
+func (m *MailServer) update(mxServers []*MxServer, err error) []*MxServer {
+	seekerMutex.Lock()
+	defer seekerMutex.Unlock()
+	now := time.Now()
+	if err == errNullMX {
+		// домен явно отказался от почты, поэтому ответ кешируется как успешный
+		removed := m.mxServers
+		m.mxServers = nil
+		m.status = NullMxMailServerStatus
+		m.expiresAt = now.Add(service.DNS.TTL)
+		return removed
+	}
+	m.err = err
+	if err != nil {
+		if m.status != SuccessMailServerStatus {
+			m.status = ErrorMailServerStatus
+		}
+		m.expiresAt = now.Add(service.DNS.NegativeTTL)
+		return nil
+	}
+
+	existing := make(map[string]*MxServer)
+	for _, mxServer := range m.mxServers {
+		existing[mxServer.hostname] = mxServer
+	}
+	for i, mxServer := range mxServers {
+		if existingMxServer, ok := existing[mxServer.hostname]; ok {
+			// политика TLS домена могла измениться
+			// сервер может использоваться соединителями, поэтому политика меняется под семафором
+			existingMxServer.setPolicy(mxServer)
+			mxServers[i] = existingMxServer
+			delete(existing, mxServer.hostname)
+		}
+	}
+	removed := make([]*MxServer, 0, len(existing))
+	for _, mxServer := range existing {
+		removed = append(removed, mxServer)
+	}
+	m.mxServers = mxServers
+	m.status = SuccessMailServerStatus
+	m.expiresAt = now.Add(service.DNS.TTL)
+	for _, mxServer := range mxServers {
+		// письма серверу откладываются, пока не удастся найти TLSA записи, поэтому серверы ищутся заново раньше
+		if mxServer.daneError() != nil {
+			m.expiresAt = now.Add(service.DNS.NegativeTTL)
+			break
+		}
+	}
+	return removed
+}
+
+// сигнализирует, что домена нет или у него нет адресов, а не что поиск не удался из-за временной ошибки DNS
+// только в этом случае письмо нельзя доставить и повторная отправка не поможет
+func (m *MailServer) notFound() bool {
+	seekerMutex.Lock()
+	defer seekerMutex.Unlock()
+	dnsErr, ok := m.err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
+
+// отдает серверы почтового сервиса
+func (m *MailServer) servers() []*MxServer {
+	seekerMutex.Lock()
+	defer seekerMutex.Unlock()
+	return m.mxServers
+}
+
+// закрывает свободные соединения к серверу
+// соединения, по которым сейчас отправляются письма, закроются почтовым сервером по таймауту
+func (m *MxServer) quitClients() {
+	for _, queue := range m.queues {
+		for client := queue.Pop(); client != nil; client = queue.Pop() {
+			smtpClient := client.(*common.SMTPClient)
+			smtpClient.Quit(quitTimeout)
+			logger.Debug("connection service quit smtp client#%d for %s", smtpClient.ID, m.hostname)
+		}
+	}
+}
+
+// периодически ищет заново почтовые серверы доменов, время жизни которых истекло
+// домены, на которые за время жизни не отправлялись письма, удаляются
+func refreshMailServers() {
+	for now := range time.Tick(refreshInterval) {
+		expired := make(map[string]*MailServer)
+		unused := make([]*MxServer, 0)
+		seekerMutex.Lock()
+		for hostname, mailServer := range mailServers {
+			if mailServer.status == LookupMailServerStatus || now.Before(mailServer.expiresAt) {
+				continue
+			}
+			if now.Sub(mailServer.usedAt) > service.DNS.TTL {
+				delete(mailServers, hostname)
+				unused = append(unused, mailServer.mxServers...)
+				logger.Debug("connection service remove unused mail server %s", hostname)
+			} else {
+				expired[hostname] = mailServer
+			}
+		}
+		seekerMutex.Unlock()
+
+		for _, mxServer := range unused {
+			mxServer.quitClients()
+		}
+		for hostname, mailServer := range expired {
+			mxServers, err := service.lookupMxServers("refresher", hostname)
+			for _, mxServer := range mailServer.update(mxServers, err) {
+				logger.Info("connection service remove mx %s for %s", mxServer.hostname, hostname)
+				mxServer.quitClients()
+			}
+			if err == nil || err == errNullMX {
+				logger.Debug("connection service refresh mail server %s", hostname)
+			} else {
+				logger.Warn("connection service can't refresh mail server %s, error - %v", hostname, err)
+			}
+		}
+	}
+}
+
+// TLSStates отдает состояние TLS серверов домена или всех найденных доменов, если домен не указан
+// возвращает false, если для домена ничего не найдено
+func (s *Service) TLSStates(hostname string) ([]*common.MxTLSState, bool) {
+	states := make([]*common.MxTLSState, 0)
+	seekerMutex.Lock()
+	defer seekerMutex.Unlock()
+	if len(hostname) > 0 {
+		mailServer, ok := mailServers[hostname]
+		if !ok {
+			return nil, false
+		}
+		for _, mxServer := range mailServer.mxServers {
+			states = append(states, mxServer.tlsState(hostname))
+		}
+		return states, true
+	}
+	for domain, mailServer := range mailServers {
+		for _, mxServer := range mailServer.mxServers {
+			states = append(states, mxServer.tlsState(domain))
+		}
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Domain == states[j].Domain {
+			return states[i].Hostname < states[j].Hostname
+		}
+		return states[i].Domain < states[j].Domain
+	})
+	return states, true
+}
+
+// FlushMailServer удаляет найденные почтовые серверы домена, при следующей отправке серверы будут найдены заново
+// возвращает false, если для домена ничего не найдено
+func (s *Service) FlushMailServer(hostname string) bool {
+	var mxServers []*MxServer
+	seekerMutex.Lock()
+	mailServer, ok := mailServers[hostname]
+	if ok {
+		mxServers = mailServer.mxServers
+		delete(mailServers, hostname)
+	}
+	seekerMutex.Unlock()
+	if ok {
+		for _, mxServer := range mxServers {
+			mxServer.quitClients()
+		}
+		logger.Info("connection service flush mail server %s", hostname)
+	}
+	return ok
+}
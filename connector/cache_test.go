@@ -0,0 +1,45 @@
+package connector
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestMailServerLookupError(t *testing.T) {
+	previous := service
+	service = newTestService(t)
+	service.DNS.init()
+	t.Cleanup(func() { service = previous })
+
+	cases := []struct {
+		name     string
+		err      error
+		notFound bool
+	}{
+		{"domain doesn't exist", notFoundError("example.com"), true},
+		{"timeout", &net.DNSError{Err: "i/o timeout", Name: "example.com", IsTimeout: true, IsTemporary: true}, false},
+		{"server failure", &net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true}, false},
+		{"other error", errors.New("connection refused"), false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mailServer := &MailServer{status: LookupMailServerStatus}
+			mailServer.update(nil, c.err)
+			if mailServer.status != ErrorMailServerStatus {
+				t.Errorf("status = %d, want error status", mailServer.status)
+			}
+			if mailServer.notFound() != c.notFound {
+				t.Errorf("notFound() = %v, want %v", mailServer.notFound(), c.notFound)
+			}
+		})
+	}
+
+	// после успешного повторного поиска ошибка забывается
+	mailServer := &MailServer{status: LookupMailServerStatus}
+	mailServer.update(nil, notFoundError("example.com"))
+	mailServer.update([]*MxServer{newMxServer("mx.example.com", nil)}, nil)
+	if mailServer.status != SuccessMailServerStatus || mailServer.notFound() {
+		t.Errorf("status = %d, notFound() = %v after successful lookup", mailServer.status, mailServer.notFound())
+	}
+}
@@ -1,6 +1,8 @@
 package connector
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"net/smtp"
@@ -35,27 +37,31 @@ func (c *Connector) run() {
 
 // устанавливает соединение к почтовому сервису
 func (c *Connector) connect(event *ConnectionEvent) {
-	logger.Debug("connector#%d-%d try find connection", c.id, event.Message.ID)
+	logger.Debug("connector#%d-%s try find connection", c.id, event.Message.ID)
 	goto receiveConnect
 
 receiveConnect:
 	event.TryCount++
 	var targetClient *common.SMTPClient
+	// ошибка политики TLS или аутентификации, из-за которой не удалось подключиться к серверу
+	var clientErr error
 
 	// смотрим все mx сервера почтового сервиса
-	for _, mxServer := range event.server.mxServers {
-		logger.Debug("connector#%d-%d try to receive connection for %s", c.id, event.Message.ID, mxServer.hostname)
+	for _, mxServer := range event.server.servers() {
+		logger.Debug("connector#%d-%s try to receive connection for %s", c.id, event.Message.ID, mxServer.hostname)
 
+		// ip для отправки выбирается по адресам сервера, потому что у серверов домена могут быть адреса разных версий
+		event.address = service.sourceAddress(event.connectorID, event.Message.HostnameTo, mxServer)
 		// пробуем получить клиента
 		event.Queue, _ = mxServer.queues[event.address]
 		client := event.Queue.Pop()
 		if client != nil {
 			targetClient = client.(*common.SMTPClient)
-			logger.Debug("connector#%d-%d found free smtp client#%d", c.id, event.Message.ID, targetClient.ID)
-			logger.Debug("connector#%d-%d check connection to %s smtp client#%d", c.id, event.Message.ID, event.address, targetClient.ID)
+			logger.Debug("connector#%d-%s found free smtp client#%d", c.id, event.Message.ID, targetClient.ID)
+			logger.Debug("connector#%d-%s check connection to %s smtp client#%d", c.id, event.Message.ID, event.address, targetClient.ID)
 			err := targetClient.Worker.Noop()
 			if err != nil {
-				logger.Debug("connector#%d-%d smtp connector is dead client#%d", c.id, event.Message.ID, targetClient.ID)
+				logger.Debug("connector#%d-%s smtp connector is dead client#%d", c.id, event.Message.ID, targetClient.ID)
 				targetClient.Close()
 				// targetClient = nil
 			}
@@ -66,8 +72,12 @@ receiveConnect:
 		// или клиент разорвал соединение
 		if (targetClient == nil && !event.Queue.HasLimit()) ||
 			(targetClient != nil && targetClient.Status == common.DisconnectedSMTPClientStatus) {
-			logger.Debug("connector#%d-%d can't find free smtp client for %s. Creating new client", c.id, event.Message.ID, mxServer.hostname)
-			c.createSMTPClient(mxServer, event, &targetClient)
+			logger.Debug("connector#%d-%s can't find free smtp client for %s. Creating new client", c.id, event.Message.ID, mxServer.hostname)
+			err := c.createSMTPClient(mxServer, event, &targetClient)
+			if err != nil {
+				clientErr = err
+				logger.Warn("connector#%d-%s %v", c.id, event.Message.ID, err)
+			}
 		}
 
 		if targetClient != nil {
@@ -75,6 +85,12 @@ receiveConnect:
 		}
 	}
 
+	// если политика TLS не позволила подключиться, письмо не отправляется без шифрования, а откладывается
+	if targetClient == nil && clientErr != nil {
+		common.ReturnMail(event.SendEvent, clientErr)
+		return
+	}
+
 	// если клиент не создан, значит мы создали максимум соединений к почтовому сервису
 	if targetClient == nil {
 		// приостановим работу горутины
@@ -95,7 +111,7 @@ waitConnect:
 			fmt.Errorf("connector#%d can't connect to %s", c.id, event.Message.HostnameTo),
 		)
 	} else {
-		logger.Debug("connector#%d-%d can't find free connections, wait...", c.id, event.Message.ID)
+		logger.Debug("connector#%d-%s can't find free connections, wait...", c.id, event.Message.ID)
 		time.Sleep(common.App.Timeout().Sleep)
 		goto receiveConnect
 	}
@@ -103,46 +119,87 @@ waitConnect:
 }
 
 // создает соединение к почтовому сервису
-func (c *Connector) createSMTPClient(mxServer *MxServer, event *ConnectionEvent, ptrSMTPClient **common.SMTPClient) {
+// возвращает ошибку, если политика TLS запрещает отправку письма серверу или релей не принял логин и пароль
+func (c *Connector) createSMTPClient(mxServer *MxServer, event *ConnectionEvent, ptrSMTPClient **common.SMTPClient) error {
+	mode, stsMismatch, _ := mxServer.policy()
+	if stsMismatch {
+		return fmt.Errorf("451 4.7.5 connector#%d-%s mx %s doesn't match mta-sts policy of %s", c.id, event.Message.ID, mxServer.hostname, event.Message.HostnameTo)
+	}
+	// без TLSA записей нельзя понять, как проверять сертификат сервера
+	if tlsaErr := mxServer.daneError(); tlsaErr != nil {
+		return fmt.Errorf("451 4.7.5 connector#%d-%s can't look up tlsa records of %s, error - %v", c.id, event.Message.ID, mxServer.hostname, tlsaErr)
+	}
 	// устанавливаем ip, с которого будем отсылать письмо
 	tcpAddr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(event.address, "0"))
 	if err == nil {
-		logger.Debug("connector#%d-%d resolve tcp address %s", c.id, event.Message.ID, tcpAddr.String())
+		logger.Debug("connector#%d-%s resolve tcp address %s", c.id, event.Message.ID, tcpAddr.String())
 
 		dialer := &net.Dialer{
 			Timeout:   common.App.Timeout().Connection,
 			LocalAddr: tcpAddr,
 		}
-		hostname := net.JoinHostPort(mxServer.hostname, "25")
 		// создаем соединение к почтовому сервису
-		connection, err := dialer.Dial("tcp", hostname)
+		connection, hostname, err := dialMxServer(dialer, mxServer, event.address)
 		if err == nil {
-			logger.Debug("connector#%d-%d connect to %s", c.id, event.Message.ID, hostname)
+			logger.Debug("connector#%d-%s connect to %s", c.id, event.Message.ID, hostname)
+
+			if mxServer.lmtp {
+				connection.SetDeadline(time.Now().Add(common.App.Timeout().Hello))
+				lmtpConnection, err := newLMTPConn(connection, service.Domain)
+				if err != nil {
+					event.Queue.HasLimitOn()
+					connection.Close()
+					logger.Warn("connector#%d-%s can't send LHLO to %s, error - %v", c.id, event.Message.ID, mxServer.hostname, err)
+					return nil
+				}
+				connection = lmtpConnection
+			}
+
+			// релей на порту 465 ожидает TLS сразу после подключения
+			if mxServer.implicitTLS {
+				tlsConnection := tls.Client(connection, service.getConf(mxServer))
+				tlsConnection.SetDeadline(time.Now().Add(common.App.Timeout().Hello))
+				err = tlsConnection.Handshake()
+				if err != nil {
+					connection.Close()
+					mxServer.tlsFailed(err)
+					return fmt.Errorf("451 4.7.5 connector#%d-%s can't start tls with %s, verification %s, error - %v", c.id, event.Message.ID, mxServer.hostname, mxServer.verification(), err)
+				}
+				mxServer.tlsSucceeded()
+				connection = tlsConnection
+			}
 
 			connection.SetDeadline(time.Now().Add(common.App.Timeout().Hello))
 			client, err := smtp.NewClient(connection, mxServer.hostname)
 			if err == nil {
-				logger.Debug("connector#%d-%d create client to %s", c.id, event.Message.ID, mxServer.hostname)
+				logger.Debug("connector#%d-%s create client to %s", c.id, event.Message.ID, mxServer.hostname)
 
 				err = client.Hello(service.Domain)
 				if err == nil {
-					logger.Debug("connector#%d-%d send command HELO: %s", c.id, event.Message.ID, service.Domain)
+					logger.Debug("connector#%d-%s send command HELO: %s", c.id, event.Message.ID, service.Domain)
+
+					if mxServer.implicitTLS {
+						return c.openSMTPClient(mxServer, event, ptrSMTPClient, connection, client)
+					}
 
 					// проверяем доступно ли TLS
-					if mxServer.useTLS {
-						mxServer.useTLS, _ = client.Extension("STARTTLS")
+					startTLS, _ := client.Extension("STARTTLS")
+					if mxServer.requiresTLS() && !startTLS {
+						client.Quit()
+						mxServer.tlsFailed(errors.New("server doesn't support STARTTLS"))
+						return fmt.Errorf("451 4.7.5 connector#%d-%s mx %s doesn't support STARTTLS, tls is required for %s", c.id, event.Message.ID, mxServer.hostname, event.Message.HostnameTo)
 					}
-					logger.Debug("connector#%d-%d use TLS %v", c.id, event.Message.ID, mxServer.useTLS)
+					useTLS := mxServer.requiresTLS() || mode == tlsOpportunisticMode && startTLS && mxServer.canTryTLS()
+					logger.Debug("connector#%d-%s use TLS %v, mode %s", c.id, event.Message.ID, useTLS, mode)
 
 					// создаем TLS или обычное соединение
-					if mxServer.useTLS {
-						c.initTLSSMTPClient(mxServer, event, ptrSMTPClient, connection, client)
-					} else {
-						c.initSMTPClient(mxServer, event, ptrSMTPClient, connection, client)
+					if useTLS {
+						return c.initTLSSMTPClient(mxServer, event, ptrSMTPClient, connection, client)
 					}
+					return c.openSMTPClient(mxServer, event, ptrSMTPClient, connection, client)
 				} else {
 					client.Quit()
-					logger.Debug("connector#%d-%d can't create client to %s Error: %+v", c.id, event.Message.ID, mxServer.hostname, err)
+					logger.Debug("connector#%d-%s can't create client to %s Error: %+v", c.id, event.Message.ID, mxServer.hostname, err)
 				}
 			} else {
 				// если не удалось создать клиента,
@@ -150,7 +207,7 @@ func (c *Connector) createSMTPClient(mxServer *MxServer, event *ConnectionEvent,
 				// ставим лимит очереди, чтобы не пытаться открывать новые соединения и не создавать новые клиенты
 				event.Queue.HasLimitOn()
 				connection.Close()
-				logger.Warn("connector#%d-%d can't create client to %s Error: %v", c.id, event.Message.ID, mxServer.hostname, err)
+				logger.Warn("connector#%d-%s can't create client to %s Error: %v", c.id, event.Message.ID, mxServer.hostname, err)
 				// event.ReturnMail(event, err)
 			}
 		} else {
@@ -158,38 +215,74 @@ func (c *Connector) createSMTPClient(mxServer *MxServer, event *ConnectionEvent,
 			// возможно, на почтовом сервисе стоит ограничение на количество соединений
 			// ставим лимит очереди, чтобы не пытаться открывать новые соединения
 			event.Queue.HasLimitOn()
-			logger.Warn("connector#%d-%d can't dial to %s, err - %+v", c.id, event.Message.ID, hostname, err)
+			logger.Warn("connector#%d-%s can't dial to %s, err - %+v", c.id, event.Message.ID, hostname, err)
 		}
 	} else {
-		logger.Warn("connector#%d-%d can't resolve tcp address %s, err - %+v", c.id, event.Message.ID, tcpAddr.String(), err)
+		logger.Warn("connector#%d-%s can't resolve tcp address %s, err - %+v", c.id, event.Message.ID, tcpAddr.String(), err)
 	}
+	return nil
 }
 
-// открывает защищенное соединение
-func (c *Connector) initTLSSMTPClient(mxServer *MxServer, event *ConnectionEvent, ptrSMTPClient **common.SMTPClient, connection net.Conn, client *smtp.Client) {
-	// если есть какие данные о сертификате и к серверу можно создать TLS соединение
-	if mxServer.useTLS {
-		// открываем TLS соединение
-		err := client.StartTLS(service.getConf(mxServer.realServerName))
-		// если все нормально, создаем клиента
+// открывает соединение к найденным ip сервера той же версии, что и ip отправителя, ip пробуются по порядку
+// отдает адрес, к которому открыто соединение, или адрес последней попытки
+func dialMxServer(dialer *net.Dialer, mxServer *MxServer, source string) (net.Conn, string, error) {
+	if len(mxServer.socket) > 0 {
+		dialer.LocalAddr = nil
+		connection, err := dialer.Dial("unix", mxServer.socket)
+		return connection, mxServer.socket, err
+	}
+	addresses := mxServer.dialAddresses(source)
+	if len(addresses) == 0 {
+		return nil, mxServer.hostname, fmt.Errorf("mx %s has no ip of the same version as %s", mxServer.hostname, source)
+	}
+	var connection net.Conn
+	var err error
+	for _, address := range addresses {
+		connection, err = dialer.Dial("tcp", address)
 		if err == nil {
-			c.initSMTPClient(mxServer, event, ptrSMTPClient, connection, client)
-		} else {
-			// если не удалось создать TLS соединение
-			// говорим, что не надо больше создавать TLS соединение
-			mxServer.dontUseTLS()
-			// разрываем созданое соединение
-			// это необходимо, т.к. не все почтовые сервисы позволяют продолжить отправку письма
-			// после неудачной попытке создать TLS соединение
-			client.Quit()
-			// создаем обычное соединие
-			c.createSMTPClient(mxServer, event, ptrSMTPClient)
+			return connection, address, nil
+		}
+	}
+	return nil, addresses[len(addresses)-1], err
+}
 
-			logger.Warn("connector#%d-%d can't start tls err - %v", c.id, event.Message.ID, err)
+// открывает защищенное соединение
+// если TLS обязателен, после неудачной попытки соединение не переоткрывается без шифрования, а возвращается ошибка
+func (c *Connector) initTLSSMTPClient(mxServer *MxServer, event *ConnectionEvent, ptrSMTPClient **common.SMTPClient, connection net.Conn, client *smtp.Client) error {
+	// открываем TLS соединение
+	err := client.StartTLS(service.getConf(mxServer))
+	// если все нормально, создаем клиента
+	if err == nil {
+		if mxServer.tlsSucceeded() {
+			logger.Info("connector#%d-%s tls to %s works again", c.id, event.Message.ID, mxServer.hostname)
 		}
-	} else {
-		c.initSMTPClient(mxServer, event, ptrSMTPClient, connection, client)
+		return c.openSMTPClient(mxServer, event, ptrSMTPClient, connection, client)
 	}
+	mxServer.tlsFailed(err)
+	// разрываем созданое соединение
+	// это необходимо, т.к. не все почтовые сервисы позволяют продолжить отправку письма
+	// после неудачной попытке создать TLS соединение
+	client.Quit()
+	if mxServer.requiresTLS() {
+		return fmt.Errorf("451 4.7.5 connector#%d-%s can't start tls with %s, verification %s, error - %v", c.id, event.Message.ID, mxServer.hostname, mxServer.verification(), err)
+	}
+	logger.Warn("connector#%d-%s can't start tls with %s, it won't be used for %v, err - %v", c.id, event.Message.ID, mxServer.hostname, service.TLSPolicy.CoolOff, err)
+	// TLS не используется до истечения времени ожидания, поэтому создаем обычное соединие
+	return c.createSMTPClient(mxServer, event, ptrSMTPClient)
+}
+
+// выполняет аутентификацию на релее и создает или инициализирует клиента
+func (c *Connector) openSMTPClient(mxServer *MxServer, event *ConnectionEvent, ptrSMTPClient **common.SMTPClient, connection net.Conn, client *smtp.Client) error {
+	if mxServer.relay != nil {
+		err := mxServer.relay.authenticate(client, mxServer.hostname)
+		if err != nil {
+			client.Quit()
+			return fmt.Errorf("451 4.7.0 connector#%d-%s can't authenticate on relay %s, error - %v", c.id, event.Message.ID, mxServer.hostname, err)
+		}
+		logger.Debug("connector#%d-%s authenticate on relay %s", c.id, event.Message.ID, mxServer.hostname)
+	}
+	c.initSMTPClient(mxServer, event, ptrSMTPClient, connection, client)
+	return nil
 }
 
 // создает или инициализирует клиента
@@ -209,10 +302,19 @@ func (c *Connector) initSMTPClient(mxServer *MxServer, event *ConnectionEvent, p
 	smtpClient := *ptrSMTPClient
 	smtpClient.Conn = connection
 	smtpClient.Worker = client
+	smtpClient.Hostname = mxServer.hostname
+	smtpClient.Address = event.address
+	_, smtpClient.TLS = client.TLSConnectionState()
+	smtpClient.LMTP = mxServer.lmtp
 	smtpClient.ModifyDate = time.Now()
+	if smtpClient.TLS {
+		logger.Info("connector#%d-%s open tls connection to %s, verification %s", c.id, event.Message.ID, mxServer.hostname, mxServer.verification())
+	} else {
+		logger.Info("connector#%d-%s open plain connection to %s, verification none", c.id, event.Message.ID, mxServer.hostname)
+	}
 	if isNil {
-		logger.Debug("connector#%d-%d create smtp client#%d for %s", c.id, event.Message.ID, smtpClient.ID, mxServer.hostname)
+		logger.Debug("connector#%d-%s create smtp client#%d for %s", c.id, event.Message.ID, smtpClient.ID, mxServer.hostname)
 	} else {
-		logger.Debug("connector#%d-%d reopen smtp client#%d for %s", c.id, event.Message.ID, smtpClient.ID, mxServer.hostname)
+		logger.Debug("connector#%d-%s reopen smtp client#%d for %s", c.id, event.Message.ID, smtpClient.ID, mxServer.hostname)
 	}
 }
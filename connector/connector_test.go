@@ -0,0 +1,33 @@
+package connector
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDialMxServer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	// имя сервера не резолвится, поэтому соединение открывается только к найденному ip
+	mxServer := newMxServerWithIPs("2001:db8::10", "127.0.0.1")
+	mxServer.hostname = "mx.invalid"
+	mxServer.port = port
+	connection, address, err := dialMxServer(&net.Dialer{Timeout: time.Second}, mxServer, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	connection.Close()
+	if want := net.JoinHostPort("127.0.0.1", port); address != want {
+		t.Errorf("dialMxServer() address = %s, want %s", address, want)
+	}
+
+	if _, _, err = dialMxServer(&net.Dialer{Timeout: time.Second}, newMxServerWithIPs("2001:db8::10"), "127.0.0.1"); err == nil {
+		t.Error("dialMxServer() connects to server without ips of source version")
+	}
+}
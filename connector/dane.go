@@ -0,0 +1,371 @@
+package connector
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/boreevyuri/postmanq/logger"
+)
+
+const (
+	// сертификат удостоверяющего центра, которым подписан сертификат сервера, RFC 7672 3.1.2
+	daneTAUsage = 2
+
+	// сертификат или ключ самого сервера, RFC 7672 3.1.1
+	daneEEUsage = 3
+
+	// тип TLSA записи
+	tlsaType = 52
+
+	// тип OPT записи, RFC 6891
+	optType = 41
+
+	// размер UDP ответа, о котором сообщается DNS серверу
+	ednsUDPSize = 1232
+)
+
+var (
+	// DNS серверы операционной системы
+	systemNameserversList []string
+
+	// чтение DNS серверов операционной системы
+	systemNameserversOnce sync.Once
+)
+
+// TLSA запись, RFC 6698
+type TLSA struct {
+	// чем является сертификат из записи
+	Usage uint8
+
+	// сертификат целиком или только открытый ключ
+	Selector uint8
+
+	// данные как есть или их SHA-256 или SHA-512 хеш
+	MatchingType uint8
+
+	// данные сертификата
+	Data []byte
+}
+
+// сигнализирует, что запись может использоваться для SMTP, записи PKIX-TA и PKIX-EE не используются, RFC 7672 3.1.3
+func (t *TLSA) usable() bool {
+	return (t.Usage == daneTAUsage || t.Usage == daneEEUsage) && t.Selector <= 1 && t.MatchingType <= 2
+}
+
+// сигнализирует, что сертификат соответствует записи
+func (t *TLSA) matches(cert *x509.Certificate) bool {
+	data := cert.Raw
+	if t.Selector == 1 {
+		data = cert.RawSubjectPublicKeyInfo
+	}
+	switch t.MatchingType {
+	case 1:
+		sum := sha256.Sum256(data)
+		data = sum[:]
+	case 2:
+		sum := sha512.Sum512(data)
+		data = sum[:]
+	}
+	return bytes.Equal(data, t.Data)
+}
+
+// ищет подписанные DNSSEC TLSA записи почтового сервера, prefix используется в логах
+// записи, которые DNS сервер не проверил, не используются, потому что их мог подменить злоумышленник
+// только отсутствие записей означает, что DANE не используется, другие ошибки поиска возвращаются,
+// потому что ими злоумышленник мог бы отключить проверку сертификата, RFC 7672 2.2
+func lookupTLSA(prefix string, mxHostname string) ([]*TLSA, error) {
+	records, authenticated, err := resolver.LookupTLSA("_25._tcp." + mxHostname)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return nil, nil
+		}
+		logger.Warn("%s can't look up tlsa records for %s, error - %v", prefix, mxHostname, err)
+		return nil, err
+	}
+	if !authenticated {
+		if len(records) > 0 {
+			logger.Debug("%s tlsa records for %s aren't authenticated, ignore them", prefix, mxHostname)
+		}
+		return nil, nil
+	}
+	usable := make([]*TLSA, 0, len(records))
+	for _, record := range records {
+		if record.usable() {
+			usable = append(usable, record)
+		}
+	}
+	if len(usable) == 0 {
+		return nil, nil
+	}
+	logger.Debug("%s look up %d tlsa records for %s", prefix, len(usable), mxHostname)
+	return usable, nil
+}
+
+// проверяет сертификат почтового сервера по TLSA записям, RFC 7672 3.1
+// для DANE-EE не проверяются имя и срок действия сертификата,
+// для DANE-TA цепочка сертификатов должна вести к сертификату из записи, а сертификат сервера должен быть выдан на имя из MX записи
+func (m *MxServer) verifyDANE(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, rawCert := range rawCerts {
+		cert, err := x509.ParseCertificate(rawCert)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+	if len(certs) == 0 {
+		return errors.New("server hasn't presented certificate")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, _, tlsa := m.policy()
+	for _, record := range tlsa {
+		switch record.Usage {
+		case daneEEUsage:
+			if record.matches(certs[0]) {
+				return nil
+			}
+		case daneTAUsage:
+			for _, cert := range certs[1:] {
+				if !record.matches(cert) {
+					continue
+				}
+				roots := x509.NewCertPool()
+				roots.AddCert(cert)
+				_, err := certs[0].Verify(x509.VerifyOptions{
+					DNSName:       m.hostname,
+					Roots:         roots,
+					Intermediates: intermediates,
+				})
+				if err == nil {
+					return nil
+				}
+			}
+		}
+	}
+	return fmt.Errorf("certificate of %s doesn't match tlsa records", m.hostname)
+}
+
+// отдает способ проверки сертификата почтового сервера для логов
+func (m *MxServer) verification() string {
+	mode, _, tlsa := m.policy()
+	if len(tlsa) > 0 {
+		return "dane-verified"
+	}
+	if mode == tlsRequiredMode {
+		return "pkix"
+	}
+	return "none"
+}
+
+// сигнализирует, что письма отправляются серверу только через TLS
+func (m *MxServer) requiresTLS() bool {
+	mode, _, tlsa := m.policy()
+	return mode == tlsRequiredMode || len(tlsa) > 0
+}
+
+// отдает DNS серверы из /etc/resolv.conf
+func systemNameservers() []string {
+	systemNameserversOnce.Do(func() {
+		var addresses []string
+		file, err := os.Open("/etc/resolv.conf")
+		if err == nil {
+			scanner := bufio.NewScanner(file)
+			for scanner.Scan() {
+				fields := strings.Fields(scanner.Text())
+				if len(fields) > 1 && fields[0] == "nameserver" {
+					addresses = append(addresses, fields[1])
+				}
+			}
+			file.Close()
+		}
+		if len(addresses) == 0 {
+			addresses = []string{"127.0.0.1"}
+		}
+		systemNameserversList = withDNSPort(addresses)
+	})
+	return systemNameserversList
+}
+
+// отправляет запрос TLSA записей DNS серверу и разбирает ответ
+// в запросе выставляются флаги DO и AD, поэтому проверяющий DNSSEC сервер сообщит в ответе, что подпись записей проверена
+// флагу AD можно доверять, только если путь до DNS сервера защищен, например, сервер запущен на том же хосте
+func exchangeTLSA(ctx context.Context, nameserver string, hostname string) ([]*TLSA, bool, error) {
+	query, err := tlsaQuery(hostname)
+	if err != nil {
+		return nil, false, &net.DNSError{Err: err.Error(), Name: hostname, Server: nameserver}
+	}
+	response, err := exchangeDNS(ctx, "udp", nameserver, query)
+	// ответ не поместился в UDP пакет, повторяем запрос по TCP
+	if err == nil && len(response) > 2 && response[2]&0x02 != 0 {
+		response, err = exchangeDNS(ctx, "tcp", nameserver, query)
+	}
+	if err != nil {
+		netErr, ok := err.(net.Error)
+		return nil, false, &net.DNSError{
+			Err:         err.Error(),
+			Name:        hostname,
+			Server:      nameserver,
+			IsTimeout:   ok && netErr.Timeout(),
+			IsTemporary: true,
+		}
+	}
+	return parseTLSAResponse(response, query, hostname, nameserver)
+}
+
+// создает запрос TLSA записей
+func tlsaQuery(hostname string) ([]byte, error) {
+	query := make([]byte, 12, 512)
+	if _, err := rand.Read(query[:2]); err != nil {
+		return nil, err
+	}
+	// RD и AD
+	binary.BigEndian.PutUint16(query[2:], 0x0120)
+	// одна запись в вопросе и одна в дополнительной секции
+	binary.BigEndian.PutUint16(query[4:], 1)
+	binary.BigEndian.PutUint16(query[10:], 1)
+	for _, label := range strings.Split(strings.TrimRight(hostname, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid hostname %s", hostname)
+		}
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	query = append(query, 0, 0, tlsaType, 0, 1)
+	// OPT запись с флагом DO
+	query = append(query, 0, 0, optType, byte(ednsUDPSize>>8), byte(ednsUDPSize&0xff), 0, 0, 0x80, 0, 0, 0)
+	return query, nil
+}
+
+// отправляет запрос DNS серверу и читает ответ
+func exchangeDNS(ctx context.Context, network string, nameserver string, query []byte) ([]byte, error) {
+	dialer := new(net.Dialer)
+	conn, err := dialer.DialContext(ctx, network, nameserver)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "tcp" {
+		message := make([]byte, 2, 2+len(query))
+		binary.BigEndian.PutUint16(message, uint16(len(query)))
+		_, err = conn.Write(append(message, query...))
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.ReadFull(conn, message)
+		if err != nil {
+			return nil, err
+		}
+		response := make([]byte, binary.BigEndian.Uint16(message))
+		_, err = io.ReadFull(conn, response)
+		return response, err
+	}
+
+	_, err = conn.Write(query)
+	if err != nil {
+		return nil, err
+	}
+	response := make([]byte, ednsUDPSize)
+	n, err := conn.Read(response)
+	return response[:n], err
+}
+
+// разбирает ответ DNS сервера
+func parseTLSAResponse(response []byte, query []byte, hostname string, nameserver string) ([]*TLSA, bool, error) {
+	invalid := &net.DNSError{Err: "invalid response", Name: hostname, Server: nameserver, IsTemporary: true}
+	if len(response) < 12 || response[0] != query[0] || response[1] != query[1] || response[2]&0x80 == 0 {
+		return nil, false, invalid
+	}
+	switch response[3] & 0x0f {
+	case 0:
+	case 3:
+		return nil, false, notFoundError(hostname)
+	case 2:
+		return nil, false, &net.DNSError{Err: "server misbehaving", Name: hostname, Server: nameserver, IsTemporary: true}
+	default:
+		return nil, false, &net.DNSError{Err: fmt.Sprintf("rcode %d", response[3]&0x0f), Name: hostname, Server: nameserver}
+	}
+	authenticated := response[3]&0x20 != 0
+	questions := int(binary.BigEndian.Uint16(response[4:]))
+	answers := int(binary.BigEndian.Uint16(response[6:]))
+
+	offset := 12
+	for i := 0; i < questions; i++ {
+		offset = skipDNSName(response, offset)
+		if offset < 0 || offset+4 > len(response) {
+			return nil, false, invalid
+		}
+		offset += 4
+	}
+	records := make([]*TLSA, 0, answers)
+	for i := 0; i < answers; i++ {
+		offset = skipDNSName(response, offset)
+		if offset < 0 || offset+10 > len(response) {
+			return nil, false, invalid
+		}
+		recordType := binary.BigEndian.Uint16(response[offset:])
+		length := int(binary.BigEndian.Uint16(response[offset+8:]))
+		offset += 10
+		if offset+length > len(response) {
+			return nil, false, invalid
+		}
+		// в ответе могут быть CNAME и RRSIG записи, они пропускаются
+		if recordType == tlsaType && length > 3 {
+			data := response[offset : offset+length]
+			records = append(records, &TLSA{
+				Usage:        data[0],
+				Selector:     data[1],
+				MatchingType: data[2],
+				Data:         append([]byte(nil), data[3:]...),
+			})
+		}
+		offset += length
+	}
+	if len(records) == 0 {
+		return nil, false, notFoundError(hostname)
+	}
+	return records, authenticated, nil
+}
+
+// отдает смещение после доменного имени в DNS сообщении или -1, если сообщение обрезано или имя испорчено
+// сжатое имя заканчивается ссылкой на другое имя, поэтому ссылка не разыменовывается, RFC 1035 4.1.4
+func skipDNSName(message []byte, offset int) int {
+	for offset >= 0 && offset < len(message) {
+		length := int(message[offset])
+		switch {
+		case length == 0:
+			return offset + 1
+		case length&0xc0 == 0xc0:
+			if offset+2 > len(message) {
+				return -1
+			}
+			return offset + 2
+		case length&0xc0 != 0:
+			// метки других типов не используются
+			return -1
+		default:
+			offset += length + 1
+		}
+	}
+	return -1
+}
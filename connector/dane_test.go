@@ -0,0 +1,255 @@
+package connector
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+)
+
+// запись ответа DNS сервера для тестов
+type testRecord struct {
+	// имя записи в формате DNS сообщения
+	name []byte
+
+	// тип записи
+	recordType uint16
+
+	// данные записи
+	data []byte
+}
+
+// имя _25._tcp.mx.example.com без сжатия
+var testTLSAName = []byte("\x03_25\x04_tcp\x02mx\x07example\x03com\x00")
+
+// ссылка на имя из вопроса, который начинается сразу после заголовка
+var testPointerName = []byte{0xc0, 0x0c}
+
+// данные TLSA записи DANE-EE SPKI SHA-256
+var testTLSAData = append([]byte{daneEEUsage, 1, 1}, bytes.Repeat([]byte{0xab}, 32)...)
+
+// собирает ответ DNS сервера на запрос с флагами flags в младшем байте заголовка
+func testTLSAResponse(query []byte, flags byte, records ...testRecord) []byte {
+	response := make([]byte, 12)
+	copy(response, query[:2])
+	// QR и RD
+	response[2] = 0x81
+	response[3] = flags
+	binary.BigEndian.PutUint16(response[4:], 1)
+	binary.BigEndian.PutUint16(response[6:], uint16(len(records)))
+	response = append(response, testTLSAName...)
+	response = append(response, 0, tlsaType, 0, 1)
+	for _, record := range records {
+		response = append(response, record.name...)
+		header := make([]byte, 10)
+		binary.BigEndian.PutUint16(header, record.recordType)
+		binary.BigEndian.PutUint16(header[2:], 1)
+		binary.BigEndian.PutUint16(header[8:], uint16(len(record.data)))
+		response = append(response, header...)
+		response = append(response, record.data...)
+	}
+	return response
+}
+
+func TestParseTLSAResponse(t *testing.T) {
+	query, err := tlsaQuery("_25._tcp.mx.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const adFlag = 0x20
+	cases := []struct {
+		name          string
+		response      []byte
+		records       int
+		authenticated bool
+		notFound      bool
+	}{
+		{
+			"compressed name",
+			testTLSAResponse(query, adFlag, testRecord{testPointerName, tlsaType, testTLSAData}),
+			1, true, false,
+		},
+		{
+			"uncompressed name",
+			testTLSAResponse(query, adFlag, testRecord{testTLSAName, tlsaType, testTLSAData}),
+			1, true, false,
+		},
+		{
+			"name ends with pointer",
+			testTLSAResponse(query, adFlag, testRecord{append([]byte("\x03_25\x04_tcp"), 0xc0, 0x18), tlsaType, testTLSAData}),
+			1, true, false,
+		},
+		{
+			"without ad bit",
+			testTLSAResponse(query, 0, testRecord{testPointerName, tlsaType, testTLSAData}),
+			1, false, false,
+		},
+		{
+			"cname and rrsig are skipped",
+			testTLSAResponse(query, adFlag,
+				testRecord{testPointerName, 5, []byte("\x02mx\xc0\x17")},
+				testRecord{testPointerName, tlsaType, testTLSAData},
+				testRecord{testPointerName, 46, bytes.Repeat([]byte{1}, 40)},
+			),
+			1, true, false,
+		},
+		{"nxdomain", testTLSAResponse(query, adFlag|3), 0, false, true},
+		{"nodata", testTLSAResponse(query, adFlag), 0, false, true},
+		{
+			"nodata with rrsig only",
+			testTLSAResponse(query, adFlag, testRecord{testPointerName, 46, bytes.Repeat([]byte{1}, 40)}),
+			0, false, true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			records, authenticated, err := parseTLSAResponse(c.response, query, "_25._tcp.mx.example.com", "127.0.0.1:53")
+			if c.notFound {
+				if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+					t.Fatalf("parseTLSAResponse() error = %v, want not found", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != c.records || authenticated != c.authenticated {
+				t.Fatalf("parseTLSAResponse() = %d records, authenticated %v, want %d, %v", len(records), authenticated, c.records, c.authenticated)
+			}
+			record := records[0]
+			if record.Usage != daneEEUsage || record.Selector != 1 || record.MatchingType != 1 || !bytes.Equal(record.Data, testTLSAData[3:]) {
+				t.Errorf("record = %+v, want %v", record, testTLSAData)
+			}
+		})
+	}
+}
+
+func TestParseTLSAResponseErrors(t *testing.T) {
+	query, err := tlsaQuery("_25._tcp.mx.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := testTLSAResponse(query, 0x20, testRecord{testPointerName, tlsaType, testTLSAData})
+
+	// ответ, обрезанный в любом месте, не разбирается и не приводит к панике
+	for length := 0; length < len(valid); length++ {
+		_, _, err := parseTLSAResponse(valid[:length], query, "_25._tcp.mx.example.com", "127.0.0.1:53")
+		if dnsErr, ok := err.(*net.DNSError); !ok || dnsErr.IsNotFound {
+			t.Errorf("response truncated to %d bytes: error = %v, want invalid response", length, err)
+		}
+	}
+
+	otherID := append([]byte(nil), valid...)
+	otherID[0]++
+	notResponse := append([]byte(nil), valid...)
+	notResponse[2] &^= 0x80
+	reservedLabel := testTLSAResponse(query, 0x20, testRecord{[]byte{0x40, 0x0c}, tlsaType, testTLSAData})
+	cases := []struct {
+		name      string
+		response  []byte
+		temporary bool
+	}{
+		{"other id", otherID, true},
+		{"not a response", notResponse, true},
+		{"reserved label type", reservedLabel, true},
+		{"servfail", testTLSAResponse(query, 2), true},
+		{"refused", testTLSAResponse(query, 5), false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, _, err := parseTLSAResponse(c.response, query, "_25._tcp.mx.example.com", "127.0.0.1:53")
+			dnsErr, ok := err.(*net.DNSError)
+			if !ok || dnsErr.IsNotFound || dnsErr.IsTemporary != c.temporary {
+				t.Errorf("parseTLSAResponse() error = %#v, want temporary %v", err, c.temporary)
+			}
+		})
+	}
+}
+
+func TestSkipDNSName(t *testing.T) {
+	cases := []struct {
+		name    string
+		message []byte
+		offset  int
+		next    int
+	}{
+		{"root", []byte{0}, 0, 1},
+		{"labels", []byte("\x02mx\x03com\x00\xff"), 0, 8},
+		{"pointer", []byte{0xff, 0xc0, 0x00, 0xff}, 1, 3},
+		{"labels with pointer", []byte("\xff\x02mx\xc0\x00"), 1, 6},
+		{"truncated label", []byte("\x02mx\x03co"), 0, -1},
+		{"truncated pointer", []byte{0x02, 'm', 'x', 0xc0}, 0, -1},
+		{"without root", []byte("\x02mx"), 0, -1},
+		{"reserved label type", []byte{0x80, 0x00}, 0, -1},
+		{"offset out of message", []byte{0}, 1, -1},
+	}
+	for _, c := range cases {
+		if next := skipDNSName(c.message, c.offset); next != c.next {
+			t.Errorf("%s: skipDNSName() = %d, want %d", c.name, next, c.next)
+		}
+	}
+}
+
+// резолвер, который отдает TLSA записи или ошибку
+type testTLSAResolver struct {
+	StubResolver
+
+	// TLSA записи
+	records []*TLSA
+
+	// сигнализирует, что подпись записей проверена
+	authenticated bool
+
+	// ошибка поиска
+	err error
+}
+
+// LookupTLSA ищет TLSA записи
+func (r *testTLSAResolver) LookupTLSA(hostname string) ([]*TLSA, bool, error) {
+	return r.records, r.authenticated, r.err
+}
+
+func TestLookupTLSA(t *testing.T) {
+	usable := &TLSA{Usage: daneEEUsage, Selector: 1, MatchingType: 1, Data: testTLSAData[3:]}
+	pkix := &TLSA{Usage: 1, Selector: 1, MatchingType: 1, Data: testTLSAData[3:]}
+	cases := []struct {
+		name     string
+		resolver *testTLSAResolver
+		records  int
+		fails    bool
+	}{
+		{"authenticated records", &testTLSAResolver{records: []*TLSA{usable, pkix}, authenticated: true}, 1, false},
+		{"unauthenticated records", &testTLSAResolver{records: []*TLSA{usable}}, 0, false},
+		{"pkix records only", &testTLSAResolver{records: []*TLSA{pkix}, authenticated: true}, 0, false},
+		{"records not found", &testTLSAResolver{err: notFoundError("_25._tcp.mx.example.com")}, 0, false},
+		{"server failure", &testTLSAResolver{err: &net.DNSError{Err: "server misbehaving", IsTemporary: true}}, 0, true},
+		{"timeout", &testTLSAResolver{err: &net.DNSError{Err: "i/o timeout", IsTimeout: true}}, 0, true},
+		{"other error", &testTLSAResolver{err: errors.New("connection refused")}, 0, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			stubResolver(t, c.resolver)
+			records, err := lookupTLSA("test", "mx.example.com")
+			if (err != nil) != c.fails {
+				t.Fatalf("lookupTLSA() error = %v, want fails %v", err, c.fails)
+			}
+			if len(records) != c.records {
+				t.Errorf("lookupTLSA() = %d records, want %d", len(records), c.records)
+			}
+		})
+	}
+}
+
+func TestApplyDANEError(t *testing.T) {
+	stubResolver(t, &testTLSAResolver{err: &net.DNSError{Err: "server misbehaving", IsTemporary: true}})
+	policy := &TLSPolicy{DANE: true}
+	if err := policy.init(); err != nil {
+		t.Fatal(err)
+	}
+	mxServer := newMxServer("mx.example.com", nil)
+	policy.apply("test", "example.com", []*MxServer{mxServer})
+	if mxServer.daneError() == nil {
+		t.Error("tlsa lookup failure isn't kept, mail would be sent without dane")
+	}
+}
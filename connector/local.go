@@ -0,0 +1,175 @@
+package connector
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/boreevyuri/postmanq/common"
+)
+
+var (
+	// счетчик писем, сохраненных в maildir, используется в именах файлов
+	maildirCounter uint64
+
+	// имя хоста для имен файлов в maildir
+	maildirHostname = maildirHost()
+)
+
+// отдает имя хоста для имен файлов в maildir, символы / и : заменяются, как требует формат maildir
+func maildirHost() string {
+	host, _ := os.Hostname()
+	return strings.NewReplacer("/", "\\057", ":", "\\072").Replace(host)
+}
+
+// создает почтовый сервис LMTP сервера
+// адрес указывается в виде host:port или unix:/путь/до/сокета
+func newLMTPServer(address string) (*MailServer, error) {
+	var mxServer *MxServer
+	if strings.HasPrefix(address, "unix:") {
+		mxServer = newMxServer(address, service.Addresses)
+		mxServer.socket = strings.TrimPrefix(address, "unix:")
+	} else {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		mxServer = newMxServer(host, service.Addresses)
+		mxServer.port = port
+	}
+	mxServer.lmtp = true
+	mxServer.tlsMode = tlsNoneMode
+	return &MailServer{
+		mxServers: []*MxServer{mxServer},
+		status:    SuccessMailServerStatus,
+	}, nil
+}
+
+// соединение к LMTP серверу
+// LMTP отличается от SMTP командой приветствия, RFC 2033, поэтому LHLO отправляется серверу до создания smtp клиента,
+// а приветствие сервера и ответ на LHLO отдаются smtp клиенту в ответ на его EHLO, сама команда EHLO серверу не отправляется
+type lmtpConn struct {
+	net.Conn
+
+	// приветствие сервера и ответ на LHLO, которые еще не прочитал smtp клиент
+	replies *bytes.Buffer
+
+	// сигнализирует, что команда EHLO smtp клиента еще не отброшена
+	skipHello bool
+}
+
+// отправляет LHLO серверу и создает соединение для smtp клиента
+func newLMTPConn(conn net.Conn, localName string) (*lmtpConn, error) {
+	text := textproto.NewConn(conn)
+	_, greeting, err := text.ReadResponse(220)
+	if err != nil {
+		return nil, err
+	}
+	id, err := text.Cmd("LHLO %s", localName)
+	if err != nil {
+		return nil, err
+	}
+	text.StartResponse(id)
+	defer text.EndResponse(id)
+	_, reply, err := text.ReadResponse(250)
+	if err != nil {
+		return nil, err
+	}
+	replies := new(bytes.Buffer)
+	writeReply(replies, 220, greeting)
+	writeReply(replies, 250, reply)
+	return &lmtpConn{Conn: conn, replies: replies, skipHello: true}, nil
+}
+
+// пишет многострочный ответ сервера, который textproto склеил через перевод строки
+func writeReply(buf *bytes.Buffer, code int, reply string) {
+	lines := strings.Split(reply, "\n")
+	for i, line := range lines {
+		separator := "-"
+		if i == len(lines)-1 {
+			separator = " "
+		}
+		fmt.Fprintf(buf, "%d%s%s\r\n", code, separator, line)
+	}
+}
+
+// Read читает ответы сервера
+func (c *lmtpConn) Read(b []byte) (int, error) {
+	if c.replies.Len() > 0 {
+		return c.replies.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+// Write отправляет команды серверу, команда EHLO отбрасывается, даже если smtp клиент пишет ее по частям
+func (c *lmtpConn) Write(b []byte) (int, error) {
+	if !c.skipHello {
+		return c.Conn.Write(b)
+	}
+	i := bytes.IndexByte(b, '\n')
+	if i < 0 {
+		return len(b), nil
+	}
+	c.skipHello = false
+	if i == len(b)-1 {
+		return len(b), nil
+	}
+	n, err := c.Conn.Write(b[i+1:])
+	return i + 1 + n, err
+}
+
+// доставка писем в maildir
+type maildirDelivery struct {
+	// каталог, в котором создаются maildir получателей
+	dir string
+}
+
+// Deliver сохраняет письмо в maildir получателя
+// файл сначала пишется в tmp, а затем переносится в new, поэтому почтовый клиент не увидит недописанное письмо
+func (d *maildirDelivery) Deliver(message *common.MailMessage, recipient string) (string, error) {
+	at := strings.LastIndexByte(recipient, '@')
+	if at <= 0 {
+		return "", fmt.Errorf("550 5.1.3 invalid mailbox %s", recipient)
+	}
+	mailbox, domain := strings.ToLower(recipient[:at]), strings.ToLower(recipient[at+1:])
+	if strings.ContainsAny(recipient, "/\\\x00") || strings.HasPrefix(mailbox, ".") || strings.HasPrefix(domain, ".") {
+		return "", fmt.Errorf("550 5.1.3 invalid mailbox %s", recipient)
+	}
+	mailbox = filepath.Join(d.dir, domain, mailbox)
+
+	for _, subdir := range []string{"tmp", "new", "cur"} {
+		err := os.MkdirAll(filepath.Join(mailbox, subdir), 0700)
+		if err != nil {
+			return "", fmt.Errorf("451 4.3.0 can't create maildir %s, error - %v", mailbox, err)
+		}
+	}
+	now := time.Now()
+	filename := fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), atomic.AddUint64(&maildirCounter, 1), maildirHostname)
+	tmpFilename := filepath.Join(mailbox, "tmp", filename)
+	body := strings.Replace(message.Body, "\r\n", "\n", -1)
+	data := fmt.Sprintf("Return-Path: <%s>\nDelivered-To: %s\n%s", message.Envelope, recipient, body)
+	err := ioutil.WriteFile(tmpFilename, []byte(data), 0600)
+	if err == nil {
+		err = os.Rename(tmpFilename, filepath.Join(mailbox, "new", filename))
+	}
+	if err != nil {
+		os.Remove(tmpFilename)
+		return "", fmt.Errorf("451 4.3.0 can't write mail to maildir %s, error - %v", mailbox, err)
+	}
+	return fmt.Sprintf("2.0.0 delivered to maildir %s", d.dir), nil
+}
+
+// доставка, которая удаляет письма, используется для тестовых доменов
+type discardDelivery struct{}
+
+// Deliver удаляет письмо
+func (d *discardDelivery) Deliver(message *common.MailMessage, recipient string) (string, error) {
+	return "2.0.0 discarded", nil
+}
@@ -0,0 +1,149 @@
+package connector
+
+import (
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/boreevyuri/postmanq/common"
+)
+
+func TestMaildirDeliver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "postmanq-maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// файл на месте maildir ящика не дает сохранить письмо
+	if err = os.MkdirAll(filepath.Join(dir, "example.com"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "example.com", "broken"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	delivery := &maildirDelivery{dir: dir}
+	message := &common.MailMessage{Envelope: "sender@example.org", Body: "Subject: test\r\n\r\nbody\r\n"}
+
+	cases := []struct {
+		recipient string
+		code      string
+	}{
+		{"User@Example.com", ""},
+		{"broken@example.com", "451"},
+		{"invalid", "550"},
+		{"../user@example.com", "550"},
+		{"user@.example.com", "550"},
+	}
+	for _, c := range cases {
+		_, err := delivery.Deliver(message, c.recipient)
+		if c.code == "" && err != nil || c.code != "" && (err == nil || !strings.HasPrefix(err.Error(), c.code)) {
+			t.Errorf("Deliver(%s) error = %v, want code %q", c.recipient, err, c.code)
+		}
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(dir, "example.com", "user", "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("maildir has %d mails, want 1", len(files))
+	}
+	if !strings.HasSuffix(files[0].Name(), "."+maildirHostname) {
+		t.Errorf("file name %s doesn't end with hostname %s", files[0].Name(), maildirHostname)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "example.com", "user", "new", files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Return-Path: <sender@example.org>\nDelivered-To: User@Example.com\nSubject: test\n\nbody\n"
+	if string(data) != want {
+		t.Errorf("mail = %q, want %q", data, want)
+	}
+	if tmp, _ := ioutil.ReadDir(filepath.Join(dir, "example.com", "user", "tmp")); len(tmp) != 0 {
+		t.Errorf("tmp has %d files", len(tmp))
+	}
+}
+
+// запускает LMTP сервер, который отдает полученные после LHLO команды
+func startTestLMTPServer(conn net.Conn) <-chan string {
+	commands := make(chan string, 10)
+	go func() {
+		defer close(commands)
+		text := textproto.NewConn(conn)
+		defer text.Close()
+		text.PrintfLine("220-lmtp.example.com ready")
+		text.PrintfLine("220 LMTP")
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			commands <- line
+			if strings.HasPrefix(line, "LHLO ") {
+				text.PrintfLine("250-lmtp.example.com")
+				text.PrintfLine("250 PIPELINING")
+			} else {
+				text.PrintfLine("250 2.0.0 ok")
+			}
+		}
+	}()
+	return commands
+}
+
+func TestLMTPConn(t *testing.T) {
+	client, server := net.Pipe()
+	commands := startTestLMTPServer(server)
+	conn, err := newLMTPConn(client, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	smtpClient, err := smtp.NewClient(conn, "lmtp.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = smtpClient.Hello("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	// расширения берутся из ответа на LHLO
+	if ok, _ := smtpClient.Extension("PIPELINING"); !ok {
+		t.Error("extensions from LHLO reply are lost")
+	}
+	if err = smtpClient.Mail("sender@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	smtpClient.Close()
+
+	want := []string{"LHLO example.com", "MAIL FROM:<sender@example.com>"}
+	got := make([]string, 0)
+	for command := range commands {
+		got = append(got, command)
+	}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("server got commands %q, want %q", got, want)
+	}
+}
+
+func TestLMTPConnSplitHello(t *testing.T) {
+	client, server := net.Pipe()
+	commands := startTestLMTPServer(server)
+	conn, err := newLMTPConn(client, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// EHLO smtp клиента не попадает на сервер, даже если пишется по частям
+	for _, part := range []string{"EH", "LO example.com\r", "\nNOOP\r\n"} {
+		if _, err = conn.Write([]byte(part)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-commands
+	if command := <-commands; command != "NOOP" {
+		t.Errorf("server got command %q, want NOOP", command)
+	}
+	conn.Close()
+}
@@ -0,0 +1,287 @@
+package connector
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boreevyuri/postmanq/logger"
+)
+
+const (
+	// время ожидания загрузки политики MTA-STS по умолчанию
+	defaultMTASTSTimeout = 10 * time.Second
+
+	// максимальный размер файла политики MTA-STS, RFC 8461 3.3
+	maxMTASTSPolicySize = 64 * 1024
+
+	// максимальное время жизни политики MTA-STS, RFC 8461 3.2
+	maxMTASTSPolicyAge = 31557600
+
+	// минимальный интервал между проверками TXT записи домена с загруженной политикой MTA-STS
+	minMTASTSRecordInterval = time.Minute
+)
+
+var (
+	// http клиент, через который загружаются политики MTA-STS
+	httpClient HTTPClient = newHTTPClient(defaultMTASTSTimeout)
+)
+
+// HTTPClient загружает файлы по HTTPS
+type HTTPClient interface {
+	// Get отправляет GET запрос
+	Get(url string) (*http.Response, error)
+}
+
+// создает http клиент, который не переходит по редиректам, RFC 8461 3.3
+func newHTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// режим политики MTA-STS
+type stsMode int
+
+const (
+	// политика отключена
+	stsNoneMode stsMode = iota
+
+	// о нарушениях политики только сообщается
+	stsTestingMode
+
+	// политика обязательна к исполнению
+	stsEnforceMode
+)
+
+var (
+	// режимы политики по названиям из файла политики
+	stsModes = map[string]stsMode{
+		"none":    stsNoneMode,
+		"testing": stsTestingMode,
+		"enforce": stsEnforceMode,
+	}
+)
+
+// MTASTS настройки поиска политик MTA-STS доменов получателей, RFC 8461
+type MTASTS struct {
+	// включает поиск политик
+	Enabled bool `yaml:"enabled"`
+
+	// время ожидания загрузки политики
+	Timeout time.Duration `yaml:"timeout"`
+
+	// загруженные политики, в качестве ключа используется домен
+	policies map[string]*stsPolicy
+
+	// семафор для политик
+	mutex *sync.Mutex
+}
+
+// политика MTA-STS домена
+type stsPolicy struct {
+	// идентификатор политики из TXT записи
+	id string
+
+	// режим политики
+	mode stsMode
+
+	// шаблоны почтовых серверов домена
+	mx []string
+
+	// дата, после которой политика больше не действует
+	expiresAt time.Time
+
+	// дата последней проверки TXT записи
+	checkedAt time.Time
+}
+
+// устанавливает значения по умолчанию
+func (m *MTASTS) init() {
+	m.policies = make(map[string]*stsPolicy)
+	m.mutex = new(sync.Mutex)
+	if m.Timeout == 0 {
+		m.Timeout = defaultMTASTSTimeout
+	}
+}
+
+// отдает действующую политику домена или nil, если домен не публикует политику, prefix используется в логах
+// политика загружается заново, только если изменился ее идентификатор в TXT записи или истекло время жизни политики
+// TXT запись домена с загруженной политикой проверяется не чаще, чем раз в minMTASTSRecordInterval
+// если TXT запись или политику не удалось получить, используется загруженная ранее политика,
+// поэтому злоумышленник, подменивший DNS ответ, не сможет отключить TLS до истечения времени жизни политики
+func (m *MTASTS) lookup(prefix string, hostname string) *stsPolicy {
+	if !m.Enabled {
+		return nil
+	}
+	now := time.Now()
+	m.mutex.Lock()
+	cached, ok := m.policies[hostname]
+	if ok && now.After(cached.expiresAt) {
+		delete(m.policies, hostname)
+		cached = nil
+	}
+	if cached != nil {
+		if now.Sub(cached.checkedAt) < minMTASTSRecordInterval {
+			m.mutex.Unlock()
+			return cached
+		}
+		cached.checkedAt = now
+	}
+	m.mutex.Unlock()
+
+	id, err := lookupSTSRecord(hostname)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+			logger.Warn("%s can't look up mta-sts record for %s, error - %v", prefix, hostname, err)
+		}
+		return cached
+	}
+	if cached != nil && cached.id == id {
+		return cached
+	}
+
+	policy, err := fetchSTSPolicy(hostname)
+	if err != nil {
+		logger.Warn("%s can't fetch mta-sts policy for %s, error - %v", prefix, hostname, err)
+		return cached
+	}
+	policy.id = id
+	policy.checkedAt = now
+	m.mutex.Lock()
+	m.policies[hostname] = policy
+	m.mutex.Unlock()
+	logger.Info("%s load mta-sts policy %s for %s, mode - %s", prefix, id, hostname, policy.modeName())
+	return policy
+}
+
+// ищет идентификатор политики в TXT записи _mta-sts домена
+func lookupSTSRecord(hostname string) (string, error) {
+	txts, err := resolver.LookupTXT("_mta-sts." + hostname)
+	if err != nil {
+		return "", err
+	}
+	var records []string
+	for _, txt := range txts {
+		if strings.HasPrefix(txt, "v=STSv1;") || txt == "v=STSv1" {
+			records = append(records, txt)
+		}
+	}
+	// если записей несколько, считается, что домен не публикует политику, RFC 8461 3.1
+	if len(records) != 1 {
+		return "", notFoundError("_mta-sts." + hostname)
+	}
+	for _, field := range strings.Split(records[0], ";") {
+		field = strings.TrimSpace(field)
+		if strings.HasPrefix(field, "id=") && len(field) > 3 {
+			return field[3:], nil
+		}
+	}
+	return "", errors.New("mta-sts record has no id")
+}
+
+// загружает политику домена
+func fetchSTSPolicy(hostname string) (*stsPolicy, error) {
+	response, err := httpClient.Get(fmt.Sprintf("https://mta-sts.%s/.well-known/mta-sts.txt", hostname))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", response.Status)
+	}
+	if contentType := response.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain") {
+		return nil, fmt.Errorf("unexpected content type %s", contentType)
+	}
+	return parseSTSPolicy(io.LimitReader(response.Body, maxMTASTSPolicySize))
+}
+
+// разбирает файл политики, состоящий из строк вида "ключ: значение"
+func parseSTSPolicy(reader io.Reader) (*stsPolicy, error) {
+	policy := new(stsPolicy)
+	var version string
+	var mode string
+	maxAge := -1
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		i := strings.IndexByte(scanner.Text(), ':')
+		if i < 0 {
+			continue
+		}
+		key, value := strings.TrimSpace(scanner.Text()[:i]), strings.TrimSpace(scanner.Text()[i+1:])
+		switch key {
+		case "version":
+			version = value
+		case "mode":
+			mode = value
+		case "mx":
+			policy.mx = append(policy.mx, strings.ToLower(value))
+		case "max_age":
+			age, err := strconv.Atoi(value)
+			if err != nil || age < 0 {
+				return nil, fmt.Errorf("invalid max_age %s", value)
+			}
+			maxAge = age
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if version != "STSv1" {
+		return nil, fmt.Errorf("unsupported version %s", version)
+	}
+	var ok bool
+	policy.mode, ok = stsModes[mode]
+	if !ok {
+		return nil, fmt.Errorf("unknown mode %s", mode)
+	}
+	if maxAge < 0 {
+		return nil, errors.New("policy has no max_age")
+	}
+	if policy.mode != stsNoneMode && len(policy.mx) == 0 {
+		return nil, errors.New("policy has no mx")
+	}
+	if maxAge > maxMTASTSPolicyAge {
+		maxAge = maxMTASTSPolicyAge
+	}
+	policy.expiresAt = time.Now().Add(time.Duration(maxAge) * time.Second)
+	return policy, nil
+}
+
+// сигнализирует, что почтовый сервер указан в политике
+// шаблон вида *.example.com подходит только для одного уровня поддомена, RFC 8461 4.1
+func (p *stsPolicy) matches(mxHostname string) bool {
+	mxHostname = strings.ToLower(strings.TrimRight(mxHostname, "."))
+	for _, pattern := range p.mx {
+		if strings.HasPrefix(pattern, "*.") {
+			i := strings.IndexByte(mxHostname, '.')
+			if i > 0 && mxHostname[i+1:] == pattern[2:] {
+				return true
+			}
+		} else if mxHostname == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// отдает название режима политики
+func (p *stsPolicy) modeName() string {
+	for name, mode := range stsModes {
+		if mode == p.mode {
+			return name
+		}
+	}
+	return "unknown"
+}
@@ -0,0 +1,208 @@
+package connector
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSTSPolicy(t *testing.T) {
+	cases := []struct {
+		name   string
+		policy string
+		mode   stsMode
+		mx     []string
+		maxAge time.Duration
+		ok     bool
+	}{
+		{
+			"enforce",
+			"version: STSv1\r\nmode: enforce\r\nmx: MX1.example.com\r\nmx: *.example.net\r\nmax_age: 86400\r\n",
+			stsEnforceMode, []string{"mx1.example.com", "*.example.net"}, 24 * time.Hour, true,
+		},
+		{"testing", "version: STSv1\nmode: testing\nmx: mx.example.com\nmax_age: 3600\n", stsTestingMode, []string{"mx.example.com"}, time.Hour, true},
+		{"none without mx", "version: STSv1\nmode: none\nmax_age: 0\n", stsNoneMode, nil, 0, true},
+		{"lines without colon are skipped", "version: STSv1\ngarbage\nmode: none\nmax_age: 60\n", stsNoneMode, nil, time.Minute, true},
+		{"max_age is clamped", "version: STSv1\nmode: none\nmax_age: 99999999999\n", stsNoneMode, nil, maxMTASTSPolicyAge * time.Second, true},
+		{"unsupported version", "version: STSv2\nmode: none\nmax_age: 60\n", stsNoneMode, nil, 0, false},
+		{"without version", "mode: none\nmax_age: 60\n", stsNoneMode, nil, 0, false},
+		{"unknown mode", "version: STSv1\nmode: strict\nmx: mx.example.com\nmax_age: 60\n", stsNoneMode, nil, 0, false},
+		{"without max_age", "version: STSv1\nmode: none\n", stsNoneMode, nil, 0, false},
+		{"negative max_age", "version: STSv1\nmode: none\nmax_age: -1\n", stsNoneMode, nil, 0, false},
+		{"invalid max_age", "version: STSv1\nmode: none\nmax_age: day\n", stsNoneMode, nil, 0, false},
+		{"enforce without mx", "version: STSv1\nmode: enforce\nmax_age: 60\n", stsNoneMode, nil, 0, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			now := time.Now()
+			policy, err := parseSTSPolicy(strings.NewReader(c.policy))
+			if (err == nil) != c.ok {
+				t.Fatalf("parseSTSPolicy() error = %v, want ok %v", err, c.ok)
+			}
+			if !c.ok {
+				return
+			}
+			if policy.mode != c.mode || strings.Join(policy.mx, " ") != strings.Join(c.mx, " ") {
+				t.Errorf("policy = %s, %v, want %v, %v", policy.modeName(), policy.mx, c.mode, c.mx)
+			}
+			if maxAge := policy.expiresAt.Sub(now); maxAge < c.maxAge || maxAge > c.maxAge+time.Second {
+				t.Errorf("policy expires in %v, want %v", maxAge, c.maxAge)
+			}
+		})
+	}
+}
+
+func TestSTSPolicyMatches(t *testing.T) {
+	policy := &stsPolicy{mx: []string{"mx.example.com", "*.example.net"}}
+	cases := []struct {
+		hostname string
+		matches  bool
+	}{
+		{"mx.example.com", true},
+		{"MX.Example.com.", true},
+		{"mx2.example.com", false},
+		{"a.example.net", true},
+		// шаблон подходит только для одного уровня поддомена
+		{"a.b.example.net", false},
+		{"example.net", false},
+		{".example.net", false},
+		{"a.example.net.org", false},
+	}
+	for _, c := range cases {
+		if matches := policy.matches(c.hostname); matches != c.matches {
+			t.Errorf("matches(%s) = %v, want %v", c.hostname, matches, c.matches)
+		}
+	}
+}
+
+func TestLookupSTSRecord(t *testing.T) {
+	cases := []struct {
+		name     string
+		txts     []string
+		id       string
+		notFound bool
+	}{
+		{"single record", []string{"v=spf1 -all", "v=STSv1; id=20200101T000000;"}, "20200101T000000", false},
+		{"several records", []string{"v=STSv1; id=1", "v=STSv1; id=2"}, "", true},
+		{"other records only", []string{"v=spf1 -all"}, "", true},
+		{"record without id", []string{"v=STSv1;"}, "", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			stubResolver(t, &StubResolver{TXT: map[string][]string{"_mta-sts.example.com": c.txts}})
+			id, err := lookupSTSRecord("example.com")
+			if c.notFound {
+				if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+					t.Errorf("lookupSTSRecord() error = %v, want not found", err)
+				}
+				return
+			}
+			if id != c.id || (err == nil) != (len(c.id) > 0) {
+				t.Errorf("lookupSTSRecord() = %s, %v, want %s", id, err, c.id)
+			}
+		})
+	}
+}
+
+// резолвер, который считает запросы TXT записей
+type testTXTResolver struct {
+	StubResolver
+
+	// количество запросов
+	queries int
+
+	// ошибка поиска
+	err error
+}
+
+// LookupTXT ищет TXT записи домена
+func (r *testTXTResolver) LookupTXT(hostname string) ([]string, error) {
+	r.queries++
+	if r.err != nil {
+		return nil, r.err
+	}
+	return r.StubResolver.LookupTXT(hostname)
+}
+
+// http клиент, который отдает политику или ошибку
+type testHTTPClient struct {
+	// файл политики
+	policy string
+
+	// ошибка загрузки
+	err error
+
+	// количество запросов
+	requests int
+}
+
+// Get отправляет GET запрос
+func (c *testHTTPClient) Get(url string) (*http.Response, error) {
+	c.requests++
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Header:     http.Header{"Content-Type": {"text/plain"}},
+		Body:       ioutil.NopCloser(strings.NewReader(c.policy)),
+	}, nil
+}
+
+// подставляет http клиент на время теста
+func stubHTTPClient(t *testing.T, stub HTTPClient) {
+	previous := httpClient
+	httpClient = stub
+	t.Cleanup(func() { httpClient = previous })
+}
+
+func TestMTASTSLookup(t *testing.T) {
+	txtResolver := &testTXTResolver{StubResolver: StubResolver{TXT: map[string][]string{"_mta-sts.example.com": {"v=STSv1; id=1"}}}}
+	stubResolver(t, txtResolver)
+	client := &testHTTPClient{policy: "version: STSv1\nmode: enforce\nmx: mx.example.com\nmax_age: 86400\n"}
+	stubHTTPClient(t, client)
+	mtasts := &MTASTS{Enabled: true}
+	mtasts.init()
+
+	policy := mtasts.lookup("test", "example.com")
+	if policy == nil || policy.mode != stsEnforceMode || client.requests != 1 {
+		t.Fatalf("lookup() = %v after %d requests, want enforce policy", policy, client.requests)
+	}
+
+	// TXT запись не проверяется до истечения интервала
+	if mtasts.lookup("test", "example.com") != policy || txtResolver.queries != 1 {
+		t.Errorf("txt record is queried %d times within interval, want 1", txtResolver.queries)
+	}
+
+	// идентификатор не изменился, политика не загружается заново
+	policy.checkedAt = time.Now().Add(-minMTASTSRecordInterval)
+	if mtasts.lookup("test", "example.com") != policy || txtResolver.queries != 2 || client.requests != 1 {
+		t.Errorf("policy with same id is reloaded, %d txt queries, %d requests", txtResolver.queries, client.requests)
+	}
+
+	// новую политику не удалось загрузить, используется загруженная ранее
+	policy.checkedAt = time.Now().Add(-minMTASTSRecordInterval)
+	txtResolver.TXT["_mta-sts.example.com"] = []string{"v=STSv1; id=2"}
+	client.err = errors.New("connection refused")
+	if mtasts.lookup("test", "example.com") != policy || client.requests != 2 {
+		t.Errorf("cached policy isn't kept after fetch failure, %d requests", client.requests)
+	}
+
+	// TXT запись не удалось получить, используется загруженная ранее политика
+	policy.checkedAt = time.Now().Add(-minMTASTSRecordInterval)
+	txtResolver.err = &net.DNSError{Err: "server misbehaving", IsTemporary: true}
+	if mtasts.lookup("test", "example.com") != policy {
+		t.Error("cached policy isn't kept after txt lookup failure")
+	}
+
+	// политика с истекшим временем жизни не используется
+	policy.expiresAt = time.Now().Add(-time.Second)
+	if cached := mtasts.lookup("test", "example.com"); cached != nil {
+		t.Errorf("lookup() = %v, want expired policy dropped", cached)
+	}
+}
@@ -0,0 +1,141 @@
+package connector
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/boreevyuri/postmanq/logger"
+)
+
+const (
+	// время, в течение которого TLS не используется после неудачной попытки, по умолчанию
+	defaultTLSCoolOff = time.Hour
+)
+
+// режим использования TLS при отправке писем
+type tlsMode int
+
+const (
+	// TLS не используется
+	tlsNoneMode tlsMode = iota
+
+	// TLS используется, если почтовый сервер его поддерживает, сертификат не проверяется
+	tlsOpportunisticMode
+
+	// письмо отправляется только через TLS с проверкой сертификата
+	tlsRequiredMode
+)
+
+var (
+	// режимы TLS по названиям из настроек
+	tlsModes = map[string]tlsMode{
+		"none":          tlsNoneMode,
+		"opportunistic": tlsOpportunisticMode,
+		"required":      tlsRequiredMode,
+	}
+)
+
+// TLSPolicy политика использования TLS для доменов получателей
+type TLSPolicy struct {
+	// режим TLS по умолчанию, none, opportunistic или required
+	Default string `yaml:"default"`
+
+	// режим TLS для доменов получателей, в качестве ключа используется домен
+	// режим, указанный для домена, важнее политики MTA-STS домена
+	Domains map[string]string `yaml:"domains"`
+
+	// настройки MTA-STS
+	MTASTS MTASTS `yaml:"mtaSts"`
+
+	// включает проверку сертификатов почтовых серверов по TLSA записям, RFC 7672
+	DANE bool `yaml:"dane"`
+
+	// время, в течение которого TLS не используется после неудачной попытки в режиме opportunistic
+	CoolOff time.Duration `yaml:"coolOff"`
+
+	// режим TLS по умолчанию
+	defaultMode tlsMode
+
+	// режимы TLS для доменов
+	modes map[string]tlsMode
+}
+
+// проверяет настройки
+func (p *TLSPolicy) init() error {
+	if len(p.Default) == 0 {
+		p.Default = "opportunistic"
+	}
+	mode, ok := tlsModes[p.Default]
+	if !ok {
+		return fmt.Errorf("unknown tls mode %s", p.Default)
+	}
+	p.defaultMode = mode
+	if p.CoolOff == 0 {
+		p.CoolOff = defaultTLSCoolOff
+	}
+	p.modes = make(map[string]tlsMode)
+	for domain, name := range p.Domains {
+		mode, ok := tlsModes[name]
+		if !ok {
+			return fmt.Errorf("unknown tls mode %s for %s", name, domain)
+		}
+		p.modes[domain] = mode
+	}
+	p.MTASTS.init()
+	return nil
+}
+
+// устанавливает режим TLS для почтовых серверов домена, prefix используется в логах
+// если домен опубликовал политику MTA-STS в режиме enforce, TLS обязателен,
+// а письма не отправляются на серверы, которых нет в политике
+// если у сервера есть подписанные TLSA записи, TLS обязателен, а сертификат проверяется по записям, а не по политике MTA-STS
+// если TLSA записи не удалось найти, письма серверу откладываются
+func (p *TLSPolicy) apply(prefix string, hostnameTo string, mxServers []*MxServer) {
+	p.applyMode(prefix, hostnameTo, mxServers)
+	for _, mxServer := range mxServers {
+		mxServer.tlsa, mxServer.tlsaError = nil, nil
+		if p.DANE && mxServer.tlsMode != tlsNoneMode {
+			mxServer.tlsa, mxServer.tlsaError = lookupTLSA(prefix, mxServer.hostname)
+		}
+	}
+}
+
+// устанавливает режим TLS для почтовых серверов домена по настройкам и политике MTA-STS
+func (p *TLSPolicy) applyMode(prefix string, hostnameTo string, mxServers []*MxServer) {
+	mode, ok := p.modes[hostnameTo]
+	if ok {
+		for _, mxServer := range mxServers {
+			mxServer.tlsMode = mode
+			mxServer.stsMismatch = false
+		}
+		return
+	}
+
+	mode = p.defaultMode
+	policy := p.MTASTS.lookup(prefix, hostnameTo)
+	if policy != nil && policy.mode == stsEnforceMode {
+		mode = tlsRequiredMode
+	}
+	for _, mxServer := range mxServers {
+		mxServer.tlsMode = mode
+		mxServer.stsMismatch = false
+		if policy != nil && policy.mode != stsNoneMode && !policy.matches(mxServer.hostname) {
+			if policy.mode == stsEnforceMode {
+				mxServer.stsMismatch = true
+				logger.Warn("%s mx %s isn't listed in mta-sts policy of %s, it won't be used", prefix, mxServer.hostname, hostnameTo)
+			} else {
+				logger.Warn("%s mx %s isn't listed in mta-sts policy of %s", prefix, mxServer.hostname, hostnameTo)
+			}
+		}
+	}
+}
+
+// отдает название режима TLS
+func (m tlsMode) String() string {
+	for name, mode := range tlsModes {
+		if mode == m {
+			return name
+		}
+	}
+	return "unknown"
+}
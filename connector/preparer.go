@@ -29,13 +29,30 @@ func (p *Preparer) run() {
 
 // подготавливает и запускает событие создание соединения
 func (p *Preparer) prepare(event *common.SendEvent) {
-	logger.Info("preparer#%d-%d try create connection", p.id, event.Message.ID)
+	logger.Info("preparer#%d-%s try create connection", p.id, event.Message.ID)
 
 	connectionEvent := &ConnectionEvent{
 		SendEvent:   event,
 		servers:     make(chan *MailServer, 1),
 		connectorID: p.id,
-		address:     service.Addresses[p.id%service.addressesLen],
+	}
+	// правило из карты транспортов или релей отменяют поиск почтовых серверов получателя
+	if rule := service.Transports.route(event.Message.HostnameTo); rule != nil && rule.kind != directTransport {
+		if rule.delivery != nil {
+			// письмо доставляется без соединения, но его все равно нужно собрать
+			logger.Debug("preparer#%d-%s deliver mail for %s by %s transport", p.id, event.Message.ID, event.Message.HostnameTo, rule.Transport)
+			event.Delivery = rule.delivery
+			event.Iterator.Next().(common.SendingService).Events() <- event
+			return
+		}
+		logger.Debug("preparer#%d-%s send mail for %s by %s transport", p.id, event.Message.ID, event.Message.HostnameTo, rule.Transport)
+		connectionEvent.server = rule.server
+	} else if rule == nil && service.Relay.isEnabled() {
+		connectionEvent.server = service.Relay.server
+	}
+	if connectionEvent.server != nil {
+		connectorEvents <- connectionEvent
+		return
 	}
 	goto connectToMailServer
 
@@ -50,16 +67,29 @@ connectToMailServer:
 		connectionEvent.server = server
 		connectorEvents <- connectionEvent
 	case ErrorMailServerStatus:
+		// письмо возвращается с ошибкой, только если домена точно нет,
+		// после временной ошибки DNS письмо откладывается и отправляется повторно по расписанию
+		if server.notFound() {
+			common.ReturnMail(
+				event,
+				fmt.Errorf("511 preparer#%d-%s can't lookup %s", p.id, event.Message.ID, event.Message.HostnameTo),
+			)
+		} else {
+			common.ReturnMail(
+				event,
+				fmt.Errorf("451 4.4.3 preparer#%d-%s can't lookup %s, it will be retried", p.id, event.Message.ID, event.Message.HostnameTo),
+			)
+		}
+	case NullMxMailServerStatus:
 		common.ReturnMail(
 			event,
-			// errors.New(fmt.Sprintf("511 preparer#%d-%d can't lookup %s", p.id, event.Message.Id, event.Message.HostnameTo)),
-			fmt.Errorf("511 preparer#%d-%d can't lookup %s", p.id, event.Message.ID, event.Message.HostnameTo),
+			fmt.Errorf("556 5.1.10 preparer#%d-%s domain %s does not accept mail", p.id, event.Message.ID, event.Message.HostnameTo),
 		)
 	}
 	return
 
 waitLookup:
-	logger.Debug("preparer#%d-%d wait ending look up mail server %s...", p.id, event.Message.ID, event.Message.HostnameTo)
+	logger.Debug("preparer#%d-%s wait ending look up mail server %s...", p.id, event.Message.ID, event.Message.HostnameTo)
 	time.Sleep(common.App.Timeout().Sleep)
 	goto connectToMailServer
 	// return
@@ -0,0 +1,201 @@
+package connector
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+)
+
+// способ защиты соединения с релеем
+type relayTLS int
+
+const (
+	// соединение открывается без шифрования, а затем шифруется командой STARTTLS
+	relayStartTLS relayTLS = iota
+
+	// соединение шифруется сразу после подключения
+	relayImplicitTLS
+
+	// соединение не шифруется
+	relayNoTLS
+)
+
+var (
+	// способы защиты соединения по названиям из настроек
+	relayTLSModes = map[string]relayTLS{
+		"starttls": relayStartTLS,
+		"implicit": relayImplicitTLS,
+		"none":     relayNoTLS,
+	}
+
+	// порты релея по умолчанию для способов защиты соединения
+	relayPorts = map[relayTLS]string{
+		relayStartTLS:    "587",
+		relayImplicitTLS: "465",
+		relayNoTLS:       "25",
+	}
+
+	// механизмы аутентификации в порядке предпочтения, если механизм не указан в настройках
+	relayAuthMechanisms = []string{"PLAIN", "LOGIN", "CRAM-MD5"}
+)
+
+// Relay настройки отправки писем через релей вместо почтовых серверов получателей
+type Relay struct {
+	// адрес релея в виде host или host:port, если не указан, письма отправляются напрямую почтовым серверам получателей
+	Host string `yaml:"host"`
+
+	// способ защиты соединения - starttls, implicit или none
+	TLS string `yaml:"tls"`
+
+	// логин, если не указан, аутентификация не выполняется
+	Username string `yaml:"username"`
+
+	// пароль
+	Password string `yaml:"password"`
+
+	// механизм аутентификации - plain, login или cram-md5, по умолчанию выбирается из поддерживаемых релеем
+	Auth string `yaml:"auth"`
+
+	// почтовый сервис релея
+	server *MailServer
+}
+
+// проверяет настройки и создает почтовый сервис релея
+func (r *Relay) init() error {
+	if !r.isEnabled() {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host, port = r.Host, ""
+	}
+	if len(r.TLS) == 0 {
+		r.TLS = "starttls"
+		if port == relayPorts[relayImplicitTLS] {
+			r.TLS = "implicit"
+		}
+	}
+	mode, ok := relayTLSModes[r.TLS]
+	if !ok {
+		return fmt.Errorf("unknown relay tls %s", r.TLS)
+	}
+	if len(port) == 0 {
+		port = relayPorts[mode]
+	}
+	r.Auth = strings.ToUpper(r.Auth)
+	if len(r.Auth) > 0 && !r.supports(r.Auth) {
+		return fmt.Errorf("unknown relay auth %s", r.Auth)
+	}
+
+	mxServer := newMxServer(host, service.Addresses)
+	mxServer.port = port
+	mxServer.relay = r
+	mxServer.implicitTLS = mode == relayImplicitTLS
+	if mode == relayNoTLS {
+		mxServer.tlsMode = tlsNoneMode
+	} else {
+		// сертификат релея всегда проверяется, потому что релею передаются логин и пароль
+		mxServer.tlsMode = tlsRequiredMode
+	}
+	r.server = &MailServer{
+		mxServers: []*MxServer{mxServer},
+		status:    SuccessMailServerStatus,
+	}
+	return nil
+}
+
+// сигнализирует, что письма отправляются через релей
+func (r *Relay) isEnabled() bool {
+	return len(r.Host) > 0
+}
+
+// сигнализирует, что механизм аутентификации поддерживается
+func (r *Relay) supports(mechanism string) bool {
+	for _, supported := range relayAuthMechanisms {
+		if supported == mechanism {
+			return true
+		}
+	}
+	return false
+}
+
+// выполняет аутентификацию на релее, если в настройках указан логин
+// механизм берется из настроек или выбирается из механизмов, которые релей перечислил в ответе на EHLO
+func (r *Relay) authenticate(client *smtp.Client, hostname string) error {
+	if len(r.Username) == 0 {
+		return nil
+	}
+	ok, mechanisms := client.Extension("AUTH")
+	if !ok {
+		return errors.New("relay doesn't support AUTH")
+	}
+	mechanism := r.Auth
+	if len(mechanism) == 0 {
+		offered := strings.Fields(strings.ToUpper(mechanisms))
+		for _, supported := range relayAuthMechanisms {
+			for _, name := range offered {
+				if name == supported {
+					mechanism = supported
+					break
+				}
+			}
+			if len(mechanism) > 0 {
+				break
+			}
+		}
+		if len(mechanism) == 0 {
+			return fmt.Errorf("relay offers unsupported auth mechanisms %s", mechanisms)
+		}
+	}
+
+	var auth smtp.Auth
+	switch mechanism {
+	case "PLAIN":
+		auth = smtp.PlainAuth("", r.Username, r.Password, hostname)
+	case "LOGIN":
+		auth = &loginAuth{username: r.Username, password: r.Password, host: hostname}
+	case "CRAM-MD5":
+		auth = smtp.CRAMMD5Auth(r.Username, r.Password)
+	}
+	return client.Auth(auth)
+}
+
+// аутентификация механизмом LOGIN, стандартная библиотека его не поддерживает
+type loginAuth struct {
+	// логин
+	username string
+
+	// пароль
+	password string
+
+	// домен релея
+	host string
+}
+
+// Start начинает аутентификацию
+// как и PLAIN, логин и пароль передаются только по защищенному соединению
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && a.host != "localhost" && a.host != "127.0.0.1" && a.host != "::1" {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+// Next отвечает на запросы логина и пароля
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected server challenge %s", fromServer)
+}
@@ -0,0 +1,218 @@
+package connector
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// время ожидания ответа DNS сервера по умолчанию
+	defaultDNSTimeout = 5 * time.Second
+
+	// количество повторных запросов после временной ошибки по умолчанию
+	defaultDNSRetries = 2
+)
+
+var (
+	// резолвер, через который ищутся почтовые серверы
+	resolver Resolver = &netResolver{
+		resolver: net.DefaultResolver,
+		timeout:  defaultDNSTimeout,
+		retries:  defaultDNSRetries,
+	}
+)
+
+// Resolver ищет DNS записи
+// искатель работает с DNS только через резолвер, поэтому поиск серверов можно проверить без доступа к сети
+type Resolver interface {
+	// LookupMX ищет MX записи домена
+	LookupMX(hostname string) ([]*net.MX, error)
+
+	// LookupIP ищет A и AAAA записи домена
+	LookupIP(hostname string) ([]net.IP, error)
+
+	// LookupTXT ищет TXT записи домена
+	LookupTXT(hostname string) ([]string, error)
+
+	// LookupTLSA ищет TLSA записи, второй результат сигнализирует, что DNS сервер проверил подпись DNSSEC ответа
+	LookupTLSA(hostname string) ([]*TLSA, bool, error)
+}
+
+// резолвер, который отправляет запросы DNS серверам
+type netResolver struct {
+	// резолвер стандартной библиотеки
+	resolver *net.Resolver
+
+	// время ожидания ответа
+	timeout time.Duration
+
+	// количество повторных запросов после временной ошибки
+	retries int
+
+	// DNS серверы из настроек
+	nameservers []string
+
+	// номер следующего DNS сервера
+	next uint32
+}
+
+// создает резолвер по настройкам
+// если DNS серверы не указаны, используются серверы операционной системы
+func newNetResolver(config *DNSConfig) *netResolver {
+	r := &netResolver{
+		resolver: net.DefaultResolver,
+		timeout:  config.Timeout,
+		retries:  config.Retries,
+	}
+	if len(config.Nameservers) > 0 {
+		r.nameservers = withDNSPort(config.Nameservers)
+		r.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				dialer := new(net.Dialer)
+				return dialer.DialContext(ctx, network, r.nameserver())
+			},
+		}
+	}
+	return r
+}
+
+// добавляет порт по умолчанию к адресам DNS серверов
+func withDNSPort(addresses []string) []string {
+	nameservers := make([]string, len(addresses))
+	for i, nameserver := range addresses {
+		if _, _, err := net.SplitHostPort(nameserver); err != nil {
+			nameserver = net.JoinHostPort(nameserver, "53")
+		}
+		nameservers[i] = nameserver
+	}
+	return nameservers
+}
+
+// отдает DNS сервер для следующего запроса
+// каждый запрос отправляется следующему серверу из списка,
+// поэтому повторный запрос после ошибки уйдет другому серверу
+func (r *netResolver) nameserver() string {
+	nameservers := r.nameservers
+	if len(nameservers) == 0 {
+		nameservers = systemNameservers()
+	}
+	return nameservers[int(atomic.AddUint32(&r.next, 1)-1)%len(nameservers)]
+}
+
+// LookupMX ищет MX записи домена
+func (r *netResolver) LookupMX(hostname string) ([]*net.MX, error) {
+	var mxes []*net.MX
+	err := r.retry(func(ctx context.Context) (err error) {
+		mxes, err = r.resolver.LookupMX(ctx, hostname)
+		return
+	})
+	return mxes, err
+}
+
+// LookupIP ищет A и AAAA записи домена
+func (r *netResolver) LookupIP(hostname string) ([]net.IP, error) {
+	var ips []net.IP
+	err := r.retry(func(ctx context.Context) error {
+		addrs, err := r.resolver.LookupIPAddr(ctx, hostname)
+		ips = make([]net.IP, len(addrs))
+		for i, addr := range addrs {
+			ips[i] = addr.IP
+		}
+		return err
+	})
+	return ips, err
+}
+
+// LookupTXT ищет TXT записи домена
+func (r *netResolver) LookupTXT(hostname string) ([]string, error) {
+	var txts []string
+	err := r.retry(func(ctx context.Context) (err error) {
+		txts, err = r.resolver.LookupTXT(ctx, hostname)
+		return
+	})
+	return txts, err
+}
+
+// LookupTLSA ищет TLSA записи
+// стандартная библиотека не умеет искать TLSA записи, поэтому запрос отправляется DNS серверу напрямую
+func (r *netResolver) LookupTLSA(hostname string) ([]*TLSA, bool, error) {
+	var records []*TLSA
+	var authenticated bool
+	err := r.retry(func(ctx context.Context) (err error) {
+		records, authenticated, err = exchangeTLSA(ctx, r.nameserver(), hostname)
+		return
+	})
+	return records, authenticated, err
+}
+
+// выполняет запрос с таймаутом и повторяет его после временной ошибки
+func (r *netResolver) retry(lookup func(ctx context.Context) error) error {
+	var err error
+	for attempt := 0; attempt <= r.retries; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+		err = lookup(ctx)
+		cancel()
+		dnsErr, ok := err.(*net.DNSError)
+		if err == nil || ok && !dnsErr.Temporary() && !dnsErr.Timeout() {
+			break
+		}
+	}
+	return err
+}
+
+// StubResolver резолвер, который отдает записи из памяти
+// домен, которого нет в записях, считается несуществующим
+type StubResolver struct {
+	// MX записи, в качестве ключа используется домен
+	MX map[string][]*net.MX
+
+	// A и AAAA записи, в качестве ключа используется домен
+	IP map[string][]net.IP
+
+	// TXT записи, в качестве ключа используется домен
+	TXT map[string][]string
+
+	// TLSA записи, в качестве ключа используется домен, записи считаются подписанными DNSSEC
+	TLSA map[string][]*TLSA
+}
+
+// LookupMX ищет MX записи домена
+func (r *StubResolver) LookupMX(hostname string) ([]*net.MX, error) {
+	if mxes, ok := r.MX[strings.TrimRight(hostname, ".")]; ok {
+		return mxes, nil
+	}
+	return nil, notFoundError(hostname)
+}
+
+// LookupIP ищет A и AAAA записи домена
+func (r *StubResolver) LookupIP(hostname string) ([]net.IP, error) {
+	if ips, ok := r.IP[strings.TrimRight(hostname, ".")]; ok {
+		return ips, nil
+	}
+	return nil, notFoundError(hostname)
+}
+
+// LookupTXT ищет TXT записи домена
+func (r *StubResolver) LookupTXT(hostname string) ([]string, error) {
+	if txts, ok := r.TXT[strings.TrimRight(hostname, ".")]; ok {
+		return txts, nil
+	}
+	return nil, notFoundError(hostname)
+}
+
+// LookupTLSA ищет TLSA записи
+func (r *StubResolver) LookupTLSA(hostname string) ([]*TLSA, bool, error) {
+	if records, ok := r.TLSA[strings.TrimRight(hostname, ".")]; ok {
+		return records, true, nil
+	}
+	return nil, false, notFoundError(hostname)
+}
+
+// создает ошибку отсутствия записи, как у стандартного резолвера
+func notFoundError(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
@@ -1,11 +1,13 @@
 package connector
 
 import (
+	"errors"
+	"fmt"
 	"net"
-	"regexp"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/boreevyuri/postmanq/logger"
 )
@@ -14,6 +16,9 @@ var (
 	seekerEvents = make(chan *ConnectionEvent)
 	// семафор, необходим для поиска MX серверов
 	seekerMutex = new(sync.Mutex)
+
+	// ошибка поиска почтовых серверов домена, который не принимает почту, RFC 7505
+	errNullMX = errors.New("domain publishes null mx")
 )
 
 // Seeker искатель, ищет информацию о сервере
@@ -40,20 +45,22 @@ func (s *Seeker) seek(event *ConnectionEvent) {
 	hostnameTo := event.Message.HostnameTo
 	// добавляем новый почтовый домен
 	seekerMutex.Lock()
-	if _, ok := mailServers[hostnameTo]; !ok {
-		logger.Debug("seeker#%d-%d create mail server for %s", event.connectorID, event.Message.ID, hostnameTo)
-		mailServers[hostnameTo] = &MailServer{
+	mailServer, ok := mailServers[hostnameTo]
+	if !ok {
+		logger.Debug("seeker#%d-%s create mail server for %s", event.connectorID, event.Message.ID, hostnameTo)
+		mailServer = &MailServer{
 			status:      LookupMailServerStatus,
 			connectorID: event.connectorID,
 		}
+		mailServers[hostnameTo] = mailServer
 	}
+	mailServer.usedAt = time.Now()
 	seekerMutex.Unlock()
-	mailServer := mailServers[hostnameTo]
 	// если пришло несколько несколько писем на один почтовый сервис,
 	// и информация о сервисе еще не собрана,
 	// то таким образом блокируем повторную попытку собрать инфомацию о почтовом сервисе
 	logger.Debug(
-		"seeker#%d-%d domain %s, event connector#%d, mail connector#%d, status#%d",
+		"seeker#%d-%s domain %s, event connector#%d, mail connector#%d, status#%d",
 		s.id,
 		event.Message.ID,
 		hostnameTo,
@@ -62,103 +69,76 @@ func (s *Seeker) seek(event *ConnectionEvent) {
 		mailServer.status,
 	)
 	if event.connectorID == mailServer.connectorID && mailServer.status == LookupMailServerStatus {
-		logger.Debug("seeker#%d-%d look up mx domains for %s...", s.id, event.Message.ID, hostnameTo)
-		mailServer := mailServers[hostnameTo]
+		logger.Debug("seeker#%d-%s look up mx domains for %s...", s.id, event.Message.ID, hostnameTo)
 		// ищем почтовые сервера для домена
-		mxes, err := net.LookupMX(hostnameTo)
+		mxServers, err := service.lookupMxServers(fmt.Sprintf("seeker#%d-%s", s.id, event.Message.ID), hostnameTo)
+		mailServer.update(mxServers, err)
 		if err == nil {
-			mailServer.mxServers = make([]*MxServer, len(mxes))
-			for i, mx := range mxes {
-				mxHostname := strings.TrimRight(mx.Host, ".")
-				logger.Debug("seeker#%d-%d look up mx domain %s for %s", s.id, event.Message.ID, mxHostname, hostnameTo)
-				mxServer := newMxServer(mxHostname)
-				//mxServer.realServerName = s.seekRealServerName(mx.Host, event)
-				// собираем IP адреса для сертификата и проверок
-				ips, err := net.LookupIP(mxHostname)
-				if err == nil {
-					for _, ip := range ips {
-						// берем только IPv4
-						ip = ip.To4()
-						if ip != nil {
-							logger.Debug("seeker#%d-%d look up ip %s for %s", s.id, event.Message.ID, ip.String(), mxHostname)
-							existsIpsLen := len(mxServer.ips)
-							index := sort.Search(existsIpsLen, func(i int) bool {
-								return mxServer.ips[i].Equal(ip)
-							})
-							// избавляемся от повторяющихся IP адресов
-							if existsIpsLen == 0 || (index == -1 && existsIpsLen > 0) {
-								mxServer.ips = append(mxServer.ips, ip)
-							}
-						}
-					}
-					// домен почтового ящика может отличаться от домена почтового сервера,
-					// а домен почтового сервера может отличаться от реальной A записи сервера,
-					// на котором размещен этот почтовый сервер
-					// нам необходимо получить реальный домен, для того чтобы подписать на него сертификат
-					for _, ip := range mxServer.ips {
-						// пытаемся получить адреса сервера
-						addrs, err := net.LookupAddr(ip.String())
-						if err == nil {
-							for _, addr := range addrs {
-								// адрес получаем с точкой на конце, убираем ее
-								addr = strings.TrimRight(addr, ".")
-								// отсекаем адрес, если это IP
-								if net.ParseIP(addr) == nil {
-									logger.Debug("seeker#%d-%d look up addr %s for ip %s", s.id, event.Message.ID, addr, ip.String())
-									if len(mxServer.realServerName) == 0 {
-										// пытаем найти домен почтового сервера в домене почты
-										hostnameMatched, _ := regexp.MatchString(hostnameTo, mxServer.hostname)
-										// пытаемся найти адрес в домене почтового сервиса
-										addrMatched, _ := regexp.MatchString(mxServer.hostname, addr)
-										// если найден домен почтового сервера в домене почты
-										// тогда в адресе будет PTR запись
-										if hostnameMatched && !addrMatched {
-											mxServer.realServerName = addr
-										} else if !hostnameMatched && addrMatched || !hostnameMatched && !addrMatched { // если найден адрес в домене почтового сервиса или нет совпадений
-											mxServer.realServerName = mxServer.hostname
-										}
-									}
-								}
-							}
-						} else {
-							logger.Warn("seeker#%d-%d can't look up addr for ip %s, err: %s", s.id, event.Message.ID, ip.String(), err)
-						}
-					}
-				} else {
-					logger.Warn("seeker#%d-%d can't look up ips for mx %s", s.id, event.Message.ID, mxHostname)
-				}
-				if len(mxServer.realServerName) == 0 { // если безвыходная ситуация
-					mxServer.realServerName = mxServer.hostname
-				}
-				logger.Debug("seeker#%d-%d look up detect real server name %s", s.id, event.Message.ID, mxServer.realServerName)
-				mailServer.mxServers[i] = mxServer
-			}
-			mailServer.status = SuccessMailServerStatus
-			logger.Debug("seeker#%d-%d look up %s success", s.id, event.Message.ID, hostnameTo)
+			logger.Debug("seeker#%d-%s look up %s success", s.id, event.Message.ID, hostnameTo)
+		} else if err == errNullMX {
+			logger.Info("seeker#%d-%s domain %s doesn't accept mail, it publishes null mx", s.id, event.Message.ID, hostnameTo)
 		} else {
-			mailServer.status = ErrorMailServerStatus
-			logger.Warn("seeker#%d-%d can't look up mx domains for %s, err: %v", s.id, event.Message.ID, hostnameTo, err)
+			logger.Warn("seeker#%d-%s can't look up mx domains for %s, err: %v", s.id, event.Message.ID, hostnameTo, err)
 		}
 	}
 	event.servers <- mailServer
 }
 
-func (s *Seeker) seekRealServerName(hostname string, event *ConnectionEvent) string {
-	parts := strings.Split(hostname, ".")
-	partsLen := len(parts)
-	var lookupHostname string
-	if partsLen > 2 {
-		lookupHostname = strings.Join(parts[partsLen-3:partsLen-1], ".")
-	} else {
-		lookupHostname = strings.Join(parts, ".")
+// ищет почтовые серверы домена, prefix используется в логах
+func (s *Service) lookupMxServers(prefix string, hostnameTo string) ([]*MxServer, error) {
+	mxes, err := lookupMX(prefix, hostnameTo)
+	if err != nil {
+		return nil, err
+	}
+	mxServers := make([]*MxServer, len(mxes))
+	for i, mx := range mxes {
+		mxHostname := strings.TrimRight(mx.Host, ".")
+		logger.Debug("%s look up mx domain %s for %s", prefix, mxHostname, hostnameTo)
+		mxServer := newMxServer(mxHostname, s.Addresses)
+		// собираем IP адреса, к которым открываются соединения
+		ips, err := resolver.LookupIP(mxHostname)
+		if err == nil {
+			for _, ip := range ips {
+				// берем IPv4 и IPv6, версия ip для отправки выбирается по адресам сервера
+				logger.Debug("%s look up ip %s for %s", prefix, ip.String(), mxHostname)
+				// избавляемся от повторяющихся IP адресов
+				if !mxServer.hasIP(ip) {
+					mxServer.ips = append(mxServer.ips, ip)
+				}
+			}
+		} else {
+			logger.Warn("%s can't look up ips for mx %s", prefix, mxHostname)
+		}
+		mxServers[i] = mxServer
 	}
-	mxes, err := net.LookupMX(lookupHostname)
-	if err == nil && len(mxes) > 0 {
-		if strings.Contains(mxes[0].Host, lookupHostname) {
-			return hostname
+	s.TLSPolicy.apply(prefix, hostnameTo, mxServers)
+	return mxServers, nil
+}
+
+// ищет MX записи домена
+// если у домена нет MX записей, но есть A или AAAA записи, почтовым сервером считается сам домен, RFC 5321 5.1
+// если домен опубликовал единственную MX запись ".", домен не принимает почту, RFC 7505
+func lookupMX(prefix string, hostnameTo string) ([]*net.MX, error) {
+	mxes, err := resolver.LookupMX(hostnameTo)
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound || err == nil && len(mxes) == 0 {
+		_, ipErr := resolver.LookupIP(hostnameTo)
+		if ipErr == nil {
+			logger.Debug("%s domain %s has no mx, use implicit mx", prefix, hostnameTo)
+			return []*net.MX{{Host: hostnameTo}}, nil
 		}
-		return s.seekRealServerName(mxes[0].Host, event)
+		if err == nil {
+			err = ipErr
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(mxes) == 1 && strings.TrimRight(mxes[0].Host, ".") == "" {
+		return nil, errNullMX
 	}
-	logger.Warn("seeker#%d-%d can't look up real mx domains for %s, err: %v", s.id, event.Message.ID, lookupHostname, err)
-	return hostname
+	// серверы перебираются в порядке приоритета, не все резолверы сортируют записи сами
+	sort.SliceStable(mxes, func(i, j int) bool {
+		return mxes[i].Pref < mxes[j].Pref
+	})
+	return mxes, nil
 }
@@ -0,0 +1,169 @@
+package connector
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/boreevyuri/postmanq/logger"
+)
+
+func TestMain(m *testing.M) {
+	// без запущенных писателей логов запись в лог блокирует искателя
+	logger.Inst()
+	os.Exit(m.Run())
+}
+
+// подставляет резолвер на время теста
+func stubResolver(t *testing.T, stub Resolver) {
+	previous := resolver
+	resolver = stub
+	t.Cleanup(func() { resolver = previous })
+}
+
+// создает сервис соединений с политикой TLS по умолчанию
+func newTestService(t *testing.T) *Service {
+	s := &Service{Addresses: []string{"192.0.2.1"}}
+	if err := s.TLSPolicy.init(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestLookupMX(t *testing.T) {
+	stub := &StubResolver{
+		MX: map[string][]*net.MX{
+			"example.com": {
+				{Host: "mx2.example.com.", Pref: 20},
+				{Host: "mx1.example.com.", Pref: 10},
+				{Host: "backup.example.com.", Pref: 20},
+			},
+			"null.example.com":  {{Host: ".", Pref: 0}},
+			"empty.example.com": {},
+		},
+		IP: map[string][]net.IP{
+			"implicit.example.com": {net.ParseIP("192.0.2.10")},
+			"empty.example.com":    {net.ParseIP("192.0.2.11")},
+		},
+	}
+	cases := []struct {
+		name     string
+		hostname string
+		hosts    []string
+		err      error
+	}{
+		{"mx sorted by preference", "example.com", []string{"mx1.example.com.", "mx2.example.com.", "backup.example.com."}, nil},
+		{"implicit mx", "implicit.example.com", []string{"implicit.example.com"}, nil},
+		{"implicit mx for empty answer", "empty.example.com", []string{"empty.example.com"}, nil},
+		{"null mx", "null.example.com", nil, errNullMX},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			stubResolver(t, stub)
+			mxes, err := lookupMX("test", c.hostname)
+			if err != c.err {
+				t.Fatalf("lookupMX(%s) error = %v, want %v", c.hostname, err, c.err)
+			}
+			if len(mxes) != len(c.hosts) {
+				t.Fatalf("lookupMX(%s) = %d mx, want %d", c.hostname, len(mxes), len(c.hosts))
+			}
+			for i, mx := range mxes {
+				if mx.Host != c.hosts[i] {
+					t.Errorf("mx #%d = %s, want %s", i, mx.Host, c.hosts[i])
+				}
+			}
+		})
+	}
+
+	t.Run("domain doesn't exist", func(t *testing.T) {
+		stubResolver(t, stub)
+		_, err := lookupMX("test", "unknown.example.com")
+		if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+			t.Errorf("lookupMX() error = %v, want not found", err)
+		}
+	})
+}
+
+func TestLookupMxServers(t *testing.T) {
+	cases := []struct {
+		name string
+		ips  []net.IP
+	}{
+		{"with ips", []net.IP{net.ParseIP("192.0.2.10")}},
+		{"without ips", nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			stub := &StubResolver{
+				MX: map[string][]*net.MX{"example.com": {{Host: "mx.example.com.", Pref: 10}}},
+				IP: map[string][]net.IP{},
+			}
+			if c.ips != nil {
+				stub.IP["mx.example.com"] = c.ips
+			}
+			stubResolver(t, stub)
+			mxServers, err := newTestService(t).lookupMxServers("test", "example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(mxServers) != 1 {
+				t.Fatalf("lookupMxServers() = %d servers, want 1", len(mxServers))
+			}
+			mxServer := mxServers[0]
+			if mxServer.hostname != "mx.example.com" {
+				t.Errorf("hostname = %s, want mx.example.com", mxServer.hostname)
+			}
+			// соединения открываются только к ip, найденным резолвером
+			if addresses := mxServer.dialAddresses("192.0.2.1"); len(addresses) != len(c.ips) {
+				t.Errorf("dial addresses = %v, want %d found ips", addresses, len(c.ips))
+			}
+			if _, ok := mxServer.queues["192.0.2.1"]; !ok {
+				t.Error("server has no client queue for source ip")
+			}
+		})
+	}
+}
+
+func TestLookupMxServersIPs(t *testing.T) {
+	stubResolver(t, &StubResolver{
+		MX: map[string][]*net.MX{
+			"example.com": {
+				{Host: "mx2.example.com.", Pref: 20},
+				{Host: "mx1.example.com.", Pref: 10},
+			},
+		},
+		IP: map[string][]net.IP{
+			"mx1.example.com": {net.ParseIP("192.0.2.10"), net.ParseIP("2001:db8::10"), net.ParseIP("192.0.2.10")},
+			"mx2.example.com": {net.ParseIP("2001:db8::20")},
+		},
+	})
+	mxServers, err := newTestService(t).lookupMxServers("test", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		hostname string
+		ips      int
+		ipv4     bool
+		ipv6     bool
+	}{
+		{"mx1.example.com", 2, true, true},
+		{"mx2.example.com", 1, false, true},
+	}
+	if len(mxServers) != len(cases) {
+		t.Fatalf("lookupMxServers() = %d servers, want %d", len(mxServers), len(cases))
+	}
+	for i, c := range cases {
+		mxServer := mxServers[i]
+		if mxServer.hostname != c.hostname {
+			t.Errorf("server #%d = %s, want %s", i, mxServer.hostname, c.hostname)
+		}
+		// повторяющиеся адреса отбрасываются
+		if len(mxServer.ips) != c.ips {
+			t.Errorf("%s has %d ips, want %d", mxServer.hostname, len(mxServer.ips), c.ips)
+		}
+		if mxServer.hasIPVersion(ipv4Version) != c.ipv4 || mxServer.hasIPVersion(ipv6Version) != c.ipv6 {
+			t.Errorf("%s ip versions = %v, %v, want %v, %v", mxServer.hostname, mxServer.hasIPVersion(ipv4Version), mxServer.hasIPVersion(ipv6Version), c.ipv4, c.ipv6)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package connector
 
 import (
 	"net"
+	"sync"
+	"time"
 
 	"github.com/boreevyuri/postmanq/common"
 )
@@ -18,6 +20,9 @@ const (
 
 	// ErrorMailServerStatus по сервису не удалось собрать информацию
 	ErrorMailServerStatus
+
+	// NullMxMailServerStatus почтовый сервис не принимает почту
+	NullMxMailServerStatus
 )
 
 // MailServer почтовый сервис
@@ -30,6 +35,15 @@ type MailServer struct {
 
 	// статус, говорящий о том, собранали ли информация о почтовом сервисе
 	status MailServerStatus
+
+	// дата, после которой серверы почтового сервиса ищутся заново
+	expiresAt time.Time
+
+	// дата последней отправки письма почтовому сервису
+	usedAt time.Time
+
+	// ошибка последнего поиска серверов почтового сервиса
+	err error
 }
 
 // MxServer почтовый сервер
@@ -37,38 +51,157 @@ type MxServer struct {
 	// доменное имя почтового сервера
 	hostname string
 
+	// порт почтового сервера
+	port string
+
+	// сигнализирует, что соединение шифруется сразу после подключения
+	implicitTLS bool
+
+	// настройки релея, если сервер является релеем
+	relay *Relay
+
+	// путь до unix сокета LMTP сервера
+	socket string
+
+	// сигнализирует, что сервер принимает письма по LMTP
+	lmtp bool
+
 	// ip сервера
 	ips []net.IP
 
 	// клиенты сервера
 	clients []*common.SMTPClient
 
-	// А запись сервера
-	realServerName string
+	// количество неудачных попыток открыть TLS соединение подряд
+	tlsFailures int
 
-	// использоватение TLS
-	useTLS bool
+	// дата последней неудачной попытки открыть TLS соединение
+	tlsFailedAt time.Time
+
+	// ошибка последней неудачной попытки открыть TLS соединение
+	tlsError string
+
+	// семафор для состояния TLS
+	tlsMutex *sync.Mutex
+
+	// режим TLS для сервера
+	tlsMode tlsMode
+
+	// сигнализирует, что сервера нет в политике MTA-STS домена в режиме enforce
+	stsMismatch bool
+
+	// подписанные DNSSEC TLSA записи сервера
+	tlsa []*TLSA
+
+	// ошибка поиска TLSA записей сервера
+	tlsaError error
+
+	// семафор для политики TLS, политика общего сервера меняется при повторном поиске серверов почтового сервиса
+	policyMutex *sync.RWMutex
 
 	// очередь клиентов
 	queues map[string]*common.LimitedQueue
 }
 
-// создает новый почтовый сервер
-func newMxServer(hostname string) *MxServer {
+// создает новый почтовый сервер с очередями клиентов для каждого ip, с которого отправляются письма
+func newMxServer(hostname string, addresses []string) *MxServer {
 	queues := make(map[string]*common.LimitedQueue)
-	for _, address := range service.Addresses {
+	for _, address := range addresses {
 		queues[address] = common.NewLimitQueue()
 	}
 
 	return &MxServer{
-		hostname: hostname,
-		ips:      make([]net.IP, 0),
-		useTLS:   true,
-		queues:   queues,
+		hostname:    hostname,
+		port:        "25",
+		ips:         make([]net.IP, 0),
+		queues:      queues,
+		tlsMutex:    new(sync.Mutex),
+		policyMutex: new(sync.RWMutex),
 	}
 }
 
-// запрещает использовать TLS соединения
-func (m *MxServer) dontUseTLS() {
-	m.useTLS = false
+// сигнализирует, что ip уже найден для сервера
+func (m *MxServer) hasIP(ip net.IP) bool {
+	for _, existsIP := range m.ips {
+		if existsIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// копирует политику TLS из найденного заново сервера
+func (m *MxServer) setPolicy(other *MxServer) {
+	mode, stsMismatch, tlsa := other.policy()
+	tlsaError := other.daneError()
+	m.policyMutex.Lock()
+	m.tlsMode = mode
+	m.stsMismatch = stsMismatch
+	m.tlsa = tlsa
+	m.tlsaError = tlsaError
+	m.policyMutex.Unlock()
+}
+
+// отдает режим TLS, несоответствие политике MTA-STS и TLSA записи сервера
+func (m *MxServer) policy() (tlsMode, bool, []*TLSA) {
+	m.policyMutex.RLock()
+	defer m.policyMutex.RUnlock()
+	return m.tlsMode, m.stsMismatch, m.tlsa
+}
+
+// отдает ошибку поиска TLSA записей сервера
+func (m *MxServer) daneError() error {
+	m.policyMutex.RLock()
+	defer m.policyMutex.RUnlock()
+	return m.tlsaError
+}
+
+// сигнализирует, что можно попытаться открыть TLS соединение
+// после неудачной попытки TLS не используется, пока не пройдет время ожидания из настроек
+func (m *MxServer) canTryTLS() bool {
+	m.tlsMutex.Lock()
+	defer m.tlsMutex.Unlock()
+	return m.tlsFailures == 0 || time.Since(m.tlsFailedAt) >= service.TLSPolicy.CoolOff
+}
+
+// запоминает неудачную попытку открыть TLS соединение
+func (m *MxServer) tlsFailed(err error) {
+	m.tlsMutex.Lock()
+	m.tlsFailures++
+	m.tlsFailedAt = time.Now()
+	m.tlsError = err.Error()
+	m.tlsMutex.Unlock()
+}
+
+// сбрасывает неудачные попытки открыть TLS соединение
+// возвращает true, если до этого были неудачные попытки
+func (m *MxServer) tlsSucceeded() bool {
+	m.tlsMutex.Lock()
+	defer m.tlsMutex.Unlock()
+	failed := m.tlsFailures > 0
+	m.tlsFailures = 0
+	m.tlsError = ""
+	return failed
+}
+
+// отдает состояние TLS сервера
+func (m *MxServer) tlsState(domain string) *common.MxTLSState {
+	mode, _, _ := m.policy()
+	m.tlsMutex.Lock()
+	defer m.tlsMutex.Unlock()
+	state := &common.MxTLSState{
+		Domain:       domain,
+		Hostname:     m.hostname,
+		Mode:         mode.String(),
+		Verification: m.verification(),
+		Failures:     m.tlsFailures,
+		Error:        m.tlsError,
+	}
+	if m.tlsFailures > 0 {
+		failedAt := m.tlsFailedAt
+		retryAt := failedAt.Add(service.TLSPolicy.CoolOff)
+		state.FailedAt = &failedAt
+		state.RetryAt = &retryAt
+	}
+	return state
 }
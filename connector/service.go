@@ -2,14 +2,18 @@ package connector
 
 import (
 	"crypto/tls"
-	"crypto/x509"
-	"io/ioutil"
+	"time"
 
 	"github.com/boreevyuri/postmanq/common"
 	"github.com/boreevyuri/postmanq/logger"
 	yaml "gopkg.in/yaml.v2"
 )
 
+const (
+	// время ожидания ответа на команду QUIT при остановке приложения
+	quitTimeout = 5 * time.Second
+)
+
 var (
 	// сервис создания соединения
 	service *Service
@@ -47,19 +51,33 @@ type Service struct {
 	// путь до файла с сертификатом
 	CertFilename string `yaml:"certificate"`
 
-	// ip с которых будем рассылать письма
+	// ip с которых будем рассылать письма, IPv4 и IPv6
 	Addresses []string `yaml:"ips"`
 
+	// предпочтительная версия IP для доменов получателей
+	IPPreference IPPreference `yaml:"ipPreference"`
+
 	Domain string `yaml:"domain"`
 
+	// настройки поиска почтовых серверов
+	DNS DNSConfig `yaml:"dns"`
+
+	// политика использования TLS для доменов получателей
+	TLSPolicy TLSPolicy `yaml:"tlsPolicy"`
+
+	// релей, через который отправляются все письма
+	Relay Relay `yaml:"relay"`
+
+	// способы доставки писем по доменам получателей
+	Transports Transports `yaml:"transports"`
+
 	// количество ip
 	addressesLen int
 
-	pool *x509.CertPool
+	// ip, разделенные по версиям
+	addresses map[ipVersion][]string
 
 	certs []tls.Certificate
-
-	config *tls.Config
 }
 
 // Inst создает новый сервис соединений
@@ -74,31 +92,42 @@ func Inst() *Service {
 func (s *Service) OnInit(event *common.ApplicationEvent) {
 	err := yaml.Unmarshal(event.Data, s)
 	if err == nil {
-		// Load client cert
+		// сертификат предъявляется почтовому сервису, если он его запросит
 		cert, err := tls.LoadX509KeyPair(s.CertFilename, s.PrivateKeyFilename)
 		if err != nil {
 			logger.FailExit("connection service can't load cert from %s and %s, error - %v", s.CertFilename, s.PrivateKeyFilename, err)
 		}
-
-		// Load CA cert
-		caCert, err := ioutil.ReadFile(s.CertFilename)
-		if err != nil {
-			logger.FailExit("connection service can't read cert %s, error - %v", s.CertFilename, err)
-		}
-		s.pool = x509.NewCertPool()
-		s.pool.AppendCertsFromPEM(caCert)
 		s.certs = []tls.Certificate{cert}
 
 		s.addressesLen = len(s.Addresses)
 		if s.addressesLen == 0 {
 			logger.FailExit("ips should be defined")
 		}
+		err = s.initAddresses()
+		if err != nil {
+			logger.FailExit("connection service can't init ips, error - %v", err)
+		}
 		if s.Domain == common.InvalidInputString {
 			logger.FailExit("domain should be defined")
 		}
 		if s.ConnectorsCount == 0 {
 			s.ConnectorsCount = common.DefaultWorkersCount
 		}
+		s.DNS.init()
+		resolver = newNetResolver(&s.DNS)
+		err = s.TLSPolicy.init()
+		if err != nil {
+			logger.FailExit("connection service can't init tls policy, error - %v", err)
+		}
+		httpClient = newHTTPClient(s.TLSPolicy.MTASTS.Timeout)
+		err = s.Relay.init()
+		if err != nil {
+			logger.FailExit("connection service can't init relay, error - %v", err)
+		}
+		err = s.Transports.init()
+		if err != nil {
+			logger.FailExit("connection service can't init transports, error - %v", err)
+		}
 	} else {
 		logger.FailExit("connection service can't unmarshal config, error - %v", err)
 	}
@@ -106,6 +135,10 @@ func (s *Service) OnInit(event *common.ApplicationEvent) {
 
 // OnRun запускает горутины
 func (s *Service) OnRun() {
+	go refreshMailServers()
+	if len(s.Transports.File) > 0 {
+		go s.Transports.watch()
+	}
 	for i := 0; i < s.ConnectorsCount; i++ {
 		id := i + 1
 		go newPreparer(id)
@@ -120,20 +153,42 @@ func (s *Service) Events() chan *common.SendEvent {
 }
 
 // OnFinish завершает работу сервиса соединений
+// к этому моменту все письма уже отправлены, поэтому клиенты лежат в очередях и их можно отключить
 func (s *Service) OnFinish() {
-	close(events)
+	seekerMutex.Lock()
+	defer seekerMutex.Unlock()
+	for _, mailServer := range mailServers {
+		for _, mxServer := range mailServer.mxServers {
+			mxServer.quitClients()
+		}
+	}
+	if s.Relay.isEnabled() {
+		for _, mxServer := range s.Relay.server.mxServers {
+			mxServer.quitClients()
+		}
+	}
+	s.Transports.quitClients()
 }
 
-func (s *Service) getConf(hostname string) *tls.Config {
+// создает настройки TLS соединения к почтовому серверу
+// сертификат сервера проверяется только в режиме required, потому что при оппортунистическом шифровании
+// шифрованное соединение с непроверенным сертификатом все равно лучше открытого
+// сертификат проверяется по имени из MX записи, а не по PTR записи, которую может подменить владелец ip
+// если у сервера есть TLSA записи, сертификат проверяется только по ним
+func (s *Service) getConf(mxServer *MxServer) *tls.Config {
+	mode, _, tlsa := mxServer.policy()
 	conf := &tls.Config{
-		ServerName:             hostname,
-		ClientAuth:             tls.RequireAnyClientCert,
+		ServerName:             mxServer.hostname,
+		InsecureSkipVerify:     mode != tlsRequiredMode,
 		CipherSuites:           cipherSuites,
 		MinVersion:             tls.VersionTLS12,
 		SessionTicketsDisabled: true,
-		ClientCAs:              s.pool,
 		Certificates:           s.certs,
 	}
+	if len(tlsa) > 0 {
+		conf.InsecureSkipVerify = true
+		conf.VerifyPeerCertificate = mxServer.verifyDANE
+	}
 	return conf
 }
 
@@ -150,6 +205,6 @@ type ConnectionEvent struct {
 	// идентификатор заготовщика запросившего поиск информации о почтовом сервисе
 	connectorID int
 
-	// адрес, с которого будет отправлено письмо
+	// адрес, с которого будет отправлено письмо текущему серверу
 	address string
 }
@@ -0,0 +1,318 @@
+package connector
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boreevyuri/postmanq/common"
+	"github.com/boreevyuri/postmanq/logger"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	// период проверки изменений файла транспортов по умолчанию
+	defaultTransportsReload = 10 * time.Second
+)
+
+// способ доставки писем
+type transportKind int
+
+const (
+	// письма отправляются почтовым серверам из MX записей домена
+	directTransport transportKind = iota
+
+	// письма отправляются релею
+	relayTransport
+
+	// письма отправляются LMTP серверу
+	lmtpTransport
+
+	// письма сохраняются в maildir
+	maildirTransport
+
+	// письма удаляются
+	discardTransport
+)
+
+var (
+	// способы доставки по названиям из настроек
+	transportKinds = map[string]transportKind{
+		"direct":  directTransport,
+		"relay":   relayTransport,
+		"lmtp":    lmtpTransport,
+		"maildir": maildirTransport,
+		"discard": discardTransport,
+	}
+)
+
+// TransportRule правило выбора способа доставки для домена получателя
+type TransportRule struct {
+	// домен получателя, домен с точкой в начале, например .example.com, подходит для всех поддоменов
+	Domain string `yaml:"domain"`
+
+	// регулярное выражение для домена получателя
+	Regex string `yaml:"regex"`
+
+	// способ доставки - direct, relay, lmtp, maildir или discard
+	Transport string `yaml:"transport"`
+
+	// релей, если не указан, используется релей из настройки relay
+	Relay Relay `yaml:"relay"`
+
+	// адрес LMTP сервера в виде host:port или unix:/путь/до/сокета
+	LMTP string `yaml:"lmtp"`
+
+	// каталог, в котором создаются maildir получателей в виде <домен>/<ящик>
+	Maildir string `yaml:"maildir"`
+
+	// способ доставки
+	kind transportKind
+
+	// регулярное выражение для домена
+	regex *regexp.Regexp
+
+	// почтовый сервис релея или LMTP сервера
+	server *MailServer
+
+	// доставка без SMTP
+	delivery common.LocalDelivery
+}
+
+// Transports карта способов доставки писем по доменам получателей
+// правила проверяются по порядку, сначала правила из файла, затем из настроек,
+// если ни одно правило не подошло, письмо отправляется релею из настройки relay или почтовым серверам домена
+type Transports struct {
+	// правила
+	Rules []*TransportRule `yaml:"rules"`
+
+	// файл с правилами, файл перечитывается без перезапуска
+	File string `yaml:"file"`
+
+	// период проверки изменений файла
+	Reload time.Duration `yaml:"reload"`
+
+	// правила из файла
+	fileRules []*TransportRule
+
+	// дата изменения загруженного файла
+	modTime time.Time
+
+	// почтовые сервисы релеев и LMTP серверов, в качестве ключа используются их настройки без пароля
+	servers map[string]*MailServer
+
+	// почтовые сервисы релеев, замененные из-за смены пароля
+	replaced []*MailServer
+
+	// семафор для правил из файла и почтовых сервисов релеев и LMTP серверов
+	mutex *sync.RWMutex
+}
+
+// проверяет правила и загружает файл с правилами
+func (t *Transports) init() error {
+	t.servers = make(map[string]*MailServer)
+	t.mutex = new(sync.RWMutex)
+	if t.Reload == 0 {
+		t.Reload = defaultTransportsReload
+	}
+	for i, rule := range t.Rules {
+		err := t.initRule(rule)
+		if err != nil {
+			return fmt.Errorf("rule #%d - %v", i+1, err)
+		}
+	}
+	if len(t.File) > 0 {
+		_, err := t.load()
+		return err
+	}
+	return nil
+}
+
+// проверяет правило и создает для него почтовый сервис или доставку
+func (t *Transports) initRule(rule *TransportRule) error {
+	if len(rule.Domain) > 0 == (len(rule.Regex) > 0) {
+		return errors.New("either domain or regex should be defined")
+	}
+	rule.Domain = strings.ToLower(rule.Domain)
+	if len(rule.Regex) > 0 {
+		regex, err := regexp.Compile(rule.Regex)
+		if err != nil {
+			return err
+		}
+		rule.regex = regex
+	}
+	kind, ok := transportKinds[rule.Transport]
+	if !ok {
+		return fmt.Errorf("unknown transport %s", rule.Transport)
+	}
+	rule.kind = kind
+
+	switch kind {
+	case relayTransport:
+		if !rule.Relay.isEnabled() {
+			if !service.Relay.isEnabled() {
+				return errors.New("relay host should be defined")
+			}
+			rule.server = service.Relay.server
+			return nil
+		}
+		// пароль не входит в ключ, чтобы не хранить его в открытом виде вне настроек релея
+		key := fmt.Sprintf("relay %s %s %s %s", rule.Relay.Host, rule.Relay.TLS, rule.Relay.Username, rule.Relay.Auth)
+		rule.server = t.servers[key]
+		// если пароль изменился, создается новый почтовый сервис, а старый закрывается, когда перестает использоваться
+		if rule.server == nil || rule.server.mxServers[0].relay.Password != rule.Relay.Password {
+			err := rule.Relay.init()
+			if err != nil {
+				return err
+			}
+			if rule.server != nil {
+				t.replaced = append(t.replaced, rule.server)
+			}
+			rule.server = rule.Relay.server
+			t.servers[key] = rule.server
+		}
+	case lmtpTransport:
+		if len(rule.LMTP) == 0 {
+			return errors.New("lmtp address should be defined")
+		}
+		key := "lmtp " + rule.LMTP
+		rule.server = t.servers[key]
+		if rule.server == nil {
+			server, err := newLMTPServer(rule.LMTP)
+			if err != nil {
+				return err
+			}
+			rule.server = server
+			t.servers[key] = rule.server
+		}
+	case maildirTransport:
+		if len(rule.Maildir) == 0 {
+			return errors.New("maildir should be defined")
+		}
+		rule.delivery = &maildirDelivery{dir: rule.Maildir}
+	case discardTransport:
+		rule.delivery = new(discardDelivery)
+	}
+	return nil
+}
+
+// сигнализирует, что правило подходит для домена
+func (r *TransportRule) matches(hostname string) bool {
+	if r.regex != nil {
+		return r.regex.MatchString(hostname)
+	}
+	if strings.HasPrefix(r.Domain, ".") {
+		return strings.HasSuffix(hostname, r.Domain)
+	}
+	return hostname == r.Domain
+}
+
+// ищет правило для домена получателя, возвращает nil, если ни одно правило не подошло
+func (t *Transports) route(hostname string) *TransportRule {
+	hostname = strings.ToLower(hostname)
+	t.mutex.RLock()
+	fileRules := t.fileRules
+	t.mutex.RUnlock()
+	for _, rules := range [][]*TransportRule{fileRules, t.Rules} {
+		for _, rule := range rules {
+			if rule.matches(hostname) {
+				return rule
+			}
+		}
+	}
+	return nil
+}
+
+// периодически перечитывает измененный файл с правилами
+func (t *Transports) watch() {
+	for range time.Tick(t.Reload) {
+		changed, err := t.load()
+		if err != nil {
+			logger.Warn("connection service can't load transports from %s, error - %v", t.File, err)
+		} else if changed {
+			logger.Info("connection service reload transports from %s", t.File)
+		}
+	}
+}
+
+// загружает правила из файла, если файл изменился
+// если файл не удалось разобрать, продолжают использоваться загруженные ранее правила
+// соединения к релеям и LMTP серверам, которые больше не используются, закрываются
+func (t *Transports) load() (bool, error) {
+	info, err := os.Stat(t.File)
+	if err != nil {
+		return false, err
+	}
+	if info.ModTime().Equal(t.modTime) {
+		return false, nil
+	}
+	data, err := ioutil.ReadFile(t.File)
+	if err != nil {
+		return false, err
+	}
+	// запоминаем дату изменения и для ошибочного файла, чтобы не выводить ошибку при каждой проверке
+	t.modTime = info.ModTime()
+	var rules []*TransportRule
+	err = yaml.Unmarshal(data, &rules)
+	if err != nil {
+		return false, err
+	}
+	// почтовые сервисы меняются под семафором, потому что при остановке сервиса их соединения закрывает quitClients
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for i, rule := range rules {
+		err = t.initRule(rule)
+		if err != nil {
+			return false, fmt.Errorf("rule #%d - %v", i+1, err)
+		}
+	}
+	t.fileRules = rules
+
+	used := make(map[*MailServer]bool)
+	for _, rules := range [][]*TransportRule{rules, t.Rules} {
+		for _, rule := range rules {
+			used[rule.server] = true
+		}
+	}
+	for key, server := range t.servers {
+		if !used[server] {
+			delete(t.servers, key)
+			for _, mxServer := range server.mxServers {
+				mxServer.quitClients()
+			}
+		}
+	}
+	replaced := t.replaced[:0]
+	for _, server := range t.replaced {
+		if used[server] {
+			replaced = append(replaced, server)
+			continue
+		}
+		for _, mxServer := range server.mxServers {
+			mxServer.quitClients()
+		}
+	}
+	t.replaced = replaced
+	return true, nil
+}
+
+// закрывает соединения к релеям и LMTP серверам
+func (t *Transports) quitClients() {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	for _, server := range t.servers {
+		for _, mxServer := range server.mxServers {
+			mxServer.quitClients()
+		}
+	}
+	for _, server := range t.replaced {
+		for _, mxServer := range server.mxServers {
+			mxServer.quitClients()
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package connector
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransportsRelayServers(t *testing.T) {
+	previous := service
+	service = newTestService(t)
+	t.Cleanup(func() { service = previous })
+
+	transports := &Transports{}
+	if err := transports.init(); err != nil {
+		t.Fatal(err)
+	}
+	newRule := func(domain string, password string) *TransportRule {
+		rule := &TransportRule{
+			Domain:    domain,
+			Transport: "relay",
+			Relay:     Relay{Host: "relay.example.com:587", Username: "user", Password: password},
+		}
+		if err := transports.initRule(rule); err != nil {
+			t.Fatal(err)
+		}
+		return rule
+	}
+
+	first := newRule("example.com", "secret")
+	second := newRule("example.org", "secret")
+	if first.server != second.server {
+		t.Error("rules with the same relay don't share mail server")
+	}
+	for key := range transports.servers {
+		if strings.Contains(key, "secret") {
+			t.Errorf("server key %q contains password", key)
+		}
+	}
+
+	// после смены пароля создается новый почтовый сервис, а старый ждет, пока перестанет использоваться
+	changed := newRule("example.net", "changed")
+	if changed.server == first.server {
+		t.Fatal("relay with changed password uses mail server with old password")
+	}
+	if password := changed.server.mxServers[0].relay.Password; password != "changed" {
+		t.Errorf("relay password = %s, want changed", password)
+	}
+	if len(transports.replaced) != 1 || transports.replaced[0] != first.server {
+		t.Errorf("replaced servers = %v, want server with old password", transports.replaced)
+	}
+}
+
+func TestTransportsReloadWhileQuit(t *testing.T) {
+	previous := service
+	service = newTestService(t)
+	t.Cleanup(func() { service = previous })
+	dir, err := ioutil.TempDir("", "postmanq-transports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	transports := &Transports{File: filepath.Join(dir, "transports.yaml")}
+	writeRules := func(i int) {
+		rules := fmt.Sprintf("- domain: example.com\n  transport: lmtp\n  lmtp: 127.0.0.1:%d\n", 2400+i)
+		if err := ioutil.WriteFile(transports.File, []byte(rules), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// дата изменения меняется при каждой записи, даже если файл пишется чаще, чем обновляется дата
+		modTime := time.Now().Add(time.Duration(i) * time.Second)
+		if err := os.Chtimes(transports.File, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeRules(0)
+	if err = transports.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	// соединения закрываются при остановке сервиса, пока файл перечитывается
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			transports.quitClients()
+		}
+	}()
+	for i := 1; i <= 20; i++ {
+		writeRules(i)
+		if changed, err := transports.load(); err != nil || !changed {
+			t.Fatalf("load() = %v, %v, want rules reloaded", changed, err)
+		}
+	}
+	<-done
+	if len(transports.servers) != 1 || transports.servers["lmtp 127.0.0.1:2420"] == nil {
+		t.Errorf("servers = %v, want only server of last rules", transports.servers)
+	}
+}
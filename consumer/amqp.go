@@ -0,0 +1,211 @@
+package consumer
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/streadway/amqp"
+)
+
+// подключение к AMQP-серверу
+type amqpConnection struct {
+	connect *amqp.Connection
+}
+
+// подключается к AMQP-серверу
+func dialAMQP(uri string) (Connection, error) {
+	connect, err := amqp.Dial(uri)
+	if err != nil {
+		return nil, err
+	}
+	return &amqpConnection{connect}, nil
+}
+
+// Channel открывает канал в режиме подтверждений
+// сообщение считается опубликованным только после того, как сервер подтвердит публикацию
+func (c *amqpConnection) Channel() (Channel, error) {
+	channel, err := c.connect.Channel()
+	if err != nil {
+		return nil, err
+	}
+	err = channel.Confirm(false)
+	if err != nil {
+		channel.Close()
+		return nil, err
+	}
+	return &amqpChannel{
+		channel:  channel,
+		confirms: channel.NotifyPublish(make(chan amqp.Confirmation, 1)),
+	}, nil
+}
+
+// NotifyClose отдает канал с ошибкой потери подключения
+func (c *amqpConnection) NotifyClose() <-chan error {
+	closeErrors := make(chan error, 1)
+	amqpErrors := c.connect.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		if err, ok := <-amqpErrors; ok {
+			closeErrors <- err
+		}
+		close(closeErrors)
+	}()
+	return closeErrors
+}
+
+// Close закрывает подключение
+func (c *amqpConnection) Close() error {
+	return c.connect.Close()
+}
+
+// канал подключения к AMQP-серверу
+type amqpChannel struct {
+	channel *amqp.Channel
+
+	// подтверждения публикаций
+	confirms chan amqp.Confirmation
+}
+
+// Declare объявляет точку обмена и очередь и связывает их
+func (c *amqpChannel) Declare(binding *Binding) error {
+	err := c.DeclareExchange(binding)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.channel.QueueDeclare(
+		binding.Queue,                 // name of the queue
+		true,                          // durable
+		false,                         // delete when usused
+		false,                         // exclusive
+		false,                         // noWait
+		amqp.Table(binding.QueueArgs), // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("can't declare queue %s, error - %v", binding.Queue, err)
+	}
+
+	err = c.channel.QueueBind(
+		binding.Queue,    // name of the queue
+		binding.Routing,  // bindingKey
+		binding.Exchange, // sourceExchange
+		false,            // noWait
+		nil,              // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("can't bind queue %s to exchange %s, error - %v", binding.Queue, binding.Exchange, err)
+	}
+	return nil
+}
+
+// DeclareExchange объявляет точку обмена
+func (c *amqpChannel) DeclareExchange(binding *Binding) error {
+	err := c.channel.ExchangeDeclare(
+		binding.Exchange,                 // name of the exchange
+		string(binding.Type),             // type
+		true,                             // durable
+		false,                            // delete when complete
+		false,                            // internal
+		false,                            // noWait
+		amqp.Table(binding.ExchangeArgs), // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("can't declare exchange %s, error - %v", binding.Exchange, err)
+	}
+	return nil
+}
+
+// Consume подписывается на сообщения из очереди
+func (c *amqpChannel) Consume(queue, tag string, prefetchCount int) (<-chan Delivery, error) {
+	// выбираем из очереди сообщения с запасом
+	// это нужно для того, чтобы после отправки письма новое уже было готово к отправке
+	// в тоже время нельзя выбираеть все сообщения из очереди разом, т.к. можно упереться в память
+	err := c.channel.Qos(prefetchCount, 0, false)
+	if err != nil {
+		return nil, err
+	}
+	amqpDeliveries, err := c.channel.Consume(
+		queue, // name
+		tag,   // consumerTag,
+		false, // noAck
+		false, // exclusive
+		false, // noLocal
+		false, // noWait
+		nil,   // arguments
+	)
+	if err != nil {
+		return nil, err
+	}
+	deliveries := make(chan Delivery)
+	go func() {
+		for delivery := range amqpDeliveries {
+			deliveries <- &amqpDelivery{delivery}
+		}
+		close(deliveries)
+	}()
+	return deliveries, nil
+}
+
+// Cancel отменяет подписку
+func (c *amqpChannel) Cancel(tag string) error {
+	return c.channel.Cancel(tag, false)
+}
+
+// Get забирает одно сообщение из очереди
+func (c *amqpChannel) Get(queue string) (Delivery, bool, error) {
+	delivery, ok, err := c.channel.Get(queue, false)
+	if !ok || err != nil {
+		return nil, false, err
+	}
+	return &amqpDelivery{delivery}, true, nil
+}
+
+// Publish кладет сообщение в точку обмена
+// письмо сохраняется сервером на диск, поэтому не теряется при его перезапуске
+func (c *amqpChannel) Publish(exchange, key string, body []byte) error {
+	err := c.channel.Publish(
+		exchange,
+		key,
+		false,
+		false,
+		amqp.Publishing{
+			ContentType:  "text/plain",
+			Body:         body,
+			DeliveryMode: amqp.Persistent,
+		},
+	)
+	if err == nil {
+		confirm, ok := <-c.confirms
+		if !ok {
+			err = errors.New("channel closed before publishing was confirmed")
+		} else if !confirm.Ack {
+			err = fmt.Errorf("broker didn't confirm publishing#%d", confirm.DeliveryTag)
+		}
+	}
+	return err
+}
+
+// Close возвращает в очередь сообщения, которые были выбраны с запасом, но еще не обработаны, и закрывает канал
+func (c *amqpChannel) Close() error {
+	c.channel.Nack(0, true, true)
+	return c.channel.Close()
+}
+
+// сообщение из очереди AMQP-сервера
+type amqpDelivery struct {
+	delivery amqp.Delivery
+}
+
+// Body тело сообщения
+func (d *amqpDelivery) Body() []byte {
+	return d.delivery.Body
+}
+
+// Ack подтверждает только это сообщение, остальные полученные сообщения еще не обработаны
+func (d *amqpDelivery) Ack() error {
+	return d.delivery.Ack(false)
+}
+
+// Nack отклоняет только это сообщение
+func (d *amqpDelivery) Nack(requeue bool) error {
+	return d.delivery.Nack(false, requeue)
+}
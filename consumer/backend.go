@@ -0,0 +1,65 @@
+package consumer
+
+import (
+	"strings"
+)
+
+// Connection подключение к брокеру сообщений
+// получатели и связки работают с брокером только через это подключение и его каналы,
+// поэтому брокер можно заменить, например, на файловую очередь
+type Connection interface {
+	// Channel открывает канал
+	Channel() (Channel, error)
+
+	// NotifyClose отдает канал, в который придет ошибка при потере подключения
+	// при закрытии подключения самим сервисом канал закрывается без ошибки
+	NotifyClose() <-chan error
+
+	// Close закрывает подключение
+	Close() error
+}
+
+// Channel канал подключения к брокеру
+type Channel interface {
+	// Declare объявляет точку обмена и очередь связки и связывает их
+	Declare(binding *Binding) error
+
+	// DeclareExchange объявляет точку обмена связки
+	DeclareExchange(binding *Binding) error
+
+	// Consume подписывается на сообщения из очереди
+	Consume(queue, tag string, prefetchCount int) (<-chan Delivery, error)
+
+	// Cancel отменяет подписку, после этого канал сообщений закрывается
+	Cancel(tag string) error
+
+	// Get забирает одно сообщение из очереди, если очередь пуста, возвращается false
+	Get(queue string) (Delivery, bool, error)
+
+	// Publish кладет сообщение в точку обмена и дожидается подтверждения от брокера
+	// сообщение должно сохраниться при перезапуске брокера
+	Publish(exchange, key string, body []byte) error
+
+	// Close закрывает канал, неподтвержденные сообщения возвращаются в очередь
+	Close() error
+}
+
+// Delivery сообщение из очереди
+type Delivery interface {
+	// Body тело сообщения
+	Body() []byte
+
+	// Ack подтверждает обработку сообщения, после этого сообщение удаляется из очереди
+	Ack() error
+
+	// Nack отклоняет сообщение, если requeue равен true, сообщение возвращается в очередь
+	Nack(requeue bool) error
+}
+
+// подключается к брокеру, брокер выбирается по схеме адреса
+var dial = func(uri string) (Connection, error) {
+	if strings.HasPrefix(uri, spoolScheme+"://") {
+		return dialSpool(uri)
+	}
+	return dialAMQP(uri)
+}
@@ -2,11 +2,10 @@ package consumer
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/boreevyuri/postmanq/common"
-	"github.com/boreevyuri/postmanq/logger"
-	"github.com/streadway/amqp"
 )
 
 // ExchangeType тип точки обмена
@@ -36,6 +35,9 @@ const (
 
 	// UnknownFailureBindingType неизвестная проблема
 	UnknownFailureBindingType
+
+	// ExpiredFailureBindingType письмо устарело и не будет отправлено
+	ExpiredFailureBindingType
 )
 
 var (
@@ -44,51 +46,44 @@ var (
 		TechnicalFailureBindingType:  "%s.failure.technical",
 		ConnectionFailureBindingType: "%s.failure.connection",
 		UnknownFailureBindingType:    "%s.failure.unknown",
+		ExpiredFailureBindingType:    "%s.failure.expired",
+	}
+
+	// названия причин неотправки письма, используются в событиях с результатом отправки
+	failureBindingTypeNames = map[FailureBindingType]string{
+		RecipientFailureBindingType:  "recipient",
+		TechnicalFailureBindingType:  "technical",
+		ConnectionFailureBindingType: "connection",
+		UnknownFailureBindingType:    "unknown",
+		ExpiredFailureBindingType:    "expired",
 	}
 
-	// отложенные очереди вообще
-	// письмо отправляется повторно при возниковении ошибки во время отправки
-	delayedBindings = map[common.DelayedBindingType]*Binding{
-		common.SecondDelayedBinding:        newDelayedBinding("%s.dlx.second", time.Second),
-		common.ThirtySecondDelayedBinding:  newDelayedBinding("%s.dlx.thirty.second", time.Second*30),
-		common.MinuteDelayedBinding:        newDelayedBinding("%s.dlx.minute", time.Minute),
-		common.FiveMinutesDelayedBinding:   newDelayedBinding("%s.dlx.five.minutes", time.Minute*5),
-		common.TenMinutesDelayedBinding:    newDelayedBinding("%s.dlx.ten.minutes", time.Minute*10),
-		common.TwentyMinutesDelayedBinding: newDelayedBinding("%s.dlx.twenty.minutes", time.Minute*20),
-		common.ThirtyMinutesDelayedBinding: newDelayedBinding("%s.dlx.thirty.minutes", time.Minute*30),
-		common.FortyMinutesDelayedBinding:  newDelayedBinding("%s.dlx.forty.minutes", time.Minute*40),
-		common.FiftyMinutesDelayedBinding:  newDelayedBinding("%s.dlx.fifty.minutes", time.Minute*50),
-		common.HourDelayedBinding:          newDelayedBinding("%s.dlx.hour", time.Hour),
-		common.SixHoursDelayedBinding:      newDelayedBinding("%s.dlx.six.hours", time.Hour*6),
-		common.DayDelayedBinding:           newDelayedBinding("%s.dlx.day", time.Hour*24),
-		common.NotSendDelayedBinding:       newBinding("%s.not.send"),
+	// шаблоны имен отложенных очередей, оставлены прежними, чтобы не потерять письма в уже объявленных очередях
+	// для остальных пауз имя очереди строится из паузы, например postmanq.dlx.2h30m
+	delayedBindingTplNames = map[time.Duration]string{
+		time.Second:      "%s.dlx.second",
+		time.Second * 30: "%s.dlx.thirty.second",
+		time.Minute:      "%s.dlx.minute",
+		time.Minute * 5:  "%s.dlx.five.minutes",
+		time.Minute * 10: "%s.dlx.ten.minutes",
+		time.Minute * 20: "%s.dlx.twenty.minutes",
+		time.Minute * 30: "%s.dlx.thirty.minutes",
+		time.Minute * 40: "%s.dlx.forty.minutes",
+		time.Minute * 50: "%s.dlx.fifty.minutes",
+		time.Hour:        "%s.dlx.hour",
+		time.Hour * 6:    "%s.dlx.six.hours",
+		time.Hour * 24:   "%s.dlx.day",
 	}
 
+	// шаблон имени очереди для писем, попытки отправки которых исчерпаны
+	notSendBindingTplName = "%s.not.send"
+
 	// отложенные очереди для лимитов
-	limitBindings = []common.DelayedBindingType{
-		common.SecondDelayedBinding,
-		common.MinuteDelayedBinding,
-		common.HourDelayedBinding,
-		common.DayDelayedBinding,
-	}
-
-	limitBindingsLen = len(limitBindings)
-
-	// цепочка очередей, используемых для повторной отправки писем
-	// в качестве ключа используется текущий тип очереди, а в качестве значения следующий
-	bindingsChain = map[common.DelayedBindingType]common.DelayedBindingType{
-		common.UnknownDelayedBinding:       common.SecondDelayedBinding,
-		common.SecondDelayedBinding:        common.ThirtySecondDelayedBinding,
-		common.ThirtySecondDelayedBinding:  common.MinuteDelayedBinding,
-		common.MinuteDelayedBinding:        common.FiveMinutesDelayedBinding,
-		common.FiveMinutesDelayedBinding:   common.TenMinutesDelayedBinding,
-		common.TenMinutesDelayedBinding:    common.TwentyMinutesDelayedBinding,
-		common.TwentyMinutesDelayedBinding: common.ThirtyMinutesDelayedBinding,
-		common.ThirtyMinutesDelayedBinding: common.FortyMinutesDelayedBinding,
-		common.FortyMinutesDelayedBinding:  common.FiftyMinutesDelayedBinding,
-		common.FiftyMinutesDelayedBinding:  common.HourDelayedBinding,
-		common.HourDelayedBinding:          common.SixHoursDelayedBinding,
-		common.SixHoursDelayedBinding:      common.NotSendDelayedBinding,
+	limitDurations = map[common.DelayedBindingType]time.Duration{
+		common.SecondDelayedBinding: time.Second,
+		common.MinuteDelayedBinding: time.Minute,
+		common.HourDelayedBinding:   time.Hour,
+		common.DayDelayedBinding:    time.Hour * 24,
 	}
 )
 
@@ -101,13 +96,13 @@ type Binding struct {
 	Exchange string `yaml:"exchange"`
 
 	// аргументы точки обмена
-	ExchangeArgs amqp.Table
+	ExchangeArgs map[string]interface{}
 
 	// имя очереди
 	Queue string `yaml:"queue"`
 
 	// аргументы очереди
-	QueueArgs amqp.Table
+	QueueArgs map[string]interface{}
 
 	// тип точки обмена
 	Type ExchangeType `yaml:"type"`
@@ -121,29 +116,33 @@ type Binding struct {
 	// количество сообщений, получаемых одновременно
 	PrefetchCount int `yaml:"prefetchCount"`
 
-	// отложенные очереди
-	delayedBindings map[common.DelayedBindingType]*Binding
+	// имя точки обмена для событий с результатом отправки писем
+	Results string `yaml:"results"`
+
+	// расписание повторных отправок
+	Retry Retry `yaml:"retry"`
+
+	// время жизни писем, у которых не указаны expiresAt и ttl
+	TTL time.Duration `yaml:"ttl"`
+
+	// ограничение на количество получателей в одной отправке письма
+	Recipients RecipientsLimit `yaml:"recipients"`
+
+	// отложенные очереди, в качестве ключа используется пауза
+	delayedBindings map[time.Duration]*Binding
+
+	// очередь для писем, попытки отправки которых исчерпаны
+	notSendBinding *Binding
 
 	// очереди для ошибок
 	failureBindings map[FailureBindingType]*Binding
-}
 
-// создает связку обложенной точки обмена и очереди
-func newDelayedBinding(name string, duration time.Duration) *Binding {
-	binding := newBinding(name)
-	binding.QueueArgs = amqp.Table{
-		"x-message-ttl": int64(duration.Seconds()) * 1000,
-	}
-	return binding
-}
-
-// создает связку точки обмена и очереди
-func newBinding(name string) *Binding {
-	return &Binding{Name: name}
+	// точка обмена для событий с результатом отправки писем
+	resultsBinding *Binding
 }
 
 // инициализирует связку параметрами по умолчанию
-func (b *Binding) init() {
+func (b *Binding) init() error {
 	if len(b.Type) == 0 {
 		b.Type = FanoutExchangeType
 	}
@@ -158,54 +157,131 @@ func (b *Binding) init() {
 	if b.PrefetchCount == 0 {
 		b.PrefetchCount = 2
 	}
-}
 
-// объявляет точку обмена и очередь и связывает их
-func (b *Binding) declare(channel *amqp.Channel) {
-	err := channel.ExchangeDeclare(
-		b.Exchange,     // name of the exchange
-		string(b.Type), // type
-		true,           // durable
-		false,          // delete when complete
-		false,          // internal
-		false,          // noWait
-		b.ExchangeArgs, // arguments
-	)
+	b.Recipients.init()
+
+	err := b.Retry.init()
 	if err != nil {
-		logger.FailExit("consumer can't declare exchange %s, error - %v", b.Exchange, err)
+		return err
 	}
 
-	_, err = channel.QueueDeclare(
-		b.Queue,     // name of the queue
-		true,        // durable
-		false,       // delete when usused
-		false,       // exclusive
-		false,       // noWait
-		b.QueueArgs, // arguments
-	)
-	if err != nil {
-		logger.FailExit("consumer can't declare queue %s, error - %v", b.Queue, err)
+	// у каждой связки свои отложенные очереди, по одной на каждую паузу из расписания и лимитов
+	b.delayedBindings = make(map[time.Duration]*Binding)
+	durations := b.Retry.durations()
+	for _, duration := range limitDurations {
+		durations = append(durations, duration)
+	}
+	for _, duration := range durations {
+		if _, ok := b.delayedBindings[duration]; !ok {
+			b.delayedBindings[duration] = b.newDelayedBinding(duration)
+		}
+	}
+	b.notSendBinding = &Binding{
+		Exchange: fmt.Sprintf(notSendBindingTplName, b.Exchange),
+		Queue:    fmt.Sprintf(notSendBindingTplName, b.Queue),
+		Type:     b.Type,
 	}
 
-	err = channel.QueueBind(
-		b.Queue,    // name of the queue
-		b.Routing,  // bindingKey
-		b.Exchange, // sourceExchange
-		false,      // noWait
-		nil,        // arguments
-	)
-	if err != nil {
-		logger.FailExit("consumer can't bind queue %s to exchange %s, error - %v", b.Queue, b.Exchange, err)
+	b.failureBindings = make(map[FailureBindingType]*Binding)
+	for failureBindingType, tplName := range failureBindingTypeTplNames {
+		failureBinding := new(Binding)
+		failureBinding.Exchange = fmt.Sprintf(tplName, b.Exchange)
+		failureBinding.Queue = fmt.Sprintf(tplName, b.Queue)
+		failureBinding.Type = b.Type
+		b.failureBindings[failureBindingType] = failureBinding
+	}
+
+	// результаты публикуются с ключом маршрутизации, равным итогу отправки,
+	// поэтому приложение может подписаться только на нужные ему итоги
+	if len(b.Results) > 0 {
+		b.resultsBinding = &Binding{
+			Exchange: b.Results,
+			Type:     TopicExchangeType,
+		}
+	}
+	return nil
+}
+
+// создает отложенную связку, письма из которой по истечении паузы возвращаются в точку обмена связки
+func (b *Binding) newDelayedBinding(duration time.Duration) *Binding {
+	tplName, ok := delayedBindingTplNames[duration]
+	if !ok {
+		tplName = "%s.dlx." + durationName(duration)
+	}
+	return &Binding{
+		Exchange: fmt.Sprintf(tplName, b.Exchange),
+		Queue:    fmt.Sprintf(tplName, b.Queue),
+		Type:     b.Type,
+		QueueArgs: map[string]interface{}{
+			"x-message-ttl":          int64(duration / time.Millisecond),
+			"x-dead-letter-exchange": b.Exchange,
+		},
+	}
+}
+
+// отдает короткое имя паузы: 45m вместо 45m0s
+func durationName(duration time.Duration) string {
+	name := duration.String()
+	if strings.HasSuffix(name, "m0s") {
+		name = name[:len(name)-2]
+	}
+	if strings.HasSuffix(name, "h0m") {
+		name = name[:len(name)-2]
+	}
+	return name
+}
+
+// объявляет связку вместе с отложенными очередями и очередями для ошибок
+// вызывается при запуске и после каждого переподключения к серверу
+func (b *Binding) declareAll(channel Channel) error {
+	err := channel.Declare(b)
+	for _, delayedBinding := range b.delayedBindings {
+		if err == nil {
+			err = channel.Declare(delayedBinding)
+		}
+	}
+	for _, failureBinding := range b.failureBindings {
+		if err == nil {
+			err = channel.Declare(failureBinding)
+		}
+	}
+	if err == nil {
+		err = channel.Declare(b.notSendBinding)
+	}
+	if err == nil && b.resultsBinding != nil {
+		err = channel.DeclareExchange(b.resultsBinding)
+	}
+	return err
+}
+
+// ищет тип очереди для ошибок по связке
+func (b *Binding) failureBindingType(binding *Binding) (FailureBindingType, bool) {
+	for failureBindingType, failureBinding := range b.failureBindings {
+		if failureBinding == binding {
+			return failureBindingType, true
+		}
+	}
+	return UnknownFailureBindingType, false
+}
+
+// отдает паузу самой долгой отложенной очереди, не превышающую оставшееся до отправки письма время
+// если оставшееся время меньше самой короткой паузы, письмо отправляется сразу
+func (b *Binding) parkingDelay(remaining time.Duration) (time.Duration, bool) {
+	var parkingDelay time.Duration
+	for delay := range b.delayedBindings {
+		if delay <= remaining && delay > parkingDelay {
+			parkingDelay = delay
+		}
 	}
+	return parkingDelay, parkingDelay > 0
 }
 
-// объявляет отложенную точку обмена и очередь и связывает их
-func (b *Binding) declareDelayed(binding *Binding, channel *amqp.Channel) {
-	b.Exchange = fmt.Sprintf(b.Name, binding.Exchange)
-	b.Queue = fmt.Sprintf(b.Name, binding.Queue)
-	if b.QueueArgs != nil {
-		b.QueueArgs["x-dead-letter-exchange"] = binding.Exchange
+// сигнализирует, что связка является отложенной очередью
+func (b *Binding) isDelayed(binding *Binding) bool {
+	for _, delayedBinding := range b.delayedBindings {
+		if delayedBinding == binding {
+			return true
+		}
 	}
-	b.Type = binding.Type
-	b.declare(channel)
+	return false
 }
@@ -4,16 +4,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"regexp"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/boreevyuri/postmanq/common"
 	"github.com/boreevyuri/postmanq/logger"
-	"github.com/streadway/amqp"
 )
 
 var (
 	// обработчики результата отправки письма
-	resultHandlers = map[common.SendEventResult]func(*Consumer, *amqp.Channel, *common.MailMessage){
+	// обработчик возвращает очередь, в которую переложено письмо
+	resultHandlers = map[common.SendEventResult]func(*Consumer, *Publisher, *common.MailMessage) (*Binding, error){
 		common.ErrorSendEventResult:     (*Consumer).handleErrorSend,
 		common.DelaySendEventResult:     (*Consumer).handleDelaySend,
 		common.OverlimitSendEventResult: (*Consumer).handleOverlimitSend,
@@ -22,140 +24,313 @@ var (
 
 // Consumer получатель сообщений из очереди
 type Consumer struct {
-	id         int
-	connect    *amqp.Connection
-	binding    *Binding
-	deliveries <-chan amqp.Delivery
+	id      int
+	connect Connection
+	binding *Binding
+
+	// хранилище ключей идемпотентности, nil, если ключи не проверяются
+	idempotency *Idempotency
+
+	// каналы обработчиков, в качестве ключа используется тег подписчика
+	channels map[string]Channel
+
+	// семафор для соединения, каналов обработчиков и флага остановки
+	mutex *sync.Mutex
+
+	// флаг, сигнализирующий, что получатель остановлен и новые обработчики не запускаются
+	stopped bool
+
+	// работающие обработчики, используется для ожидания писем при остановке
+	group *sync.WaitGroup
 }
 
 // NewConsumer создает нового получателя
-func NewConsumer(id int, connect *amqp.Connection, binding *Binding) *Consumer {
+func NewConsumer(id int, connect Connection, binding *Binding, idempotency *Idempotency) *Consumer {
 	app := new(Consumer)
 	app.id = id
 	app.connect = connect
 	app.binding = binding
+	app.idempotency = idempotency
+	app.channels = make(map[string]Channel)
+	app.mutex = new(sync.Mutex)
+	app.group = new(sync.WaitGroup)
 	return app
 }
 
 // запускает получение сообщений из очереди в заданное количество потоков
+// обработчики учитываются до запуска горутин, поэтому остановка сервиса дождется каждого из них
 func (c *Consumer) run() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.stopped {
+		return
+	}
+	c.group.Add(c.binding.Handlers)
 	for i := 0; i < c.binding.Handlers; i++ {
 		go c.consume(i)
 	}
 }
 
+// устанавливает новое соединение после переподключения к серверу
+func (c *Consumer) setConnect(connect Connection) {
+	c.mutex.Lock()
+	c.connect = connect
+	c.mutex.Unlock()
+}
+
 // подключается к очереди для получения сообщений
 func (c *Consumer) consume(id int) {
-	channel, err := c.connect.Channel()
-	// выбираем из очереди сообщения с запасом
-	// это нужно для того, чтобы после отправки письма новое уже было готово к отправке
-	// в тоже время нельзя выбираеть все сообщения из очереди разом, т.к. можно упереться в память
-	channel.Qos(c.binding.PrefetchCount, 0, false)
-	deliveries, err := channel.Consume(
-		c.binding.Queue, // name
-		"",              // consumerTag,
-		false,           // noAck
-		false,           // exclusive
-		false,           // noLocal
-		false,           // noWait
-		nil,             // arguments
-	)
+	c.mutex.Lock()
+	connect := c.connect
+	c.mutex.Unlock()
+	channel, err := connect.Channel()
+	if err != nil {
+		logger.Warn("consumer#%d, handler#%d can't get channel, error - %v", c.id, id, err)
+		c.group.Done()
+		return
+	}
+	// письмо подтверждается только после того, как брокер подтвердит его публикацию в другую очередь
+	publisher := newPublisher(channel)
+	tag := fmt.Sprintf("postmanq-consumer#%d-handler#%d", c.id, id)
+	// подписка и регистрация канала идут под семафором, поэтому остановка либо отменит подписку, либо не даст ее создать
+	c.mutex.Lock()
+	if c.stopped {
+		c.mutex.Unlock()
+		channel.Close()
+		c.group.Done()
+		return
+	}
+	deliveries, err := channel.Consume(c.binding.Queue, tag, c.binding.PrefetchCount)
 	if err == nil {
-		go c.consumeDeliveries(id, channel, deliveries)
-	} else {
-		logger.Warn("consumer#%d, handler#%d can't consume queue %s", c.id, id, c.binding.Queue)
+		c.channels[tag] = channel
 	}
+	c.mutex.Unlock()
+	if err != nil {
+		logger.Warn("consumer#%d, handler#%d can't consume queue %s, error - %v", c.id, id, c.binding.Queue, err)
+		channel.Close()
+		c.group.Done()
+		return
+	}
+	c.consumeDeliveries(id, tag, channel, publisher, deliveries)
+}
+
+// останавливает получение новых сообщений из очереди
+// обработчики дожидаются результата отправки уже полученных писем
+func (c *Consumer) stop() {
+	c.mutex.Lock()
+	c.stopped = true
+	for tag, channel := range c.channels {
+		err := channel.Cancel(tag)
+		if err != nil {
+			logger.Warn("consumer#%d can't cancel %s, error - %v", c.id, tag, err)
+		}
+	}
+	c.mutex.Unlock()
 }
 
 // получает сообщения из очереди и отправляет их другим сервисам
-func (c *Consumer) consumeDeliveries(id int, channel *amqp.Channel, deliveries <-chan amqp.Delivery) {
+func (c *Consumer) consumeDeliveries(id int, tag string, channel Channel, publisher *Publisher, deliveries <-chan Delivery) {
 	for delivery := range deliveries {
 		message := new(common.MailMessage)
-		err := json.Unmarshal(delivery.Body, message)
+		err := json.Unmarshal(delivery.Body(), message)
 		if err == nil {
-			// инициализируем параметры письма
-			message.Init()
-			logger.Info(
-				"consumer#%d-%d, handler#%d send mail#%d: envelope - %s, recipient - %s to mailer",
-				c.id,
-				message.ID,
-				id,
-				message.ID,
-				message.Envelope,
-				message.Recipient,
-			)
-
-			event := common.NewSendEvent(message)
-			logger.Debug("consumer#%d-%d send event", c.id, message.ID)
-			event.Iterator.Next().(common.SendingService).Events() <- event
-			// ждем результата,
-			// во время ожидания поток блокируется
-			// если этого не сделать, тогда невозможно будет подтвердить получение сообщения из очереди
-			if handler, ok := resultHandlers[<-event.Result]; ok {
-				handler(c, channel, message)
-			}
+			err = c.handleIdempotentMessage(id, publisher, message)
 			message = nil
-			event = nil
 		} else {
-			failureBinding := c.binding.failureBindings[TechnicalFailureBindingType]
-			err = channel.Publish(
-				failureBinding.Exchange,
-				failureBinding.Routing,
-				false,
-				false,
-				amqp.Publishing{
-					ContentType:  "text/plain",
-					Body:         delivery.Body,
-					DeliveryMode: amqp.Transient,
-				},
-			)
-			logger.Warn("consumer#%d can't unmarshal delivery body, body should be json, body is %s", c.id, string(delivery.Body))
+			logger.Warn("consumer#%d can't unmarshal delivery body, body should be json, body is %s", c.id, string(delivery.Body()))
+			err = publisher.Publish(c.binding.failureBindings[TechnicalFailureBindingType], delivery.Body())
 		}
-		// всегда подтверждаем получение сообщения
-		// даже если во время отправки письма возникли ошибки,
-		// мы уже положили это письмо в другую очередь
-		delivery.Ack(true)
+		// подтверждаем только это сообщение,
+		// остальные полученные обработчиком сообщения еще не отправлены
+		if err == nil {
+			// подтверждаем получение сообщения,
+			// даже если во время отправки письма возникли ошибки,
+			// брокер уже подтвердил, что письмо лежит в другой очереди
+			err = delivery.Ack()
+		} else {
+			// письмо не удалось переложить в другую очередь, возвращаем его обратно
+			logger.Warn("consumer#%d, handler#%d can't republish delivery, return it to queue %s, error - %v", c.id, id, c.binding.Queue, err)
+			err = delivery.Nack(true)
+		}
+		if err != nil {
+			// канал потерян, брокер сам вернет сообщение в очередь
+			logger.Warn("consumer#%d, handler#%d can't acknowledge delivery, broker will redeliver it, error - %v", c.id, id, err)
+		}
+	}
+
+	c.mutex.Lock()
+	delete(c.channels, tag)
+	c.mutex.Unlock()
+	// получатель остановлен или канал потерян
+	// при закрытии канала сообщения, которые были выбраны с запасом, но еще не обработаны, возвращаются в очередь
+	err := channel.Close()
+	if err == nil {
+		logger.Debug("consumer#%d, handler#%d return unprocessed deliveries to queue %s", c.id, id, c.binding.Queue)
 	}
+	c.group.Done()
+}
+
+// отбрасывает письмо, которое приложение уже публиковало с тем же ключом идемпотентности, остальные письма отправляет
+// ключ проверяется только при первом получении письма, повторные и отложенные отправки проверку уже прошли
+// первое получение определяется по токену, который выдает сервис и который сверяется с хранилищем ключей,
+// поэтому приложение не может пропустить проверку, заполнив поля письма само
+func (c *Consumer) handleIdempotentMessage(id int, publisher *Publisher, message *common.MailMessage) error {
+	key := message.IdempotencyKey
+	if c.idempotency == nil || len(key) == 0 || c.idempotency.admitted(key, message.IdempotencyToken) {
+		return c.handleMessage(id, publisher, message)
+	}
+	token, ok := c.idempotency.reserve(key)
+	if !ok {
+		message.Init()
+		duplicates := c.idempotency.countDuplicate()
+		logger.Info("consumer#%d-%s drop duplicate mail with idempotency key %s, duplicates dropped - %d", c.id, message.ID, key, duplicates)
+		c.publishDuplicateResult(publisher, message)
+		return nil
+	}
+	// токен сохранится в письме, если оно будет переложено в другую очередь
+	message.IdempotencyToken = token
+	err := c.handleMessage(id, publisher, message)
+	if err == nil {
+		if e := c.idempotency.commit(key); e != nil {
+			logger.Warn("consumer#%d-%s can't save idempotency key %s, error - %v", c.id, message.ID, key, e)
+		}
+	} else {
+		// письмо вернется в очередь и будет обработано повторно
+		c.idempotency.release(key)
+	}
+	return err
+}
+
+// отправляет письмо другим сервисам и перекладывает его в зависимости от результата отправки
+func (c *Consumer) handleMessage(id int, publisher *Publisher, message *common.MailMessage) error {
+	// инициализируем параметры письма
+	message.Init()
+	if message.ExpiresAt.IsZero() && c.binding.TTL > 0 {
+		message.ExpiresAt = message.CreatedDate.Add(c.binding.TTL)
+	}
+	// письмо нескольким адресатам делим по доменам получателей,
+	// каждая часть отправляется отдельно
+	if len(message.Recipients) > 1 {
+		chunks := c.binding.Recipients.split(message.Recipients)
+		if len(chunks) > 1 {
+			return c.publishChunks(publisher, message, chunks)
+		}
+	}
+	now := time.Now()
+	// письмо еще рано отправлять, откладываем его, пока не наступит время отправки
+	// откладывание не считается попыткой отправки
+	if !message.IsDueAt(now) && !message.IsExpiredAt(now) {
+		if delay, ok := c.binding.parkingDelay(message.SendAt.Sub(now)); ok {
+			logger.Debug("consumer#%d-%s park mail until %s for %v", c.id, message.ID, message.SendAt.Format(time.RFC3339), delay)
+			_, err := c.publishDelayedMessage(publisher, c.binding.delayedBindings[delay], message)
+			return err
+		}
+	}
+	message.TrySendingCount++
+	// ошибка предыдущей попытки не должна попасть в историю и результат этой попытки
+	message.Error = nil
+	event := common.NewSendEvent(message)
+
+	var err error
+	var binding *Binding
+	result := common.ErrorSendEventResult
+	// устаревшее письмо не отправляем, сразу перекладываем в очередь для ошибок
+	if message.IsExpiredAt(now) {
+		binding, err = c.publishExpiredMessage(publisher, message)
+	} else {
+		logger.Info(
+			"consumer#%d-%s, handler#%d send mail#%s: envelope - %s, recipient - %s to mailer",
+			c.id,
+			message.ID,
+			id,
+			message.ID,
+			message.Envelope,
+			strings.Join(message.AllRecipients(), ", "),
+		)
+		logger.Debug("consumer#%d-%s send event", c.id, message.ID)
+		event.Iterator.Next().(common.SendingService).Events() <- event
+		// ждем результата,
+		// во время ожидания поток блокируется
+		// если этого не сделать, тогда невозможно будет подтвердить получение сообщения из очереди
+		result = <-event.Result
+		// отклоненных получателей перекладываем по отдельности
+		for _, rejected := range event.Rejected {
+			if err == nil {
+				err = c.handleRejectedRecipient(publisher, message, rejected)
+			}
+		}
+		// если почтовый сервис отклонил всех получателей, письмо уже разложено по очередям
+		if err != nil || len(event.Rejected) > 0 && len(message.Recipients) == 0 {
+			return err
+		}
+		if handler, ok := resultHandlers[result]; ok {
+			binding, err = handler(c, publisher, message)
+		}
+	}
+	if err == nil {
+		c.publishResult(publisher, result, event, binding)
+	}
+	return err
+}
+
+// кладет части письма нескольким адресатам в очередь, из которой письмо получено
+func (c *Consumer) publishChunks(publisher *Publisher, message *common.MailMessage, chunks [][]string) error {
+	for _, chunk := range chunks {
+		chunkMessage := message.ForRecipients(chunk)
+		jsonMessage, err := json.Marshal(chunkMessage)
+		if err == nil {
+			err = publisher.Publish(c.binding, jsonMessage)
+		}
+		if err != nil {
+			logger.Warn("consumer#%d-%s can't publish mail#%s for %d recipients, error - %v", c.id, message.ID, chunkMessage.ID, len(chunk), err)
+			return err
+		}
+		logger.Debug("consumer#%d-%s publish mail#%s for %d recipients", c.id, message.ID, chunkMessage.ID, len(chunk))
+	}
+	logger.Info("consumer#%d-%s split mail into %d parts by recipients", c.id, message.ID, len(chunks))
+	return nil
+}
+
+// перекладывает копию письма для отклоненного получателя в отложенную очередь или очередь для ошибок
+func (c *Consumer) handleRejectedRecipient(publisher *Publisher, message *common.MailMessage, rejected *common.RejectedRecipient) error {
+	rejectedMessage := message.ForRecipients([]string{rejected.Recipient})
+	rejectedMessage.Error = rejected.Error
+	rejectedMessage.Attempts = append(rejectedMessage.Attempts, rejected.Attempt)
+	logger.Info("consumer#%d-%s publish mail#%s for rejected recipient %s", c.id, message.ID, rejectedMessage.ID, rejected.Recipient)
+
+	result := common.ErrorSendEventResultFor(rejected.Error)
+	binding, err := resultHandlers[result](c, publisher, rejectedMessage)
+	if err == nil {
+		event := common.NewSendEvent(rejectedMessage)
+		event.Attempt = rejected.Attempt
+		c.publishResult(publisher, result, event, binding)
+	}
+	return err
 }
 
 // обрабатывает письма, которые не удалось отправить
-func (c *Consumer) handleErrorSend(channel *amqp.Channel, message *common.MailMessage) {
-	// если есть ошибка при отправке, значит мы попали в серый список https://ru.wikipedia.org/wiki/%D0%A1%D0%B5%D1%80%D1%8B%D0%B9_%D1%81%D0%BF%D0%B8%D1%81%D0%BE%D0%BA
-	// или получили какую то ошибку от почтового сервиса, что он не может
-	// отправить письмо указанному адресату или выполнить какую то команду
+func (c *Consumer) handleErrorSend(publisher *Publisher, message *common.MailMessage) (*Binding, error) {
+	// если для кода ответа указано отдельное расписание, отправляем письмо повторно,
+	// например, некоторые почтовые сервисы отвечают 5XX ошибкой при переполненном ящике
+	if c.binding.Retry.hasCode(message.Error.Code) {
+		return c.publishRetryMessage(publisher, message)
+	}
 	var failureBinding *Binding
 	// если ошибка связана с невозможностью отправить письмо адресату
 	// перекладываем письмо в очередь для плохих писем
 	// и пусть отправители сами с ними разбираются
-	// TODO: Разобраться с iCloud и его 450 при OverQuota
 	if message.Error.Code >= 500 && message.Error.Code < 600 {
 		failureBinding = c.binding.failureBindings[errorSignsMap.BindingType(message)]
-	} else if message.Error.Code == 450 || message.Error.Code == 451 { // мы точно попали в серый список, надо повторить отправку письма попозже
-		if message.TrySendingCount < common.MaxSendingCount {
-			failureBinding = delayedBindings[common.ThirtyMinutesDelayedBinding]
-		} else {
-			failureBinding = delayedBindings[common.NotSendDelayedBinding]
-		}
 	} else {
 		failureBinding = c.binding.failureBindings[UnknownFailureBindingType]
 	}
 	jsonMessage, err := json.Marshal(message)
 	if err == nil {
 		// кладем в очередь
-		err = channel.Publish(
-			failureBinding.Exchange,
-			failureBinding.Routing,
-			false,
-			false,
-			amqp.Publishing{
-				ContentType:  "text/plain",
-				Body:         jsonMessage,
-				DeliveryMode: amqp.Transient,
-			},
-		)
+		err = publisher.Publish(failureBinding, jsonMessage)
 		if err == nil {
 			logger.Info(
-				"consumer#%d-%d publish failed mail to queue %s, message: %s, code: %d",
+				"consumer#%d-%s publish failed mail to queue %s, message: %s, code: %d",
 				c.id,
 				message.ID,
 				failureBinding.Queue,
@@ -164,7 +339,7 @@ func (c *Consumer) handleErrorSend(channel *amqp.Channel, message *common.MailMe
 			)
 		} else {
 			logger.Info(
-				"consumer#%d-%d can't publish failed mail to queue %s, message: %s, code: %d, publish error% %v",
+				"consumer#%d-%s can't publish failed mail to queue %s, message: %s, code: %d, publish error% %v",
 				c.id,
 				message.ID,
 				failureBinding.Queue,
@@ -176,77 +351,90 @@ func (c *Consumer) handleErrorSend(channel *amqp.Channel, message *common.MailMe
 	} else {
 		logger.WarnWithErr(err)
 	}
+	return failureBinding, err
 }
 
 // обрабатывает письма, которые нужно отправить позже
-func (c *Consumer) handleDelaySend(channel *amqp.Channel, message *common.MailMessage) {
+// в том числе письма, попавшие в серый список https://ru.wikipedia.org/wiki/%D0%A1%D0%B5%D1%80%D1%8B%D0%B9_%D1%81%D0%BF%D0%B8%D1%81%D0%BE%D0%BA
+func (c *Consumer) handleDelaySend(publisher *Publisher, message *common.MailMessage) (*Binding, error) {
 	logger.Debug(
-		"consumer%d-%d find dlx queue",
+		"consumer%d-%s find dlx queue",
 		c.id,
 		message.ID,
 	)
-	bindingType := common.UnknownDelayedBinding
 	if message.Error != nil {
 		logger.Debug(
-			"consumer%d-%d detect error, message: %s, code: %d",
+			"consumer%d-%s detect error, message: %s, code: %d",
 			c.id,
 			message.ID,
 			message.Error.Message,
 			message.Error.Code,
 		)
 	}
-	logger.Debug("consumer%d-%d detect old dlx queue type#%v", c.id, message.ID, message.BindingType)
-	// если нам просто не удалось отправить письмо, берем следующую очередь из цепочки
-	if chainBinding, ok := bindingsChain[message.BindingType]; ok {
-		bindingType = chainBinding
-	}
-	c.publishDelayedMessage(channel, bindingType, message)
+	return c.publishRetryMessage(publisher, message)
 }
 
 // обрабатывает письма, которые превысили лимит отправки
-func (c *Consumer) handleOverlimitSend(channel *amqp.Channel, message *common.MailMessage) {
-	bindingType := common.UnknownDelayedBinding
-	logger.Debug("consumer#%d-%d detect overlimit, find dlx queue", c.id, message.ID)
-	for i := 0; i < limitBindingsLen; i++ {
-		if limitBindings[i] == message.BindingType {
-			bindingType = limitBindings[i]
-			break
+func (c *Consumer) handleOverlimitSend(publisher *Publisher, message *common.MailMessage) (*Binding, error) {
+	logger.Debug("consumer#%d-%s detect overlimit, find dlx queue", c.id, message.ID)
+	if duration, ok := limitDurations[message.BindingType]; ok {
+		return c.publishDelayedMessage(publisher, c.binding.delayedBindings[duration], message)
+	}
+	// письмо вернется в очередь, иначе оно будет потеряно
+	logger.Warn("consumer#%d-%s unknow delayed type#%v", c.id, message.ID, message.BindingType)
+	return nil, fmt.Errorf("unknown delayed type#%v", message.BindingType)
+}
+
+// кладет письмо в отложенную очередь по расписанию повторных отправок
+// если попытки исчерпаны, письмо кладется в очередь неотправленных писем
+func (c *Consumer) publishRetryMessage(publisher *Publisher, message *common.MailMessage) (*Binding, error) {
+	delay, ok := c.binding.Retry.schedule(message).next(message)
+	// письмо устареет раньше, чем будет отправлено повторно
+	if ok && message.IsExpiredAt(time.Now().Add(delay)) {
+		return c.publishExpiredMessage(publisher, message)
+	}
+	if !ok {
+		logger.Info("consumer#%d-%s exhausted retries after %d attempts, give up sending mail", c.id, message.ID, message.RetryCount+1)
+		return c.publishDelayedMessage(publisher, c.binding.notSendBinding, message)
+	}
+	logger.Debug("consumer#%d-%s retry#%d in %v", c.id, message.ID, message.RetryCount+1, delay)
+	message.RetryCount++
+	return c.publishDelayedMessage(publisher, c.binding.delayedBindings[delay], message)
+}
+
+// кладет устаревшее письмо в очередь для ошибок
+func (c *Consumer) publishExpiredMessage(publisher *Publisher, message *common.MailMessage) (*Binding, error) {
+	message.Expire()
+	expiredBinding := c.binding.failureBindings[ExpiredFailureBindingType]
+	jsonMessage, err := json.Marshal(message)
+	if err == nil {
+		err = publisher.Publish(expiredBinding, jsonMessage)
+		if err == nil {
+			logger.Info("consumer#%d-%s publish expired mail to queue %s, message: %s", c.id, message.ID, expiredBinding.Queue, message.Error.Message)
+		} else {
+			logger.Warn("consumer#%d-%s can't publish expired mail to queue %s, error - %v", c.id, message.ID, expiredBinding.Queue, err)
 		}
+	} else {
+		logger.Warn("consumer#%d-%s can't marshal mail to json", c.id, message.ID)
 	}
-	c.publishDelayedMessage(channel, bindingType, message)
+	return expiredBinding, err
 }
 
 // кладет письмо обратно в одну из отложенных очередей
-func (c *Consumer) publishDelayedMessage(channel *amqp.Channel, bindingType common.DelayedBindingType, message *common.MailMessage) {
-	// получаем очередь, проверяем, что она реально есть
-	// а что? а вдруг нет)
-	if delayedBinding, ok := c.binding.delayedBindings[bindingType]; ok {
-		message.BindingType = bindingType
-		jsonMessage, err := json.Marshal(message)
+func (c *Consumer) publishDelayedMessage(publisher *Publisher, delayedBinding *Binding, message *common.MailMessage) (*Binding, error) {
+	jsonMessage, err := json.Marshal(message)
+	if err == nil {
+		// кладем в очередь
+		err = publisher.Publish(delayedBinding, jsonMessage)
 		if err == nil {
-			// кладем в очередь
-			err = channel.Publish(
-				delayedBinding.Exchange,
-				delayedBinding.Routing,
-				false,
-				false,
-				amqp.Publishing{
-					ContentType:  "text/plain",
-					Body:         []byte(jsonMessage),
-					DeliveryMode: amqp.Transient,
-				},
-			)
-			if err == nil {
-				logger.Debug("consumer#%d-%d publish failed mail to queue %s", c.id, message.ID, delayedBinding.Queue)
-			} else {
-				logger.Warn("consumer#%d-%d can't publish failed mail to queue %s, error - %v", c.id, message.ID, delayedBinding.Queue, err)
-			}
+			logger.Debug("consumer#%d-%s publish failed mail to queue %s", c.id, message.ID, delayedBinding.Queue)
 		} else {
-			logger.Warn("consumer#%d-%d can't marshal mail to json", c.id, message.ID)
+			logger.Warn("consumer#%d-%s can't publish failed mail to queue %s, error - %v", c.id, message.ID, delayedBinding.Queue, err)
 		}
 	} else {
-		logger.Warn("consumer#%d-%d unknow delayed type#%v", c.id, message.ID, bindingType)
+		logger.Warn("consumer#%d-%s can't marshal mail to json", c.id, message.ID)
 	}
+	return delayedBinding, err
 }
 
 // получает письма из всех очередей с ошибками
@@ -255,10 +443,10 @@ func (c *Consumer) consumeFailureMessages(group *sync.WaitGroup) {
 	if err == nil {
 		for _, failureBinding := range c.binding.failureBindings {
 			for {
-				delivery, ok, _ := channel.Get(failureBinding.Queue, false)
+				delivery, ok, _ := channel.Get(failureBinding.Queue)
 				if ok {
 					message := new(common.MailMessage)
-					err = json.Unmarshal(delivery.Body, message)
+					err = json.Unmarshal(delivery.Body(), message)
 					if err == nil {
 						sendEvent := common.NewSendEvent(message)
 						sendEvent.Iterator.Next().(common.ReportService).Events() <- sendEvent
@@ -300,12 +488,13 @@ func (c *Consumer) consumeAndPublishMessages(event *common.ApplicationEvent, gro
 			recipientRegex, _ = regexp.Compile(event.GetStringArg("recipient"))
 		}
 
-		publishDeliveries := make([]amqp.Delivery, 0)
+		publisher := newPublisher(channel)
+		publishDeliveries := make([]Delivery, 0)
 		for {
-			delivery, ok, _ := channel.Get(srcBinding.Queue, false)
+			delivery, ok, _ := channel.Get(srcBinding.Queue)
 			if ok {
 				message := new(common.MailMessage)
-				err = json.Unmarshal(delivery.Body, message)
+				err = json.Unmarshal(delivery.Body(), message)
 				if err == nil {
 					var necessaryPublish bool
 					if (event.GetIntArg("code") > common.InvalidInputInt && event.GetIntArg("code") == message.Error.Code) ||
@@ -316,7 +505,7 @@ func (c *Consumer) consumeAndPublishMessages(event *common.ApplicationEvent, gro
 					}
 					if necessaryPublish {
 						fmt.Printf(
-							"find mail#%d: envelope - %s, recipient - %s\n",
+							"find mail#%s: envelope - %s, recipient - %s\n",
 							message.ID,
 							message.Envelope,
 							message.Recipient,
@@ -330,21 +519,11 @@ func (c *Consumer) consumeAndPublishMessages(event *common.ApplicationEvent, gro
 		}
 
 		for _, delivery := range publishDeliveries {
-			err = channel.Publish(
-				destBinding.Exchange,
-				destBinding.Routing,
-				false,
-				false,
-				amqp.Publishing{
-					ContentType:  "text/plain",
-					Body:         delivery.Body,
-					DeliveryMode: amqp.Transient,
-				},
-			)
+			err = publisher.Publish(destBinding, delivery.Body())
 			if err == nil {
-				delivery.Ack(true)
+				delivery.Ack()
 			} else {
-				delivery.Nack(true, true)
+				delivery.Nack(true)
 			}
 		}
 		group.Done()
@@ -379,5 +558,9 @@ func (c *Consumer) findBindingByQueueName(queueName string) *Binding {
 		}
 	}
 
+	if binding == nil && c.binding.notSendBinding.Queue == queueName {
+		binding = c.binding.notSendBinding
+	}
+
 	return binding
 }
@@ -0,0 +1,453 @@
+package consumer
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boreevyuri/postmanq/common"
+	"github.com/boreevyuri/postmanq/logger"
+)
+
+func TestMain(m *testing.M) {
+	// без запущенных писателей логов запись в лог блокирует получателя
+	logger.Inst()
+	os.Exit(m.Run())
+}
+
+// сервис отправки для тестов, отвечает на события функцией send
+type testSender struct {
+	events chan *common.SendEvent
+	send   func(*common.SendEvent)
+}
+
+// создает сервис отправки и подставляет его в итератор сервисов
+func newTestSender(t *testing.T, send func(*common.SendEvent)) *testSender {
+	sender := &testSender{events: make(chan *common.SendEvent), send: send}
+	services := common.Services
+	common.Services = []interface{}{sender}
+	go func() {
+		for event := range sender.events {
+			sender.send(event)
+		}
+	}()
+	t.Cleanup(func() {
+		common.Services = services
+		close(sender.events)
+	})
+	return sender
+}
+
+func (s *testSender) OnInit(*common.ApplicationEvent) {}
+func (s *testSender) OnRun()                          {}
+func (s *testSender) OnFinish()                       {}
+func (s *testSender) Events() chan *common.SendEvent  { return s.events }
+
+// отправляет письмо успешно
+func sendSuccess(event *common.SendEvent) {
+	event.AddAttempt(250, "2.0.0 ok")
+	event.Result <- common.SuccessSendEventResult
+}
+
+// письмо в файловой очереди
+type queuedMessage struct {
+	// дата, с которой письмо доступно получателям
+	visibleAt time.Time
+
+	// письмо
+	message *common.MailMessage
+}
+
+// создает получателя связки, очереди которого лежат во временном каталоге
+func newTestConsumer(t *testing.T, binding *Binding) (*Consumer, *Publisher, *spoolConnection) {
+	dir, err := ioutil.TempDir("", "postmanq-consumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	if err = binding.init(); err != nil {
+		t.Fatal(err)
+	}
+	connect, err := dialSpool(spoolScheme + "://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { connect.Close() })
+	channel, err := connect.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { channel.Close() })
+	if err = binding.declareAll(channel); err != nil {
+		t.Fatal(err)
+	}
+	return NewConsumer(1, connect, binding, nil), newPublisher(channel), connect.(*spoolConnection)
+}
+
+// отдает все письма очереди, включая еще недоступные получателям
+func queued(t *testing.T, connect *spoolConnection, queue string) []*queuedMessage {
+	names, err := readNames(connect.queueDir(queue))
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := make([]*queuedMessage, 0)
+	for _, name := range names {
+		visibleAt, ok := parseSpoolName(name)
+		if !ok || strings.HasPrefix(name, ".") {
+			continue
+		}
+		body, err := ioutil.ReadFile(filepath.Join(connect.queueDir(queue), name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		message := new(common.MailMessage)
+		if err = json.Unmarshal(body, message); err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, &queuedMessage{visibleAt: time.Unix(0, visibleAt), message: message})
+	}
+	return messages
+}
+
+// проверяет, что письмо станет доступным получателям через паузу
+func assertVisibleAfter(t *testing.T, queuedMessage *queuedMessage, publishedAt time.Time, delay time.Duration) {
+	t.Helper()
+	visibleAfter := queuedMessage.visibleAt.Sub(publishedAt)
+	if visibleAfter < delay || visibleAfter > delay+time.Second {
+		t.Errorf("mail is visible after %v, want %v", visibleAfter, delay)
+	}
+}
+
+// создает письмо для тестов
+func newTestMessage() *common.MailMessage {
+	return &common.MailMessage{
+		Envelope:  "sender@example.com",
+		Recipient: "recipient@example.org",
+		Body:      "Subject: test\r\n\r\ntest",
+	}
+}
+
+// обрабатывает получателем все доступные письма очереди связки
+func consumeQueue(t *testing.T, consumer *Consumer, publisher *Publisher) {
+	channel, err := consumer.connect.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliveries := make(chan Delivery, 100)
+	for {
+		delivery, ok, err := channel.Get(consumer.binding.Queue)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+		deliveries <- delivery
+	}
+	close(deliveries)
+	consumer.group.Add(1)
+	consumer.consumeDeliveries(0, "test", channel, publisher, deliveries)
+}
+
+// объявляет очередь для событий с результатом отправки
+func declareResults(t *testing.T, binding *Binding, connect *spoolConnection) {
+	channel, err := connect.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer channel.Close()
+	if err = channel.Declare(&Binding{Exchange: binding.Results, Queue: "results"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// отдает события с результатом отправки
+func results(t *testing.T, connect *spoolConnection) []*Result {
+	names, err := readNames(connect.queueDir("results"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := make([]*Result, 0)
+	for _, name := range names {
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		body, err := ioutil.ReadFile(filepath.Join(connect.queueDir("results"), name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := new(Result)
+		if err = json.Unmarshal(body, res); err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+func TestConsumeDeliveries(t *testing.T) {
+	cases := []struct {
+		name     string
+		body     func() []byte
+		send     func(*common.SendEvent)
+		queue    string
+		status   ResultStatus
+		code     int
+		text     string
+		attempts int
+	}{
+		{
+			name:     "success",
+			send:     sendSuccess,
+			status:   SuccessResultStatus,
+			code:     250,
+			text:     "2.0.0 ok",
+			attempts: 1,
+		},
+		{
+			name: "permanent error",
+			send: func(event *common.SendEvent) {
+				common.ReturnMail(event, errors.New("550 5.1.1 user unknown"))
+			},
+			queue:    "postmanq.failure.recipient",
+			status:   ErrorResultStatus,
+			code:     550,
+			text:     "550 5.1.1 user unknown",
+			attempts: 1,
+		},
+		{
+			// ошибка без кода не должна получить код и текст предыдущей попытки
+			name: "error without code after error with code",
+			body: func() []byte {
+				message := newTestMessage()
+				message.Error = &common.MailError{Code: 421, Message: "421 4.7.0 try again later"}
+				message.Attempts = []*common.MailAttempt{{Code: 421, Message: message.Error.Message}}
+				message.RetryCount = 1
+				body, _ := json.Marshal(message)
+				return body
+			},
+			send: func(event *common.SendEvent) {
+				common.ReturnMail(event, errors.New("dial tcp 192.0.2.1:25: i/o timeout"))
+			},
+			queue:    "postmanq",
+			status:   DelayResultStatus,
+			text:     "dial tcp 192.0.2.1:25: i/o timeout",
+			attempts: 2,
+		},
+		{
+			name:  "invalid json",
+			body:  func() []byte { return []byte("not json") },
+			send:  sendSuccess,
+			queue: "postmanq.failure.technical",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			newTestSender(t, c.send)
+			binding := &Binding{Name: "postmanq", Results: "postmanq.results"}
+			consumer, publisher, connect := newTestConsumer(t, binding)
+			declareResults(t, binding, connect)
+			body, _ := json.Marshal(newTestMessage())
+			if c.body != nil {
+				body = c.body()
+			}
+			if err := publisher.Publish(binding, body); err != nil {
+				t.Fatal(err)
+			}
+
+			consumeQueue(t, consumer, publisher)
+			if c.queue != binding.Queue {
+				if messages := queued(t, connect, binding.Queue); len(messages) != 0 {
+					t.Errorf("queue %s has %d mails, want empty queue", binding.Queue, len(messages))
+				}
+			}
+			if len(c.status) == 0 {
+				// тело не является письмом, поэтому перекладывается как есть
+				if names, _ := readNames(connect.queueDir(c.queue)); len(names) != 2 {
+					t.Errorf("queue %s has %d files, want body and leased directory", c.queue, len(names))
+				}
+				return
+			}
+			if len(c.queue) > 0 {
+				messages := queued(t, connect, c.queue)
+				if len(messages) != 1 {
+					t.Fatalf("queue %s has %d mails, want 1", c.queue, len(messages))
+				}
+				message := messages[0].message
+				if len(message.Attempts) != c.attempts || message.Attempts[c.attempts-1].Message != c.text {
+					t.Errorf("attempts = %+v, want %d attempts, last with %s", message.Attempts, c.attempts, c.text)
+				}
+			}
+			events := results(t, connect)
+			if len(events) != 1 {
+				t.Fatalf("%d result events, want 1", len(events))
+			}
+			if events[0].Status != c.status || events[0].Code != c.code || events[0].Message != c.text {
+				t.Errorf("result = %s, %d, %s, want %s, %d, %s", events[0].Status, events[0].Code, events[0].Message, c.status, c.code, c.text)
+			}
+		})
+	}
+}
+
+func TestConsumeDeliveriesRequeue(t *testing.T) {
+	newTestSender(t, func(event *common.SendEvent) {
+		common.ReturnMail(event, errors.New("451 4.3.0 try again later"))
+	})
+	binding := &Binding{Name: "postmanq"}
+	consumer, publisher, connect := newTestConsumer(t, binding)
+	body, _ := json.Marshal(newTestMessage())
+	if err := publisher.Publish(binding, body); err != nil {
+		t.Fatal(err)
+	}
+
+	// очереди не объявлены в другом подключении, поэтому письмо не удастся переложить в отложенную очередь
+	other, err := dialSpool(spoolScheme + "://" + connect.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	channel, err := other.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer channel.Close()
+	consumeQueue(t, consumer, newPublisher(channel))
+
+	messages := queued(t, connect, binding.Queue)
+	if len(messages) != 1 || string(mustMarshal(t, messages[0].message)) != string(mustMarshal(t, mustUnmarshal(t, body))) {
+		t.Errorf("queue has %d mails, want unchanged mail", len(messages))
+	}
+}
+
+func TestHandleMessageSplit(t *testing.T) {
+	newTestSender(t, sendSuccess)
+	consumer, publisher, connect := newTestConsumer(t, &Binding{Name: "postmanq"})
+	message := newTestMessage()
+	message.Recipients = []string{"first@example.org", "second@example.net", "third@example.org"}
+
+	if err := consumer.handleMessage(0, publisher, message); err != nil {
+		t.Fatal(err)
+	}
+	messages := queued(t, connect, "postmanq")
+	if len(messages) != 2 {
+		t.Fatalf("queue has %d parts, want 2", len(messages))
+	}
+	ids := map[string]bool{message.ID: true}
+	for _, part := range messages {
+		if ids[part.message.ID] || part.message.ParentID != message.ID {
+			t.Errorf("part id = %s, parent id = %s, mail id = %s", part.message.ID, part.message.ParentID, message.ID)
+		}
+		ids[part.message.ID] = true
+	}
+}
+
+func TestHandleMessageRejectedRecipient(t *testing.T) {
+	newTestSender(t, func(event *common.SendEvent) {
+		event.Reject("second@example.org", errors.New("550 5.1.1 user unknown"))
+		event.Message.Recipients = event.Message.Recipients[:1]
+		sendSuccess(event)
+	})
+	binding := &Binding{Name: "postmanq", Results: "postmanq.results"}
+	consumer, publisher, connect := newTestConsumer(t, binding)
+	declareResults(t, binding, connect)
+	message := newTestMessage()
+	message.Recipients = []string{"first@example.org", "second@example.org"}
+
+	if err := consumer.handleMessage(0, publisher, message); err != nil {
+		t.Fatal(err)
+	}
+	failed := queued(t, connect, "postmanq.failure.recipient")
+	if len(failed) != 1 {
+		t.Fatalf("failure queue has %d mails, want 1", len(failed))
+	}
+	rejected := failed[0].message
+	if rejected.ID == message.ID || rejected.ParentID != message.ID || rejected.Recipient != "second@example.org" {
+		t.Errorf("rejected copy id = %s, parent id = %s, recipient = %s", rejected.ID, rejected.ParentID, rejected.Recipient)
+	}
+	statuses := make(map[string]ResultStatus)
+	for _, res := range results(t, connect) {
+		statuses[res.Recipient] = res.Status
+	}
+	if statuses["first@example.org"] != SuccessResultStatus || statuses["second@example.org"] != ErrorResultStatus {
+		t.Errorf("result statuses = %v", statuses)
+	}
+}
+
+func mustMarshal(t *testing.T, message *common.MailMessage) []byte {
+	body, err := json.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func mustUnmarshal(t *testing.T, body []byte) *common.MailMessage {
+	message := new(common.MailMessage)
+	if err := json.Unmarshal(body, message); err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+// ждет завершения обработчиков получателя
+func waitHandlers(t *testing.T, consumer *Consumer) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		consumer.group.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handlers aren't finished after stop")
+	}
+}
+
+func TestConsumerRunStop(t *testing.T) {
+	sent := make(chan struct{}, 1)
+	newTestSender(t, func(event *common.SendEvent) {
+		sendSuccess(event)
+		sent <- struct{}{}
+	})
+	binding := &Binding{Name: "postmanq"}
+	consumer, publisher, connect := newTestConsumer(t, binding)
+	if err := publisher.Publish(binding, mustMarshal(t, newTestMessage())); err != nil {
+		t.Fatal(err)
+	}
+	consumer.run()
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("mail isn't consumed")
+	}
+	consumer.stop()
+	waitHandlers(t, consumer)
+
+	// после остановки письма остаются в очереди
+	if err := publisher.Publish(binding, mustMarshal(t, newTestMessage())); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * spoolPollInterval)
+	if messages := queued(t, connect, binding.Queue); len(messages) != 1 {
+		t.Errorf("queue has %d mails after stop, want 1", len(messages))
+	}
+}
+
+func TestConsumerRunAfterStop(t *testing.T) {
+	newTestSender(t, sendSuccess)
+	consumer, _, _ := newTestConsumer(t, &Binding{Name: "postmanq"})
+	// обработчики, запущенные после остановки, не подписываются на очередь
+	consumer.stop()
+	consumer.run()
+	waitHandlers(t, consumer)
+	if len(consumer.channels) != 0 {
+		t.Errorf("consumer has %d channels after stop, want none", len(consumer.channels))
+	}
+}
@@ -0,0 +1,240 @@
+package consumer
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// окно проверки повторов по умолчанию
+	defaultIdempotencyWindow = 24 * time.Hour
+
+	// минимальное количество устаревших записей в файле, после которого файл перезаписывается
+	minIdempotencyGarbage = 1000
+)
+
+// Idempotency хранилище ключей идемпотентности обработанных писем
+// ключи дописываются в файл, поэтому после перезапуска повторы по-прежнему отбрасываются
+type Idempotency struct {
+	// файл с ключами, если не указан, ключи не проверяются
+	Filename string `yaml:"file"`
+
+	// окно, в течение которого письмо с тем же ключом считается повтором
+	Window time.Duration `yaml:"window"`
+
+	// обработанные письма, в качестве ключа используется ключ идемпотентности
+	keys map[string]*idempotencyRecord
+
+	// токены писем, которые сейчас обрабатываются, в качестве ключа используется ключ идемпотентности
+	pending map[string]string
+
+	// файл, в который дописываются ключи
+	file *os.File
+
+	// количество записей в файле
+	records int
+
+	// количество отброшенных повторов
+	duplicates int64
+
+	// семафор для ключей и файла
+	mutex *sync.Mutex
+}
+
+// запись о письме, прошедшем проверку
+type idempotencyRecord struct {
+	// дата обработки письма
+	date time.Time
+
+	// токен, выданный письму при первом получении
+	token string
+}
+
+// загружает ключи из файла
+// ключи, вышедшие за окно проверки, не загружаются, а файл перезаписывается без них
+func (i *Idempotency) init() error {
+	i.keys = make(map[string]*idempotencyRecord)
+	i.pending = make(map[string]string)
+	i.mutex = new(sync.Mutex)
+	if i.Window == 0 {
+		i.Window = defaultIdempotencyWindow
+	}
+
+	file, err := os.Open(i.Filename)
+	if err == nil {
+		now := time.Now()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			key, record, ok := parseIdempotencyRecord(scanner.Text())
+			if ok && now.Sub(record.date) < i.Window {
+				i.keys[key] = record
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	return i.compact()
+}
+
+// сигнализирует, что файл с ключами указан
+func (i *Idempotency) isEnabled() bool {
+	return len(i.Filename) > 0
+}
+
+// занимает ключ на время обработки письма и выдает письму токен
+// возвращает false, если письмо с таким ключом уже обработано в пределах окна или обрабатывается сейчас
+func (i *Idempotency) reserve(key string) (string, bool) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if record, ok := i.keys[key]; ok && time.Since(record.date) < i.Window {
+		return "", false
+	}
+	if _, ok := i.pending[key]; ok {
+		return "", false
+	}
+	token := newIdempotencyToken()
+	i.pending[key] = token
+	return token, true
+}
+
+// сигнализирует, что письмо с токеном уже прошло проверку
+// токен сверяется с хранилищем, поэтому приложение не может пропустить проверку, указав токен в письме само
+func (i *Idempotency) admitted(key string, token string) bool {
+	if len(token) == 0 {
+		return false
+	}
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if record, ok := i.keys[key]; ok {
+		return record.token == token
+	}
+	// части письма могут вернуться, пока письмо еще обрабатывается
+	return i.pending[key] == token
+}
+
+// освобождает ключ, если письмо не удалось обработать и оно вернулось в очередь
+func (i *Idempotency) release(key string) {
+	i.mutex.Lock()
+	delete(i.pending, key)
+	i.mutex.Unlock()
+}
+
+// запоминает ключ и токен обработанного письма
+// ключ пишется в файл до подтверждения получения письма,
+// поэтому письмо, которое брокер вернет в очередь после падения, тоже будет отброшено
+func (i *Idempotency) commit(key string) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	now := time.Now()
+	record := &idempotencyRecord{date: now, token: i.pending[key]}
+	delete(i.pending, key)
+	i.keys[key] = record
+	_, err := fmt.Fprintf(i.file, "%d %s %s\n", record.date.UnixNano(), strconv.Quote(key), record.token)
+	if err != nil {
+		return err
+	}
+	i.records++
+	// удаляем устаревшие ключи, когда их становится больше, чем действующих
+	if i.records-len(i.keys) > minIdempotencyGarbage && i.records > 2*len(i.keys) {
+		for key, record := range i.keys {
+			if now.Sub(record.date) >= i.Window {
+				delete(i.keys, key)
+			}
+		}
+		return i.compact()
+	}
+	return nil
+}
+
+// увеличивает счетчик отброшенных повторов и отдает его значение
+func (i *Idempotency) countDuplicate() int64 {
+	return atomic.AddInt64(&i.duplicates, 1)
+}
+
+// перезаписывает файл действующими ключами и открывает его для дописывания
+func (i *Idempotency) compact() error {
+	if i.file != nil {
+		i.file.Close()
+	}
+	tmpFilename := i.Filename + ".tmp"
+	file, err := os.OpenFile(tmpFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for key, record := range i.keys {
+		fmt.Fprintf(writer, "%d %s %s\n", record.date.UnixNano(), strconv.Quote(key), record.token)
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err == nil {
+		err = os.Rename(tmpFilename, i.Filename)
+	}
+	if err != nil {
+		return err
+	}
+	i.file, err = os.OpenFile(i.Filename, os.O_WRONLY|os.O_APPEND, 0644)
+	i.records = len(i.keys)
+	return err
+}
+
+// закрывает файл с ключами
+func (i *Idempotency) close() {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if i.file != nil {
+		i.file.Close()
+		i.file = nil
+	}
+}
+
+// разбирает запись файла вида "<дата в наносекундах> <ключ в кавычках> <токен>"
+// в записях, сохраненных до появления токенов, токена нет
+func parseIdempotencyRecord(line string) (string, *idempotencyRecord, bool) {
+	i := strings.IndexByte(line, ' ')
+	if i < 0 {
+		return "", nil, false
+	}
+	nanos, err := strconv.ParseInt(line[:i], 10, 64)
+	if err != nil {
+		return "", nil, false
+	}
+	quoted, token := line[i+1:], ""
+	key, err := strconv.Unquote(quoted)
+	if err != nil {
+		// токен не содержит пробелов, поэтому отделяется последним пробелом
+		j := strings.LastIndexByte(quoted, ' ')
+		if j < 0 {
+			return "", nil, false
+		}
+		quoted, token = quoted[:j], quoted[j+1:]
+		key, err = strconv.Unquote(quoted)
+		if err != nil {
+			return "", nil, false
+		}
+	}
+	return key, &idempotencyRecord{date: time.Unix(0, nanos), token: token}, true
+}
+
+// создает случайный токен письма
+func newIdempotencyToken() string {
+	var token [16]byte
+	rand.Read(token[:])
+	return hex.EncodeToString(token[:])
+}
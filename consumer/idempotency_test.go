@@ -0,0 +1,140 @@
+package consumer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/boreevyuri/postmanq/common"
+)
+
+// открывает хранилище ключей во временном каталоге
+func newTestIdempotency(t *testing.T) *Idempotency {
+	dir, err := ioutil.TempDir("", "postmanq-idempotency")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	idempotency := &Idempotency{Filename: filepath.Join(dir, "keys")}
+	if err = idempotency.init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(idempotency.close)
+	return idempotency
+}
+
+func TestHandleIdempotentMessage(t *testing.T) {
+	sent := 0
+	newTestSender(t, func(event *common.SendEvent) {
+		sent++
+		sendSuccess(event)
+	})
+	consumer, publisher, _ := newTestConsumer(t, &Binding{Name: "postmanq"})
+	consumer.idempotency = newTestIdempotency(t)
+
+	newMessage := func() *common.MailMessage {
+		message := newTestMessage()
+		message.IdempotencyKey = "order-1"
+		// дата создания, указанная приложением, не отменяет проверку
+		message.CreatedDate = time.Now().Add(-time.Minute)
+		return message
+	}
+	first := newMessage()
+	if err := consumer.handleIdempotentMessage(0, publisher, first); err != nil {
+		t.Fatal(err)
+	}
+	if len(first.IdempotencyToken) == 0 {
+		t.Error("checked mail has no token")
+	}
+	if err := consumer.handleIdempotentMessage(0, publisher, newMessage()); err != nil {
+		t.Fatal(err)
+	}
+	if sent != 1 {
+		t.Fatalf("mail is sent %d times, want duplicate dropped", sent)
+	}
+
+	// повторная отправка того же письма уже прошла проверку
+	retried := newMessage()
+	retried.IdempotencyToken = first.IdempotencyToken
+	if err := consumer.handleIdempotentMessage(0, publisher, retried); err != nil {
+		t.Fatal(err)
+	}
+	if sent != 2 {
+		t.Errorf("retried mail isn't sent")
+	}
+}
+
+func TestHandleIdempotentMessageClientMarks(t *testing.T) {
+	sent := 0
+	newTestSender(t, func(event *common.SendEvent) {
+		sent++
+		sendSuccess(event)
+	})
+	consumer, publisher, _ := newTestConsumer(t, &Binding{Name: "postmanq"})
+	consumer.idempotency = newTestIdempotency(t)
+	if err := consumer.handleIdempotentMessage(0, publisher, &common.MailMessage{
+		Envelope:       "sender@example.com",
+		Recipient:      "user@example.com",
+		IdempotencyKey: "order-1",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// приложение не может пропустить проверку, пометив письмо само
+	for _, body := range []string{
+		`{"envelope":"sender@example.com","recipient":"user@example.com","idempotencyKey":"order-1","idempotencyChecked":true}`,
+		`{"envelope":"sender@example.com","recipient":"user@example.com","idempotencyKey":"order-1","idempotencyToken":"00112233445566778899aabbccddeeff"}`,
+	} {
+		message := new(common.MailMessage)
+		if err := json.Unmarshal([]byte(body), message); err != nil {
+			t.Fatal(err)
+		}
+		if err := consumer.handleIdempotentMessage(0, publisher, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sent != 1 {
+		t.Errorf("mail is sent %d times, want duplicates marked by client dropped", sent)
+	}
+}
+
+func TestIdempotencyReload(t *testing.T) {
+	idempotency := newTestIdempotency(t)
+	token, ok := idempotency.reserve("order-1")
+	if !ok {
+		t.Fatal("new key isn't reserved")
+	}
+	// части письма могут вернуться, пока письмо обрабатывается
+	if !idempotency.admitted("order-1", token) {
+		t.Error("pending mail isn't admitted by its token")
+	}
+	if err := idempotency.commit("order-1"); err != nil {
+		t.Fatal(err)
+	}
+	// запись без токена из файла, сохраненного до появления токенов
+	if _, err := idempotency.file.WriteString(strconv.FormatInt(time.Now().UnixNano(), 10) + " \"order 2\"\n"); err != nil {
+		t.Fatal(err)
+	}
+	idempotency.close()
+
+	reloaded := &Idempotency{Filename: idempotency.Filename}
+	if err := reloaded.init(); err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.close()
+	if !reloaded.admitted("order-1", token) {
+		t.Error("token isn't restored from file")
+	}
+	if reloaded.admitted("order-1", "other") || reloaded.admitted("order 2", "") {
+		t.Error("mail without issued token is admitted")
+	}
+	for _, key := range []string{"order-1", "order 2"} {
+		if _, ok := reloaded.reserve(key); ok {
+			t.Errorf("key %s isn't restored from file", key)
+		}
+	}
+}
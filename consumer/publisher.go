@@ -0,0 +1,24 @@
+package consumer
+
+// Publisher публикует сообщения и дожидается подтверждения публикации от брокера
+type Publisher struct {
+	// канал, через который публикуются сообщения
+	channel Channel
+}
+
+// newPublisher создает публикатора
+func newPublisher(channel Channel) *Publisher {
+	return &Publisher{channel: channel}
+}
+
+// Publish кладет сообщение в точку обмена связки
+// письмо сохраняется брокером на диск, поэтому не теряется при его перезапуске
+// ошибка возвращается, если брокер не подтвердил публикацию
+func (p *Publisher) Publish(binding *Binding, body []byte) error {
+	return p.PublishWithKey(binding, binding.Routing, body)
+}
+
+// PublishWithKey кладет сообщение в точку обмена связки с указанным ключом маршрутизации
+func (p *Publisher) PublishWithKey(binding *Binding, key string, body []byte) error {
+	return p.channel.Publish(binding.Exchange, key, body)
+}
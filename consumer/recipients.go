@@ -0,0 +1,60 @@
+package consumer
+
+import (
+	"strings"
+)
+
+const (
+	// максимальное количество получателей в одной отправке по умолчанию
+	defaultMaxRecipients = 50
+)
+
+// RecipientsLimit ограничение на количество получателей в одной отправке письма
+type RecipientsLimit struct {
+	// максимальное количество получателей
+	Max int `yaml:"max"`
+
+	// максимальное количество получателей для отдельных доменов
+	Domains map[string]int `yaml:"domains"`
+}
+
+// инициализирует ограничение значениями по умолчанию
+func (r *RecipientsLimit) init() {
+	if r.Max == 0 {
+		r.Max = defaultMaxRecipients
+	}
+}
+
+// отдает максимальное количество получателей для домена
+func (r *RecipientsLimit) maxFor(hostname string) int {
+	if max, ok := r.Domains[hostname]; ok && max > 0 {
+		return max
+	}
+	return r.Max
+}
+
+// делит получателей на группы по домену, каждая группа не превышает ограничение для домена
+// порядок получателей сохраняется
+func (r *RecipientsLimit) split(recipients []string) [][]string {
+	hostnames := make([]string, 0)
+	groups := make(map[string][]string)
+	for _, recipient := range recipients {
+		hostname := strings.ToLower(recipient[strings.LastIndex(recipient, "@")+1:])
+		if _, ok := groups[hostname]; !ok {
+			hostnames = append(hostnames, hostname)
+		}
+		groups[hostname] = append(groups[hostname], recipient)
+	}
+
+	chunks := make([][]string, 0, len(hostnames))
+	for _, hostname := range hostnames {
+		group := groups[hostname]
+		max := r.maxFor(hostname)
+		for len(group) > max {
+			chunks = append(chunks, group[:max])
+			group = group[max:]
+		}
+		chunks = append(chunks, group)
+	}
+	return chunks
+}
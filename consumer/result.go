@@ -0,0 +1,173 @@
+package consumer
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/boreevyuri/postmanq/common"
+	"github.com/boreevyuri/postmanq/logger"
+)
+
+// ResultStatus итог отправки письма, используется как ключ маршрутизации события с результатом
+type ResultStatus string
+
+const (
+	// SuccessResultStatus письмо отправлено
+	SuccessResultStatus ResultStatus = "success"
+
+	// DelayResultStatus письмо будет отправлено повторно
+	DelayResultStatus ResultStatus = "delay"
+
+	// OverlimitResultStatus превышен лимит отправки, письмо будет отправлено позже
+	OverlimitResultStatus ResultStatus = "overlimit"
+
+	// ErrorResultStatus письмо не отправлено и больше отправляться не будет
+	ErrorResultStatus ResultStatus = "error"
+
+	// RevokeResultStatus отправка письма отменена
+	RevokeResultStatus ResultStatus = "revoke"
+
+	// DuplicateResultStatus письмо с тем же ключом идемпотентности уже обработано, повтор отброшен
+	DuplicateResultStatus ResultStatus = "duplicate"
+)
+
+const (
+	// причина неотправки письма, попытки отправки которого исчерпаны
+	notSendFailureName = "retries"
+)
+
+var (
+	// итоги для результатов отправки письма
+	resultStatuses = map[common.SendEventResult]ResultStatus{
+		common.SuccessSendEventResult:   SuccessResultStatus,
+		common.DelaySendEventResult:     DelayResultStatus,
+		common.OverlimitSendEventResult: OverlimitResultStatus,
+		common.ErrorSendEventResult:     ErrorResultStatus,
+		common.RevokeSendEventResult:    RevokeResultStatus,
+	}
+)
+
+// Result событие с результатом отправки письма
+type Result struct {
+	// итог отправки
+	Status ResultStatus `json:"status"`
+
+	// идентификатор письма
+	MessageID string `json:"messageId"`
+
+	// идентификатор письма, из которого выделено письмо для части получателей
+	ParentID string `json:"parentId,omitempty"`
+
+	// отправитель
+	Envelope string `json:"envelope"`
+
+	// получатель
+	Recipient string `json:"recipient"`
+
+	// почтовый сервер, которому отправлялось письмо
+	MxHostname string `json:"mxHost,omitempty"`
+
+	// ip, с которого отправлялось письмо
+	Address string `json:"outboundIp,omitempty"`
+
+	// код ответа почтового сервиса
+	Code int `json:"smtpCode,omitempty"`
+
+	// текст ответа почтового сервиса
+	Message string `json:"smtpText,omitempty"`
+
+	// номер попытки отправки
+	Attempt int `json:"attempt"`
+
+	// очередь, в которую положено письмо, для повторной отправки или для ошибок
+	Queue string `json:"queue,omitempty"`
+
+	// причина неотправки письма
+	Failure string `json:"failure,omitempty"`
+
+	// дата события
+	Date time.Time `json:"date"`
+}
+
+// создает событие с результатом отправки письма
+// код и текст ответа берутся из попытки, совершенной в рамках события,
+// если попытки не было, например, письмо устарело, - из ошибки письма, которая сбрасывается перед каждой попыткой
+func newResult(result common.SendEventResult, event *common.SendEvent) *Result {
+	message := event.Message
+	res := &Result{
+		Status:    resultStatuses[result],
+		MessageID: message.ID,
+		ParentID:  message.ParentID,
+		Envelope:  message.Envelope,
+		Recipient: message.Recipient,
+		Attempt:   message.TrySendingCount,
+		Date:      time.Now(),
+	}
+	if event.Attempt != nil {
+		res.MxHostname = event.Attempt.MxHostname
+		res.Address = event.Attempt.Address
+		res.Code = event.Attempt.Code
+		res.Message = event.Attempt.Message
+	} else if message.Error != nil {
+		res.Code = message.Error.Code
+		res.Message = message.Error.Message
+	}
+	return res
+}
+
+// публикует событие с результатом отправки письма в точку обмена результатов
+// binding - очередь, в которую было переложено письмо
+// ошибка публикации только логируется, т.к. письмо уже отправлено или переложено в другую очередь
+func (c *Consumer) publishResult(publisher *Publisher, result common.SendEventResult, event *common.SendEvent, binding *Binding) {
+	if c.binding.resultsBinding == nil {
+		return
+	}
+	res := newResult(result, event)
+	if binding != nil {
+		res.Queue = binding.Queue
+		if failureBindingType, ok := c.binding.failureBindingType(binding); ok {
+			// письмо может попасть в очередь для ошибок и после временной ошибки, например, если оно устарело
+			res.Status = ErrorResultStatus
+			res.Failure = failureBindingTypeNames[failureBindingType]
+		} else if binding == c.binding.notSendBinding {
+			// попытки отправки исчерпаны, письмо больше отправляться не будет
+			res.Status = ErrorResultStatus
+			res.Failure = notSendFailureName
+		} else if res.Status == ErrorResultStatus && c.binding.isDelayed(binding) {
+			// для кода ответа указано отдельное расписание, письмо будет отправлено повторно
+			res.Status = DelayResultStatus
+		}
+	}
+	c.publishResultForRecipients(publisher, res, event.Message)
+}
+
+// публикует событие об отброшенном повторе письма
+func (c *Consumer) publishDuplicateResult(publisher *Publisher, message *common.MailMessage) {
+	if c.binding.resultsBinding == nil {
+		return
+	}
+	res := &Result{
+		Status:    DuplicateResultStatus,
+		MessageID: message.ID,
+		ParentID:  message.ParentID,
+		Envelope:  message.Envelope,
+		Date:      time.Now(),
+	}
+	c.publishResultForRecipients(publisher, res, message)
+}
+
+// публикует событие для каждого получателя письма
+func (c *Consumer) publishResultForRecipients(publisher *Publisher, res *Result, message *common.MailMessage) {
+	for _, recipient := range message.AllRecipients() {
+		res.Recipient = recipient
+		body, err := json.Marshal(res)
+		if err == nil {
+			err = publisher.PublishWithKey(c.binding.resultsBinding, string(res.Status), body)
+		}
+		if err == nil {
+			logger.Debug("consumer#%d-%s publish %s result for %s to exchange %s", c.id, message.ID, res.Status, recipient, c.binding.Results)
+		} else {
+			logger.Warn("consumer#%d-%s can't publish %s result for %s to exchange %s, error - %v", c.id, message.ID, res.Status, recipient, c.binding.Results, err)
+		}
+	}
+}
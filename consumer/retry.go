@@ -0,0 +1,130 @@
+package consumer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/boreevyuri/postmanq/common"
+)
+
+var (
+	// расписание повторных отправок по умолчанию
+	defaultRetryDelays = []time.Duration{
+		time.Second,
+		time.Second * 30,
+		time.Minute,
+		time.Minute * 5,
+		time.Minute * 10,
+		time.Minute * 20,
+		time.Minute * 30,
+		time.Minute * 40,
+		time.Minute * 50,
+		time.Hour,
+		time.Hour * 6,
+	}
+)
+
+// RetrySchedule расписание повторных отправок письма
+type RetrySchedule struct {
+	// паузы перед повторными отправками
+	// если попытки не ограничены maxAttempts или maxAge, письмо отправляется повторно столько раз, сколько указано пауз
+	// иначе после исчерпания списка используется последняя пауза
+	Delays []time.Duration `yaml:"delays"`
+
+	// максимальное количество попыток отправки письма, включая первую
+	MaxAttempts int `yaml:"maxAttempts"`
+
+	// максимальное время, в течение которого письмо отправляется повторно, отсчитывается от первого получения письма
+	MaxAge time.Duration `yaml:"maxAge"`
+}
+
+// Retry настройки повторной отправки писем
+type Retry struct {
+	RetrySchedule `yaml:",inline"`
+
+	// расписания для отдельных кодов ответа почтового сервиса
+	// незаполненные поля берутся из общего расписания
+	Codes map[int]*RetrySchedule `yaml:"codes"`
+}
+
+// инициализирует расписание значениями по умолчанию и проверяет паузы
+func (r *Retry) init() error {
+	if len(r.Delays) == 0 {
+		r.Delays = defaultRetryDelays
+	}
+	err := r.RetrySchedule.check()
+	for code, schedule := range r.Codes {
+		if err != nil {
+			break
+		}
+		if len(schedule.Delays) == 0 {
+			schedule.Delays = r.Delays
+		}
+		if schedule.MaxAttempts == 0 {
+			schedule.MaxAttempts = r.MaxAttempts
+		}
+		if schedule.MaxAge == 0 {
+			schedule.MaxAge = r.MaxAge
+		}
+		err = schedule.check()
+		if err != nil {
+			err = fmt.Errorf("code %d: %v", code, err)
+		}
+	}
+	return err
+}
+
+// отдает все паузы, для которых нужны отложенные очереди
+func (r *Retry) durations() []time.Duration {
+	durations := append([]time.Duration{}, r.Delays...)
+	for _, schedule := range r.Codes {
+		durations = append(durations, schedule.Delays...)
+	}
+	return durations
+}
+
+// отдает расписание для письма, учитывая код ответа почтового сервиса
+func (r *Retry) schedule(message *common.MailMessage) *RetrySchedule {
+	if message.Error != nil {
+		if schedule, ok := r.Codes[message.Error.Code]; ok {
+			return schedule
+		}
+	}
+	return &r.RetrySchedule
+}
+
+// сигнализирует, что для кода ответа почтового сервиса указано отдельное расписание
+func (r *Retry) hasCode(code int) bool {
+	_, ok := r.Codes[code]
+	return ok
+}
+
+// проверяет паузы расписания
+func (s *RetrySchedule) check() error {
+	for _, delay := range s.Delays {
+		if delay < time.Second {
+			return fmt.Errorf("retry delay %v should be at least a second", delay)
+		}
+	}
+	return nil
+}
+
+// отдает паузу перед следующей отправкой письма
+// если попытки исчерпаны, возвращается false
+func (s *RetrySchedule) next(message *common.MailMessage) (time.Duration, bool) {
+	step := message.RetryCount
+	if s.MaxAttempts == 0 && s.MaxAge == 0 && step >= len(s.Delays) {
+		return 0, false
+	}
+	if s.MaxAttempts > 0 && step+1 >= s.MaxAttempts {
+		return 0, false
+	}
+	if step >= len(s.Delays) {
+		step = len(s.Delays) - 1
+	}
+	delay := s.Delays[step]
+	if s.MaxAge > 0 && time.Since(message.CreatedDate)+delay > s.MaxAge {
+		return 0, false
+	}
+	return delay, true
+}
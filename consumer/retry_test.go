@@ -0,0 +1,232 @@
+package consumer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/boreevyuri/postmanq/common"
+)
+
+func TestRetryScheduleNext(t *testing.T) {
+	delays := []time.Duration{time.Second, 30 * time.Second, time.Minute}
+	cases := []struct {
+		name       string
+		schedule   RetrySchedule
+		retryCount int
+		age        time.Duration
+		delay      time.Duration
+		ok         bool
+	}{
+		{"first retry", RetrySchedule{Delays: delays}, 0, 0, time.Second, true},
+		{"last delay", RetrySchedule{Delays: delays}, 2, 0, time.Minute, true},
+		{"delays exhausted", RetrySchedule{Delays: delays}, 3, 0, 0, false},
+		{"attempts left", RetrySchedule{Delays: delays, MaxAttempts: 3}, 1, 0, 30 * time.Second, true},
+		{"attempts exhausted", RetrySchedule{Delays: delays, MaxAttempts: 3}, 2, 0, 0, false},
+		{"last delay repeats until attempts exhausted", RetrySchedule{Delays: delays, MaxAttempts: 10}, 7, 0, time.Minute, true},
+		{"last delay repeats until max age", RetrySchedule{Delays: delays, MaxAge: time.Hour}, 20, 30 * time.Minute, time.Minute, true},
+		{"retry would exceed max age", RetrySchedule{Delays: delays, MaxAge: time.Hour}, 20, 59*time.Minute + 30*time.Second, 0, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			message := &common.MailMessage{RetryCount: c.retryCount, CreatedDate: time.Now().Add(-c.age)}
+			delay, ok := c.schedule.next(message)
+			if delay != c.delay || ok != c.ok {
+				t.Errorf("next() = %v, %v, want %v, %v", delay, ok, c.delay, c.ok)
+			}
+		})
+	}
+}
+
+func TestRetrySchedule(t *testing.T) {
+	retry := &Retry{
+		RetrySchedule: RetrySchedule{MaxAttempts: 5},
+		Codes: map[int]*RetrySchedule{
+			452: {Delays: []time.Duration{time.Hour}},
+			552: {Delays: []time.Duration{time.Minute}, MaxAttempts: 2},
+		},
+	}
+	if err := retry.init(); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name        string
+		err         *common.MailError
+		delays      []time.Duration
+		maxAttempts int
+	}{
+		{"without error", nil, defaultRetryDelays, 5},
+		{"code without schedule", &common.MailError{Code: 421}, defaultRetryDelays, 5},
+		{"code inherits max attempts", &common.MailError{Code: 452}, []time.Duration{time.Hour}, 5},
+		{"code overrides max attempts", &common.MailError{Code: 552}, []time.Duration{time.Minute}, 2},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			schedule := retry.schedule(&common.MailMessage{Error: c.err})
+			if len(schedule.Delays) != len(c.delays) || schedule.Delays[0] != c.delays[0] || schedule.MaxAttempts != c.maxAttempts {
+				t.Errorf("schedule() = %v, %d, want %v, %d", schedule.Delays, schedule.MaxAttempts, c.delays, c.maxAttempts)
+			}
+		})
+	}
+}
+
+func TestRetryInit(t *testing.T) {
+	cases := []struct {
+		name  string
+		retry Retry
+		ok    bool
+	}{
+		{"default delays", Retry{}, true},
+		{"delay shorter than second", Retry{RetrySchedule: RetrySchedule{Delays: []time.Duration{time.Millisecond}}}, false},
+		{"code delay shorter than second", Retry{Codes: map[int]*RetrySchedule{452: {Delays: []time.Duration{time.Millisecond}}}}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := c.retry.init()
+			if (err == nil) != c.ok {
+				t.Errorf("init() = %v, want ok %v", err, c.ok)
+			}
+		})
+	}
+}
+
+func TestBindingParkingDelay(t *testing.T) {
+	binding := &Binding{Name: "postmanq"}
+	if err := binding.init(); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		remaining time.Duration
+		delay     time.Duration
+		ok        bool
+	}{
+		{-time.Minute, 0, false},
+		{500 * time.Millisecond, 0, false},
+		{time.Second, time.Second, true},
+		{45 * time.Second, 30 * time.Second, true},
+		{2 * time.Hour, time.Hour, true},
+		{72 * time.Hour, 24 * time.Hour, true},
+	}
+	for _, c := range cases {
+		delay, ok := binding.parkingDelay(c.remaining)
+		if delay != c.delay || ok != c.ok {
+			t.Errorf("parkingDelay(%v) = %v, %v, want %v, %v", c.remaining, delay, ok, c.delay, c.ok)
+		}
+	}
+}
+
+func TestPublishRetryMessage(t *testing.T) {
+	cases := []struct {
+		name      string
+		expiresIn time.Duration
+		retries   int
+		queue     string
+		delay     time.Duration
+	}{
+		{"retry before expiry", time.Hour, 1, "postmanq", 30 * time.Second},
+		{"mail expires before retry", 10 * time.Second, 1, "postmanq.failure.expired", 0},
+		{"retries exhausted", time.Hour, 3, "postmanq.not.send", 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			binding := &Binding{Name: "postmanq", Retry: Retry{RetrySchedule: RetrySchedule{Delays: []time.Duration{time.Second, 30 * time.Second, time.Minute}}}}
+			consumer, publisher, connect := newTestConsumer(t, binding)
+			message := newTestMessage()
+			message.Init()
+			message.RetryCount = c.retries
+			message.ExpiresAt = time.Now().Add(c.expiresIn)
+
+			publishedAt := time.Now()
+			published, err := consumer.publishRetryMessage(publisher, message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			messages := queued(t, connect, c.queue)
+			if len(messages) != 1 {
+				t.Fatalf("queue %s has %d mails, want 1, mail published to %s", c.queue, len(messages), published.Queue)
+			}
+			assertVisibleAfter(t, messages[0], publishedAt, c.delay)
+			if c.delay > 0 && messages[0].message.RetryCount != c.retries+1 {
+				t.Errorf("retry count = %d, want %d", messages[0].message.RetryCount, c.retries+1)
+			}
+			if c.queue == "postmanq.failure.expired" && messages[0].message.Error == nil {
+				t.Error("expired mail has no error")
+			}
+		})
+	}
+}
+
+func TestHandleMessageSendAt(t *testing.T) {
+	cases := []struct {
+		name   string
+		sendIn time.Duration
+		sent   bool
+		delay  time.Duration
+	}{
+		{"without send date", 0, true, 0},
+		{"send date in the past", -time.Hour, true, 0},
+		{"send date sooner than shortest delay", 500 * time.Millisecond, true, 0},
+		{"send date in the future", 2 * time.Hour, false, time.Hour},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sent := make(chan *common.MailMessage, 1)
+			newTestSender(t, func(event *common.SendEvent) {
+				sent <- event.Message
+				sendSuccess(event)
+			})
+			consumer, publisher, connect := newTestConsumer(t, &Binding{Name: "postmanq"})
+			message := newTestMessage()
+			if c.sendIn != 0 {
+				message.SendAt = time.Now().Add(c.sendIn)
+			}
+
+			publishedAt := time.Now()
+			if err := consumer.handleMessage(0, publisher, message); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-sent:
+				if !c.sent {
+					t.Fatal("mail is sent before send date")
+				}
+				if message.TrySendingCount != 1 {
+					t.Errorf("try sending count = %d, want 1", message.TrySendingCount)
+				}
+			default:
+				if c.sent {
+					t.Fatal("mail isn't sent")
+				}
+				messages := queued(t, connect, "postmanq")
+				if len(messages) != 1 {
+					t.Fatalf("queue has %d mails, want 1 parked mail", len(messages))
+				}
+				assertVisibleAfter(t, messages[0], publishedAt, c.delay)
+				// откладывание не считается попыткой отправки
+				if messages[0].message.TrySendingCount != 0 || messages[0].message.RetryCount != 0 {
+					t.Errorf("parked mail has %d attempts and %d retries", messages[0].message.TrySendingCount, messages[0].message.RetryCount)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleMessageExpired(t *testing.T) {
+	newTestSender(t, func(event *common.SendEvent) {
+		t.Error("expired mail is sent")
+		sendSuccess(event)
+	})
+	consumer, publisher, connect := newTestConsumer(t, &Binding{Name: "postmanq"})
+	message := newTestMessage()
+	message.SendAt = time.Now().Add(2 * time.Hour)
+	message.ExpiresAt = time.Now().Add(-time.Minute)
+
+	if err := consumer.handleMessage(0, publisher, message); err != nil {
+		t.Fatal(err)
+	}
+	if messages := queued(t, connect, "postmanq.failure.expired"); len(messages) != 1 {
+		t.Errorf("expired queue has %d mails, want 1", len(messages))
+	}
+	if messages := queued(t, connect, "postmanq"); len(messages) != 0 {
+		t.Errorf("expired mail is parked")
+	}
+}
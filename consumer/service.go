@@ -1,19 +1,28 @@
 package consumer
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/url"
 	"sync"
+	"time"
 
 	"github.com/boreevyuri/postmanq/common"
 	"github.com/boreevyuri/postmanq/logger"
-	"github.com/streadway/amqp"
 	yaml "gopkg.in/yaml.v2"
 )
 
+const (
+	// начальная пауза между попытками переподключения к серверу
+	minReconnectDelay = time.Second
+
+	// максимальная пауза между попытками переподключения к серверу
+	maxReconnectDelay = time.Minute
+)
+
 var (
 	// сервис получения сообщений
-	service common.SendingService
+	service *Service
 
 	// канал для получения событий
 	events = make(chan *common.SendEvent)
@@ -24,20 +33,38 @@ type Service struct {
 	// настройка подписчиков на сообщения
 	Configs []*Config `yaml:"consumers"`
 
+	// хранилище ключей идемпотентности писем
+	Idempotency *Idempotency `yaml:"idempotency"`
+
 	// подключения к очередям
-	connections map[string]*amqp.Connection
+	connections map[string]Connection
 
 	// подписчики на сообщения из очереди
 	consumers map[string][]*Consumer
+
+	// семафор для подключений
+	mutex *sync.Mutex
+
+	// флаг, сигнализирующий, что сервис остановлен и переподключаться не нужно
+	stopped bool
+
+	// публикаторы писем, полученных не из очереди, в качестве ключа используется адрес сервера
+	publishers map[string]*Publisher
+
+	// семафор для публикаторов, публикатор ждет подтверждения брокера, поэтому публикации идут по очереди
+	publisherMutex *sync.Mutex
 }
 
 // Inst создает новый сервис получения сообщений
 func Inst() common.SendingService {
 	if service == nil {
-		service := new(Service)
-		service.connections = make(map[string]*amqp.Connection)
-		service.consumers = make(map[string][]*Consumer)
-		return service
+		service = &Service{
+			connections:    make(map[string]Connection),
+			consumers:      make(map[string][]*Consumer),
+			mutex:          new(sync.Mutex),
+			publishers:     make(map[string]*Publisher),
+			publisherMutex: new(sync.Mutex),
+		}
 	}
 	return service
 }
@@ -48,45 +75,38 @@ func (s *Service) OnInit(event *common.ApplicationEvent) {
 	// получаем настройки
 	err := yaml.Unmarshal(event.Data, s)
 	if err == nil {
+		if s.Idempotency != nil && s.Idempotency.isEnabled() {
+			err = s.Idempotency.init()
+			if err != nil {
+				logger.FailExit("consumer service can't load idempotency keys from %s, error - %v", s.Idempotency.Filename, err)
+			}
+		} else {
+			s.Idempotency = nil
+		}
 		appsCount := 0
 		for _, config := range s.Configs {
-			connect, err := amqp.Dial(config.URI)
+			for _, binding := range config.Bindings {
+				err = binding.init()
+				if err != nil {
+					logger.FailExit("consumer service can't init binding %s, error - %v", binding.Queue, err)
+				}
+			}
+			connect, err := dial(config.URI)
 			if err == nil {
-				channel, err := connect.Channel()
+				// объявляем очереди
+				err = s.declare(connect, config)
 				if err == nil {
 					apps := make([]*Consumer, len(config.Bindings))
 					for i, binding := range config.Bindings {
-						binding.init()
-						// объявляем очередь
-						binding.declare(channel)
-
-						binding.delayedBindings = make(map[common.DelayedBindingType]*Binding)
-						// объявляем отложенные очереди
-						for delayedBindingType, delayedBinding := range delayedBindings {
-							delayedBinding.declareDelayed(binding, channel)
-							binding.delayedBindings[delayedBindingType] = delayedBinding
-						}
-
-						binding.failureBindings = make(map[FailureBindingType]*Binding)
-						for failureBindingType, tplName := range failureBindingTypeTplNames {
-							failureBinding := new(Binding)
-							failureBinding.Exchange = fmt.Sprintf(tplName, binding.Exchange)
-							failureBinding.Queue = fmt.Sprintf(tplName, binding.Queue)
-							failureBinding.Type = binding.Type
-							failureBinding.declare(channel)
-							binding.failureBindings[failureBindingType] = failureBinding
-						}
-
 						appsCount++
-						app := NewConsumer(appsCount, connect, binding)
-						apps[i] = app
+						apps[i] = NewConsumer(appsCount, connect, binding, s.Idempotency)
 					}
 					s.connections[config.URI] = connect
 					s.consumers[config.URI] = apps
 					// слушаем закрытие соединения
 					s.reconnect(connect, config)
 				} else {
-					logger.FailExit("consumer service can't get channel to %s, error - %v", config.URI, err)
+					logger.FailExit("consumer service can't declare bindings on %s, %v", config.URI, err)
 				}
 			} else {
 				logger.FailExit("consumer service can't connect to %s, error - %v", config.URI, err)
@@ -97,33 +117,79 @@ func (s *Service) OnInit(event *common.ApplicationEvent) {
 	}
 }
 
+// объявляет связки получателя, а также их отложенные очереди и очереди для ошибок
+func (s *Service) declare(connect Connection, config *Config) error {
+	channel, err := connect.Channel()
+	if err != nil {
+		return fmt.Errorf("can't get channel, error - %v", err)
+	}
+	defer channel.Close()
+	for _, binding := range config.Bindings {
+		err = binding.declareAll(channel)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // объявляет слушателя закрытия соединения
-func (s *Service) reconnect(connect *amqp.Connection, config *Config) {
-	closeErrors := connect.NotifyClose(make(chan *amqp.Error))
-	go s.notifyCloseError(config, closeErrors)
+func (s *Service) reconnect(connect Connection, config *Config) {
+	go s.notifyCloseError(config, connect.NotifyClose())
 }
 
-// слушает закрытие соединения
-func (s *Service) notifyCloseError(config *Config, closeErrors chan *amqp.Error) {
-	for closeError := range closeErrors {
-		logger.Warn("consumer service close connection %s with error - %v, restart...", config.URI, closeError)
-		connect, err := amqp.Dial(config.URI)
+// слушает закрытие соединения и переподключается к серверу
+// после переподключения заново объявляет очереди и запускает получателей
+func (s *Service) notifyCloseError(config *Config, closeErrors <-chan error) {
+	closeError, ok := <-closeErrors
+	// соединение закрыто самим сервисом
+	if !ok {
+		return
+	}
+	logger.Warn("consumer service lost connection to %s with error - %v, reconnecting...", config.URI, closeError)
+
+	delay := minReconnectDelay
+	for attempt := 1; !s.isStopped(); attempt++ {
+		connect, err := dial(config.URI)
 		if err == nil {
-			s.connections[config.URI] = connect
-			closeErrors = nil
-			if apps, ok := s.consumers[config.URI]; ok {
+			err = s.declare(connect, config)
+			if err == nil {
+				s.mutex.Lock()
+				// сервис мог остановиться и закрыть подключения, пока шло переподключение
+				if s.stopped {
+					s.mutex.Unlock()
+					connect.Close()
+					return
+				}
+				s.connections[config.URI] = connect
+				apps := s.consumers[config.URI]
 				for _, app := range apps {
-					app.connect = connect
+					app.setConnect(connect)
 				}
+				s.mutex.Unlock()
 				s.reconnect(connect, config)
+				s.runConsumers(apps)
+				logger.Info("consumer service reconnected to %s after %d attempts", config.URI, attempt)
+				return
 			}
-			logger.Debug("consumer service reconnect to amqp server %s", config.URI)
-		} else {
-			logger.Warn("consumer service can't reconnect to amqp server %s with error - %v", config.URI, err)
+			connect.Close()
+		}
+		logger.Warn("consumer service can't reconnect to %s, attempt#%d, next attempt in %v, error - %v", config.URI, attempt, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
 		}
 	}
 }
 
+// сигнализирует, что сервис остановлен
+func (s *Service) isStopped() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.stopped
+}
+
 // OnRun запускает сервис
 func (s *Service) OnRun() {
 	logger.Debug("run consumers...")
@@ -135,13 +201,41 @@ func (s *Service) OnRun() {
 // запускает получателей
 func (s *Service) runConsumers(apps []*Consumer) {
 	for _, app := range apps {
-		go app.run()
+		app.run()
 	}
 }
 
 // OnFinish останавливает получателей
+// получатели перестают забирать новые сообщения и ждут результата отправки уже полученных писем
+// письма, которые не успели отправиться до истечения таймаута, возвращаются в очередь при закрытии соединения
 func (s *Service) OnFinish() {
 	logger.Debug("stop consumers...")
+	s.mutex.Lock()
+	s.stopped = true
+	s.mutex.Unlock()
+	for _, apps := range s.consumers {
+		for _, app := range apps {
+			app.stop()
+		}
+	}
+
+	drained := make(chan bool)
+	go func() {
+		for _, apps := range s.consumers {
+			for _, app := range apps {
+				app.group.Wait()
+			}
+		}
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		logger.Info("consumers finished sending mails")
+	case <-time.After(common.App.Timeout().Shutdown):
+		logger.Warn("consumers didn't finish sending mails in %v, return them to queues", common.App.Timeout().Shutdown)
+	}
+
+	s.mutex.Lock()
 	for _, connect := range s.connections {
 		if connect != nil {
 			err := connect.Close()
@@ -150,6 +244,10 @@ func (s *Service) OnFinish() {
 			}
 		}
 	}
+	s.mutex.Unlock()
+	if s.Idempotency != nil {
+		s.Idempotency.close()
+	}
 	close(events)
 }
 
@@ -171,13 +269,13 @@ func (s *Service) OnShowReport() {
 	}
 	group.Add(delta)
 	for _, apps := range s.consumers {
-		go func() {
+		go func(apps []*Consumer) {
 			for _, app := range apps {
 				for i := 0; i < app.binding.Handlers; i++ {
 					go app.consumeFailureMessages(group)
 				}
 			}
-		}()
+		}(apps)
 	}
 	group.Wait()
 	waiter.Stop()
@@ -213,10 +311,60 @@ func (s *Service) OnPublish(event *common.ApplicationEvent) {
 	}
 	group.Add(delta)
 	group.Wait()
-	fmt.Println("done")
 	common.App.Events() <- common.NewApplicationEvent(common.FinishApplicationEventKind)
 }
 
+// PublishMail кладет письмо в точку обмена одной из связок
+// используется сервисами, принимающими письма не из очереди
+// если точка обмена не указана, письмо кладется в точку обмена первой связки
+func (s *Service) PublishMail(exchange string, message *common.MailMessage) error {
+	uri, binding := s.findBindingByExchange(exchange)
+	if binding == nil {
+		return fmt.Errorf("exchange %s isn't declared by consumers", exchange)
+	}
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	s.publisherMutex.Lock()
+	defer s.publisherMutex.Unlock()
+	publisher, ok := s.publishers[uri]
+	if !ok {
+		s.mutex.Lock()
+		connect := s.connections[uri]
+		s.mutex.Unlock()
+		if connect == nil {
+			return fmt.Errorf("consumer service isn't connected to %s", uri)
+		}
+		channel, err := connect.Channel()
+		if err != nil {
+			return err
+		}
+		publisher = newPublisher(channel)
+		s.publishers[uri] = publisher
+	}
+	err = publisher.Publish(binding, body)
+	if err != nil {
+		// канал мог закрыться при потере соединения, при следующей публикации будет создан новый
+		publisher.channel.Close()
+		delete(s.publishers, uri)
+	}
+	return err
+}
+
+// ищет связку по имени точки обмена
+func (s *Service) findBindingByExchange(exchange string) (string, *Binding) {
+	for _, config := range s.Configs {
+		for _, binding := range config.Bindings {
+			if len(exchange) == 0 || binding.Exchange == exchange {
+				return config.URI, binding
+			}
+		}
+	}
+	return "", nil
+}
+
 // Config получатель сообщений из очереди
 type Config struct {
 	URI      string     `yaml:"uri"`
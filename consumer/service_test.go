@@ -0,0 +1,171 @@
+package consumer
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boreevyuri/postmanq/common"
+)
+
+// подключение, закрытие которого сигнализирует тест
+type testConnection struct {
+	Connection
+
+	// ошибки закрытия подключения
+	closeErrors chan error
+
+	// сигнализирует, что подключение закрыто сервисом
+	closed bool
+}
+
+// NotifyClose отдает канал ошибок закрытия подключения
+func (c *testConnection) NotifyClose() <-chan error {
+	return c.closeErrors
+}
+
+// Close закрывает подключение
+func (c *testConnection) Close() error {
+	c.closed = true
+	return c.Connection.Close()
+}
+
+// подставляет подключение к брокеру на время теста
+func stubDial(t *testing.T, stub func(string) (Connection, error)) {
+	previous := dial
+	dial = stub
+	t.Cleanup(func() { dial = previous })
+}
+
+// создает сервис с одним получателем, подключение которого закрывает тест
+func newTestService(t *testing.T) (*Service, *Config, *testConnection) {
+	dir, err := ioutil.TempDir("", "postmanq-service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	binding := &Binding{Name: "postmanq"}
+	if err = binding.init(); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{URI: spoolScheme + "://" + dir, Bindings: []*Binding{binding}}
+	spool, err := dialSpool(config.URI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connect := &testConnection{Connection: spool, closeErrors: make(chan error, 1)}
+	s := &Service{
+		connections: map[string]Connection{config.URI: connect},
+		consumers:   map[string][]*Consumer{config.URI: {NewConsumer(1, connect, binding, nil)}},
+		mutex:       new(sync.Mutex),
+	}
+	t.Cleanup(func() {
+		s.mutex.Lock()
+		s.stopped = true
+		s.mutex.Unlock()
+		for _, app := range s.consumers[config.URI] {
+			app.stop()
+			app.group.Wait()
+		}
+		s.connections[config.URI].Close()
+		connect.Close()
+	})
+	return s, config, connect
+}
+
+// переподключает сервис после закрытия подключения
+func reconnectService(t *testing.T, s *Service, config *Config, connect *testConnection) {
+	done := make(chan struct{})
+	go func() {
+		s.notifyCloseError(config, connect.closeErrors)
+		close(done)
+	}()
+	connect.closeErrors <- errors.New("connection reset by peer")
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("service isn't reconnected")
+	}
+}
+
+func TestNotifyCloseError(t *testing.T) {
+	sent := make(chan struct{}, 1)
+	newTestSender(t, func(event *common.SendEvent) {
+		sendSuccess(event)
+		sent <- struct{}{}
+	})
+	s, config, connect := newTestService(t)
+	attempts := 0
+	stubDial(t, func(uri string) (Connection, error) {
+		attempts++
+		// первая попытка неудачна, следующая идет после паузы
+		if attempts == 1 {
+			return nil, errors.New("connection refused")
+		}
+		return dialSpool(uri)
+	})
+
+	startedAt := time.Now()
+	reconnectService(t, s, config, connect)
+	if attempts != 2 {
+		t.Errorf("service reconnected after %d attempts, want 2", attempts)
+	}
+	if elapsed := time.Since(startedAt); elapsed < minReconnectDelay {
+		t.Errorf("service reconnected after %v, want delay %v", elapsed, minReconnectDelay)
+	}
+	reconnected := s.connections[config.URI]
+	if reconnected == Connection(connect) {
+		t.Fatal("service keeps closed connection")
+	}
+	app := s.consumers[config.URI][0]
+	if app.connect != reconnected {
+		t.Error("consumer doesn't use new connection")
+	}
+
+	// очереди объявлены заново, и получатель забирает из них письма
+	channel, err := reconnected.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer channel.Close()
+	if err = newPublisher(channel).Publish(app.binding, mustMarshal(t, newTestMessage())); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Error("mail isn't consumed after reconnect")
+	}
+}
+
+func TestNotifyCloseErrorStopped(t *testing.T) {
+	newTestSender(t, sendSuccess)
+	s, config, connect := newTestService(t)
+	var dialed *testConnection
+	stubDial(t, func(uri string) (Connection, error) {
+		// сервис останавливается, пока идет переподключение
+		s.mutex.Lock()
+		s.stopped = true
+		s.mutex.Unlock()
+		spool, err := dialSpool(uri)
+		if err != nil {
+			return nil, err
+		}
+		dialed = &testConnection{Connection: spool, closeErrors: make(chan error)}
+		return dialed, nil
+	})
+
+	reconnectService(t, s, config, connect)
+	if dialed == nil || !dialed.closed {
+		t.Error("connection opened after stop isn't closed")
+	}
+	if s.connections[config.URI] != Connection(connect) {
+		t.Error("connection opened after stop replaces service connection")
+	}
+	if app := s.consumers[config.URI][0]; app.connect != Connection(connect) || len(app.channels) != 0 {
+		t.Error("consumer is started after stop")
+	}
+}
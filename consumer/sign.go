@@ -139,6 +139,8 @@ var (
 		},
 		554: ErrorSigns{
 			ErrorSign{TechnicalFailureBindingType, []string{
+				"can't compose mail",
+				"can't render template",
 				"relay access denied",
 				"unresolvable address",
 				"blocked using",
@@ -160,6 +162,11 @@ var (
 				"refused",
 			}},
 		},
+		556: ErrorSigns{
+			ErrorSign{RecipientFailureBindingType, []string{
+				"does not accept mail",
+			}},
+		},
 		571: ErrorSigns{
 			ErrorSign{ConnectionFailureBindingType, []string{
 				"relay",
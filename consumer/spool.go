@@ -0,0 +1,466 @@
+package consumer
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// схема адреса файловой очереди, например spool:///var/spool/postmanq
+	spoolScheme = "spool"
+
+	// каталог для записи сообщений, из него сообщение переносится в очередь уже записанным на диск
+	spoolTmpDir = ".tmp"
+
+	// каталог очереди для сообщений, выданных получателям, но еще не подтвержденных
+	spoolLeasedDir = ".leased"
+
+	// пауза между проверками пустой очереди
+	spoolPollInterval = 200 * time.Millisecond
+)
+
+var (
+	// номер сообщения, делает имена файлов уникальными в рамках процесса
+	spoolSeq uint64
+
+	// каталоги, открытые процессом, при первом открытии каталога освобождаются сообщения,
+	// выданные получателям завершившихся процессов
+	openedSpools = make(map[string]bool)
+
+	// семафор для открытых каталогов
+	openedSpoolsMutex = new(sync.Mutex)
+)
+
+// файловая очередь
+// каждая очередь - это каталог, каждое сообщение - это файл,
+// имя файла начинается с даты, с которой сообщение становится доступным получателям,
+// поэтому отложенные очереди не нужны, сообщение сразу кладется в очередь, в которую оно вернется по истечении паузы
+// ключи маршрутизации не поддерживаются, сообщение получают все очереди, связанные с точкой обмена
+type spoolConnection struct {
+	// каталог с очередями
+	dir string
+
+	// очереди, связанные с точками обмена
+	exchanges map[string][]string
+
+	// аргументы очередей
+	queues map[string]*spoolQueue
+
+	// семафор для точек обмена и очередей
+	mutex *sync.RWMutex
+
+	// закрывается при закрытии подключения
+	closed chan error
+}
+
+// очередь файловой очереди
+type spoolQueue struct {
+	// пауза, после которой сообщение перекладывается в точку обмена deadLetterExchange
+	ttl time.Duration
+
+	// точка обмена, в которую перекладываются сообщения по истечении паузы
+	deadLetterExchange string
+}
+
+// открывает файловую очередь
+func dialSpool(uri string) (Connection, error) {
+	parsedURI, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Clean(parsedURI.Path)
+	err = os.MkdirAll(filepath.Join(dir, spoolTmpDir), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	openedSpoolsMutex.Lock()
+	defer openedSpoolsMutex.Unlock()
+	if !openedSpools[dir] {
+		err = recoverSpool(dir)
+		if err != nil {
+			return nil, err
+		}
+		openedSpools[dir] = true
+	}
+	return &spoolConnection{
+		dir:       dir,
+		exchanges: make(map[string][]string),
+		queues:    make(map[string]*spoolQueue),
+		mutex:     new(sync.RWMutex),
+		closed:    make(chan error),
+	}, nil
+}
+
+// возвращает в очереди сообщения, выданные получателям завершившихся процессов
+// процесс с тем же идентификатором, что и текущий, тоже считается завершившимся, т.к. каталог открывается впервые
+func recoverSpool(dir string) error {
+	leasedDirs, err := filepath.Glob(filepath.Join(dir, "*", spoolLeasedDir, "*"))
+	if err != nil {
+		return err
+	}
+	for _, leasedDir := range leasedDirs {
+		pid, err := strconv.Atoi(filepath.Base(leasedDir))
+		if err != nil || pid != os.Getpid() && isProcessAlive(pid) {
+			continue
+		}
+		queueDir := filepath.Dir(filepath.Dir(leasedDir))
+		names, err := readNames(leasedDir)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			err = os.Rename(filepath.Join(leasedDir, name), filepath.Join(queueDir, name))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// сигнализирует, что процесс работает
+func isProcessAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// отдает отсортированные имена файлов каталога
+func readNames(dir string) ([]string, error) {
+	file, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	names, err := file.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Channel открывает канал
+func (c *spoolConnection) Channel() (Channel, error) {
+	return &spoolChannel{
+		connect:   c,
+		leasedDir: strconv.Itoa(os.Getpid()),
+		leased:    make(map[string]string),
+		consumers: make(map[string]chan bool),
+		mutex:     new(sync.Mutex),
+	}, nil
+}
+
+// NotifyClose отдает канал, который закрывается при закрытии подключения
+// файловая очередь не может потерять подключение, поэтому ошибок в канале не бывает
+func (c *spoolConnection) NotifyClose() <-chan error {
+	return c.closed
+}
+
+// Close закрывает подключение
+func (c *spoolConnection) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+	return nil
+}
+
+// отдает каталог очереди
+func (c *spoolConnection) queueDir(queue string) string {
+	return filepath.Join(c.dir, queue)
+}
+
+// канал файловой очереди
+type spoolChannel struct {
+	connect *spoolConnection
+
+	// имя каталога для выданных сообщений
+	leasedDir string
+
+	// выданные, но еще не подтвержденные сообщения, в качестве ключа используется путь к выданному сообщению,
+	// в качестве значения - путь в очереди
+	leased map[string]string
+
+	// подписки, в качестве ключа используется тег подписчика
+	consumers map[string]chan bool
+
+	// семафор для выданных сообщений и подписок
+	mutex *sync.Mutex
+}
+
+// Declare создает каталог очереди и связывает очередь с точкой обмена
+func (c *spoolChannel) Declare(binding *Binding) error {
+	if strings.ContainsAny(binding.Queue, `/\`) || strings.HasPrefix(binding.Queue, ".") || len(binding.Queue) == 0 {
+		return fmt.Errorf("can't declare queue %s, queue name should be a file name", binding.Queue)
+	}
+	err := os.MkdirAll(filepath.Join(c.connect.queueDir(binding.Queue), spoolLeasedDir, c.leasedDir), 0755)
+	if err != nil {
+		return fmt.Errorf("can't declare queue %s, error - %v", binding.Queue, err)
+	}
+
+	queue := new(spoolQueue)
+	if ttl, ok := binding.QueueArgs["x-message-ttl"].(int64); ok {
+		queue.ttl = time.Duration(ttl) * time.Millisecond
+	}
+	if deadLetterExchange, ok := binding.QueueArgs["x-dead-letter-exchange"].(string); ok {
+		queue.deadLetterExchange = deadLetterExchange
+	}
+
+	c.connect.mutex.Lock()
+	defer c.connect.mutex.Unlock()
+	c.connect.queues[binding.Queue] = queue
+	for _, name := range c.connect.exchanges[binding.Exchange] {
+		if name == binding.Queue {
+			return nil
+		}
+	}
+	c.connect.exchanges[binding.Exchange] = append(c.connect.exchanges[binding.Exchange], binding.Queue)
+	return nil
+}
+
+// DeclareExchange объявляет точку обмена
+func (c *spoolChannel) DeclareExchange(binding *Binding) error {
+	c.connect.mutex.Lock()
+	defer c.connect.mutex.Unlock()
+	if _, ok := c.connect.exchanges[binding.Exchange]; !ok {
+		c.connect.exchanges[binding.Exchange] = nil
+	}
+	return nil
+}
+
+// Consume подписывается на сообщения из очереди
+// сообщения выдаются по одному, поэтому prefetchCount не используется
+func (c *spoolChannel) Consume(queue, tag string, prefetchCount int) (<-chan Delivery, error) {
+	cancel := make(chan bool)
+	c.mutex.Lock()
+	if _, ok := c.consumers[tag]; ok {
+		c.mutex.Unlock()
+		return nil, fmt.Errorf("consumer %s already exists", tag)
+	}
+	c.consumers[tag] = cancel
+	c.mutex.Unlock()
+
+	deliveries := make(chan Delivery)
+	go func() {
+		defer close(deliveries)
+		for {
+			delivery, ok, err := c.Get(queue)
+			if err == nil && ok {
+				select {
+				case deliveries <- delivery:
+					continue
+				case <-cancel:
+					delivery.Nack(true)
+					return
+				case <-c.connect.closed:
+					delivery.Nack(true)
+					return
+				}
+			}
+			select {
+			case <-time.After(spoolPollInterval):
+			case <-cancel:
+				return
+			case <-c.connect.closed:
+				return
+			}
+		}
+	}()
+	return deliveries, nil
+}
+
+// Cancel отменяет подписку
+func (c *spoolChannel) Cancel(tag string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	cancel, ok := c.consumers[tag]
+	if !ok {
+		return fmt.Errorf("consumer %s doesn't exist", tag)
+	}
+	close(cancel)
+	delete(c.consumers, tag)
+	return nil
+}
+
+// Get забирает первое доступное сообщение из очереди
+// сообщение переносится в каталог выданных сообщений, поэтому его не заберет другой получатель, даже из другого процесса
+func (c *spoolChannel) Get(queue string) (Delivery, bool, error) {
+	queueDir := c.connect.queueDir(queue)
+	names, err := readNames(queueDir)
+	if err != nil {
+		return nil, false, err
+	}
+	now := time.Now().UnixNano()
+	for _, name := range names {
+		visibleAt, ok := parseSpoolName(name)
+		if !ok {
+			continue
+		}
+		// имена отсортированы по дате, остальные сообщения тоже еще недоступны
+		if visibleAt > now {
+			break
+		}
+		path := filepath.Join(queueDir, name)
+		leasedPath := filepath.Join(queueDir, spoolLeasedDir, c.leasedDir, name)
+		err = os.Rename(path, leasedPath)
+		if err != nil {
+			// сообщение забрал другой получатель
+			continue
+		}
+		body, err := ioutil.ReadFile(leasedPath)
+		if err != nil {
+			os.Rename(leasedPath, path)
+			return nil, false, err
+		}
+		c.mutex.Lock()
+		c.leased[leasedPath] = path
+		c.mutex.Unlock()
+		return &spoolDelivery{channel: c, path: leasedPath, body: body}, true, nil
+	}
+	return nil, false, nil
+}
+
+// Publish кладет сообщение во все очереди, связанные с точкой обмена
+// если у очереди указаны пауза и точка обмена для истекших сообщений,
+// сообщение сразу кладется в очереди этой точки обмена и становится доступным по истечении паузы
+func (c *spoolChannel) Publish(exchange, key string, body []byte) error {
+	c.connect.mutex.RLock()
+	defer c.connect.mutex.RUnlock()
+	queues, ok := c.connect.exchanges[exchange]
+	if !ok {
+		return fmt.Errorf("exchange %s isn't declared", exchange)
+	}
+	now := time.Now()
+	for _, name := range queues {
+		visibleAt := now
+		if queue := c.connect.queues[name]; queue != nil && queue.ttl > 0 && len(queue.deadLetterExchange) > 0 {
+			visibleAt = now.Add(queue.ttl)
+			for _, deadLetterQueue := range c.connect.exchanges[queue.deadLetterExchange] {
+				err := c.write(deadLetterQueue, visibleAt, body)
+				if err != nil {
+					return err
+				}
+			}
+		} else {
+			err := c.write(name, visibleAt, body)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// записывает сообщение на диск и переносит его в очередь
+func (c *spoolChannel) write(queue string, visibleAt time.Time, body []byte) error {
+	name := fmt.Sprintf("%020d-%d-%d", visibleAt.UnixNano(), os.Getpid(), atomic.AddUint64(&spoolSeq, 1))
+	tmpPath := filepath.Join(c.connect.dir, spoolTmpDir, name)
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(body)
+	if err == nil {
+		// сообщение должно сохраниться при перезапуске сервера
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, filepath.Join(c.connect.queueDir(queue), name))
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+// Close отменяет подписки и возвращает в очереди неподтвержденные сообщения
+func (c *spoolChannel) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for tag, cancel := range c.consumers {
+		close(cancel)
+		delete(c.consumers, tag)
+	}
+	var err error
+	for leasedPath, path := range c.leased {
+		if e := os.Rename(leasedPath, path); e != nil {
+			err = e
+		}
+		delete(c.leased, leasedPath)
+	}
+	return err
+}
+
+// получает дату, с которой сообщение доступно получателям, из имени файла
+func parseSpoolName(name string) (int64, bool) {
+	i := strings.IndexByte(name, '-')
+	if i <= 0 {
+		return 0, false
+	}
+	visibleAt, err := strconv.ParseInt(name[:i], 10, 64)
+	return visibleAt, err == nil
+}
+
+// сообщение файловой очереди
+type spoolDelivery struct {
+	channel *spoolChannel
+
+	// путь к выданному сообщению
+	path string
+
+	// тело сообщения
+	body []byte
+}
+
+// Body тело сообщения
+func (d *spoolDelivery) Body() []byte {
+	return d.body
+}
+
+// Ack удаляет сообщение
+func (d *spoolDelivery) Ack() error {
+	if _, ok := d.release(); !ok {
+		return errors.New("delivery already acknowledged")
+	}
+	return os.Remove(d.path)
+}
+
+// Nack возвращает сообщение в очередь или удаляет его
+func (d *spoolDelivery) Nack(requeue bool) error {
+	path, ok := d.release()
+	if !ok {
+		return errors.New("delivery already acknowledged")
+	}
+	if requeue {
+		return os.Rename(d.path, path)
+	}
+	return os.Remove(d.path)
+}
+
+// забирает сообщение из выданных каналом, возвращает путь сообщения в очереди
+func (d *spoolDelivery) release() (string, bool) {
+	d.channel.mutex.Lock()
+	defer d.channel.mutex.Unlock()
+	path, ok := d.channel.leased[d.path]
+	delete(d.channel.leased, d.path)
+	return path, ok
+}
@@ -0,0 +1,233 @@
+package consumer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// открывает файловую очередь во временном каталоге и объявляет связки
+func newTestSpool(t *testing.T, bindings ...*Binding) (*spoolConnection, Channel) {
+	dir, err := ioutil.TempDir("", "postmanq-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	connect, err := dialSpool(spoolScheme + "://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { connect.Close() })
+	channel, err := connect.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { channel.Close() })
+	for _, binding := range bindings {
+		if err = channel.Declare(binding); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return connect.(*spoolConnection), channel
+}
+
+// забирает сообщение из очереди, сообщение должно быть
+func mustGet(t *testing.T, channel Channel, queue string) Delivery {
+	t.Helper()
+	delivery, ok, err := channel.Get(queue)
+	if err != nil || !ok {
+		t.Fatalf("Get(%s) = %v, %v, want delivery", queue, ok, err)
+	}
+	return delivery
+}
+
+// проверяет, что очередь пуста
+func assertEmpty(t *testing.T, channel Channel, queue string) {
+	t.Helper()
+	_, ok, err := channel.Get(queue)
+	if err != nil || ok {
+		t.Fatalf("Get(%s) = %v, %v, want empty queue", queue, ok, err)
+	}
+}
+
+func TestSpoolPublishGet(t *testing.T) {
+	_, channel := newTestSpool(t,
+		&Binding{Exchange: "mail", Queue: "first"},
+		&Binding{Exchange: "mail", Queue: "second"},
+	)
+	for _, body := range []string{"one", "two"} {
+		if err := channel.Publish("mail", "", []byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// сообщение получают все очереди точки обмена в порядке публикации
+	for _, queue := range []string{"first", "second"} {
+		for _, body := range []string{"one", "two"} {
+			delivery := mustGet(t, channel, queue)
+			if string(delivery.Body()) != body {
+				t.Errorf("queue %s body = %s, want %s", queue, delivery.Body(), body)
+			}
+			if err := delivery.Ack(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		assertEmpty(t, channel, queue)
+	}
+
+	if err := channel.Publish("unknown", "", []byte("one")); err == nil {
+		t.Error("publish to undeclared exchange succeeded")
+	}
+}
+
+func TestSpoolAckNack(t *testing.T) {
+	cases := []struct {
+		name     string
+		settle   func(Delivery) error
+		requeued bool
+	}{
+		{"ack", func(delivery Delivery) error { return delivery.Ack() }, false},
+		{"nack with requeue", func(delivery Delivery) error { return delivery.Nack(true) }, true},
+		{"nack without requeue", func(delivery Delivery) error { return delivery.Nack(false) }, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, channel := newTestSpool(t, &Binding{Exchange: "mail", Queue: "mail"})
+			if err := channel.Publish("mail", "", []byte("body")); err != nil {
+				t.Fatal(err)
+			}
+			delivery := mustGet(t, channel, "mail")
+			// выданное сообщение не достается другим получателям
+			assertEmpty(t, channel, "mail")
+			if err := c.settle(delivery); err != nil {
+				t.Fatal(err)
+			}
+			if err := delivery.Ack(); err == nil {
+				t.Error("delivery is acknowledged twice")
+			}
+			if c.requeued {
+				mustGet(t, channel, "mail").Ack()
+			} else {
+				assertEmpty(t, channel, "mail")
+			}
+		})
+	}
+}
+
+func TestSpoolCloseRequeues(t *testing.T) {
+	connect, channel := newTestSpool(t, &Binding{Exchange: "mail", Queue: "mail"})
+	if err := channel.Publish("mail", "", []byte("body")); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, channel, "mail")
+	if err := channel.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := connect.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	delivery := mustGet(t, other, "mail")
+	if string(delivery.Body()) != "body" {
+		t.Errorf("body = %s, want body", delivery.Body())
+	}
+}
+
+func TestSpoolConsumeCancel(t *testing.T) {
+	_, channel := newTestSpool(t, &Binding{Exchange: "mail", Queue: "mail"})
+	deliveries, err := channel.Consume("mail", "tag", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = channel.Consume("mail", "tag", 1); err == nil {
+		t.Error("consumer with the same tag is created twice")
+	}
+	if err = channel.Publish("mail", "", []byte("body")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case delivery := <-deliveries:
+		if string(delivery.Body()) != "body" {
+			t.Errorf("body = %s, want body", delivery.Body())
+		}
+		delivery.Ack()
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery isn't consumed")
+	}
+
+	if err = channel.Cancel("tag"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case _, ok := <-deliveries:
+		if ok {
+			t.Error("delivery is consumed after cancel")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("deliveries aren't closed after cancel")
+	}
+}
+
+func TestSpoolDeadLetter(t *testing.T) {
+	_, channel := newTestSpool(t,
+		&Binding{Exchange: "mail", Queue: "mail"},
+		&Binding{
+			Exchange: "mail.dlx",
+			Queue:    "mail.dlx",
+			QueueArgs: map[string]interface{}{
+				"x-message-ttl":          int64(200),
+				"x-dead-letter-exchange": "mail",
+			},
+		},
+	)
+	if err := channel.Publish("mail.dlx", "", []byte("body")); err != nil {
+		t.Fatal(err)
+	}
+	// сообщение сразу лежит в очереди точки обмена для истекших сообщений, но доступно только по истечении паузы
+	assertEmpty(t, channel, "mail.dlx")
+	assertEmpty(t, channel, "mail")
+	time.Sleep(300 * time.Millisecond)
+	mustGet(t, channel, "mail").Ack()
+}
+
+func TestSpoolRecover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "postmanq-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// сообщение, выданное этим же процессом до перезапуска
+	leasedDir := filepath.Join(dir, "mail", spoolLeasedDir, strconv.Itoa(os.Getpid()))
+	if err = os.MkdirAll(leasedDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	name := strconv.FormatInt(time.Now().UnixNano(), 10) + "-1-1"
+	if err = ioutil.WriteFile(filepath.Join(leasedDir, name), []byte("body"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	connect, err := dialSpool(spoolScheme + "://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connect.Close()
+	channel, err := connect.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer channel.Close()
+	mustGet(t, channel, "mail").Ack()
+}
+
+func TestSpoolDeclareInvalidQueue(t *testing.T) {
+	_, channel := newTestSpool(t)
+	for _, queue := range []string{"", ".tmp", "../mail", "mail/dlx"} {
+		if err := channel.Declare(&Binding{Exchange: "mail", Queue: queue}); err == nil {
+			t.Errorf("queue %q is declared", queue)
+		}
+	}
+}
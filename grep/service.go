@@ -18,7 +18,7 @@ var (
 	service *Service
 
 	// регулярное выражение, по которому находим начало отправки
-	mailIDRegex = regexp.MustCompile(`mail#((\d)+)+`)
+	mailIDRegex = regexp.MustCompile(`mail#([\da-f\-]+)`)
 )
 
 // Service сервис ищущий сообщения в логе об отправке письма
@@ -87,7 +87,7 @@ func (s *Service) OnGrep(event *common.ApplicationEvent) {
 			if mailID == "" {
 				if strings.Contains(line, expr) {
 					results := mailIDRegex.FindStringSubmatch(line)
-					if len(results) == 3 {
+					if len(results) == 2 {
 						mailID = results[1]
 
 						successExpr = fmt.Sprintf("%s success send", mailID)
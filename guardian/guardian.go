@@ -28,16 +28,16 @@ func (g *Guardian) run() {
 
 // блокирует отправку на указанные почтовые сервисы
 func (g *Guardian) guard(event *common.SendEvent) {
-	logger.Info("guardian#%d-%d check mail", g.id, event.Message.ID)
+	logger.Info("guardian#%d-%s check mail", g.id, event.Message.ID)
 	hostnameTo := event.Message.HostnameTo
 	i := sort.Search(service.hostnameLen, func(i int) bool {
 		return service.Hostnames[i] == hostnameTo
 	})
 	if i < service.hostnameLen && service.Hostnames[i] == hostnameTo {
-		logger.Info("guardian#%d-%d detect postal worker - %s, revoke sending mail", g.id, event.Message.ID, hostnameTo)
+		logger.Info("guardian#%d-%s detect postal worker - %s, revoke sending mail", g.id, event.Message.ID, hostnameTo)
 		event.Result <- common.RevokeSendEventResult
 	} else {
-		logger.Debug("guardian#%d-%d does not detected forbidden domain, continue sending mail", g.id, event.Message.ID)
+		logger.Debug("guardian#%d-%s does not detected forbidden domain, continue sending mail", g.id, event.Message.ID)
 		event.Iterator.Next().(common.SendingService).Events() <- event
 	}
 }
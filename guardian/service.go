@@ -60,7 +60,6 @@ func (s *Service) Events() chan *common.SendEvent {
 	return events
 }
 
-// OnFinish завершает работу сервиса соединений
-func (s *Service) OnFinish() {
-	close(events)
-}
+// OnFinish завершает работу сервиса блокировок
+// канал событий остается открытым, в него еще могут прийти письма, не успевшие отправиться до остановки
+func (s *Service) OnFinish() {}
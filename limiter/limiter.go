@@ -29,19 +29,19 @@ func (l *Limiter) run() {
 // проверяет количество отправленных писем почтовому сервису
 // если количество превышено, отправляет письмо в отложенную очередь
 func (l *Limiter) check(event *common.SendEvent) {
-	logger.Info("limiter#%d-%d limit check for %s", l.id, event.Message.ID, event.Message.HostnameTo)
+	logger.Info("limiter#%d-%s limit check for %s", l.id, event.Message.ID, event.Message.HostnameTo)
 	// пытаемся найти ограничения для почтового сервиса
 	if limit, ok := service.Limits[event.Message.HostnameTo]; ok {
-		logger.Info("limiter#%d-%d limit FOUND for %s", l.id, event.Message.ID, event.Message.HostnameTo)
+		logger.Info("limiter#%d-%s limit FOUND for %s", l.id, event.Message.ID, event.Message.HostnameTo)
 		// если оно нашлось, проверяем, что отправка нового письма происходит в тот промежуток времени,
 		// в который нам необходимо следить за ограничениями
-		if limit.isValidDuration(event.Message.CreatedDate) {
+		if limit.isValidDuration(event.CreateDate) {
 			atomic.AddInt32(&limit.currentValue, 1)
 			currentValue := atomic.LoadInt32(&limit.currentValue)
-			logger.Debug("limiter#%d-%d detect current value %d, const value %d", l.id, event.Message.ID, currentValue, limit.Value)
+			logger.Debug("limiter#%d-%s detect current value %d, const value %d", l.id, event.Message.ID, currentValue, limit.Value)
 			// если ограничение превышено
 			if currentValue > limit.Value {
-				logger.Debug("limiter#%d-%d current value is exceeded for %s", l.id, event.Message.ID, event.Message.HostnameTo)
+				logger.Debug("limiter#%d-%s current value is exceeded for %s", l.id, event.Message.ID, event.Message.HostnameTo)
 				// определяем очередь, в которое переложем письмо
 				event.Message.BindingType = limit.bindingType
 				// говорим получателю, что у нас превышение ограничения,
@@ -50,10 +50,10 @@ func (l *Limiter) check(event *common.SendEvent) {
 				return
 			}
 		} else {
-			logger.Debug("limiter#%d-%d duration great then %v", l.id, event.Message.ID, limit.duration)
+			logger.Debug("limiter#%d-%s duration great then %v", l.id, event.Message.ID, limit.duration)
 		}
 	} else {
-		logger.Info("limiter#%d-%d limit not found for %s", l.id, event.Message.ID, event.Message.HostnameTo)
+		logger.Info("limiter#%d-%s limit not found for %s", l.id, event.Message.ID, event.Message.HostnameTo)
 	}
 	event.Iterator.Next().(common.SendingService).Events() <- event
 }
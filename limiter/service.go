@@ -70,7 +70,6 @@ func (s *Service) Events() chan *common.SendEvent {
 	return events
 }
 
-// OnFinish завершает работу сервиса соединений
-func (s *Service) OnFinish() {
-	close(events)
-}
+// OnFinish завершает работу сервиса ограничений
+// ограничители завершатся вместе с приложением
+func (s *Service) OnFinish() {}
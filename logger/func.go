@@ -3,13 +3,14 @@ package logger
 import (
 	"fmt"
 	"runtime/debug"
+	"sync/atomic"
+	"time"
 
 	"github.com/boreevyuri/postmanq/common"
 )
 
 // log посылает сервису логирования запись для логирования произвольного уровня
 func log(message string, necessaryLevel Level, args ...interface{}) {
-	defer func() { recover() }()
 	// если уровень записи не ниже уровня сервиса логирования
 	// запись посылается сервису
 	if level <= necessaryLevel {
@@ -18,7 +19,28 @@ func log(message string, necessaryLevel Level, args ...interface{}) {
 		if necessaryLevel > InfoLevel && necessaryLevel == DebugLevel {
 			message = fmt.Sprint(message, "\n", string(debug.Stack()))
 		}
-		messages <- NewMessage(necessaryLevel, message, args...)
+		send(NewMessage(necessaryLevel, message, args...))
+	}
+}
+
+// посылает запись писателям логов и учитывает ее, пока она не будет записана
+func send(message *Message) {
+	atomic.AddInt64(&pending, 1)
+	defer func() {
+		// канал логирования закрыт при повторной инициализации сервиса, запись теряется
+		if recover() != nil {
+			atomic.AddInt64(&pending, -1)
+		}
+	}()
+	messages <- message
+}
+
+// Flush дожидается, пока писатели запишут все полученные записи, но не дольше timeout
+// вызывается перед завершением приложения, чтобы не потерять последние записи
+func Flush(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&pending) > 0 && time.Now().Before(deadline) {
+		time.Sleep(flushInterval)
 	}
 }
 
@@ -30,7 +52,9 @@ func Err(message string, args ...interface{}) {
 // FailExit пишет произвольную ошибку в лог и завершает программу
 func FailExit(message string, args ...interface{}) {
 	Err(message, args...)
-	common.App.Events() <- common.NewApplicationEvent(common.FinishApplicationEventKind)
+	event := common.NewApplicationEvent(common.FinishApplicationEventKind)
+	event.ExitCode = common.FailureExitCode
+	common.App.Events() <- event
 }
 
 // FailExitWithErr пишет системную ошибку в лог и завершает программу
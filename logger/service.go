@@ -1,6 +1,8 @@
 package logger
 
 import (
+	"time"
+
 	"github.com/boreevyuri/postmanq/common"
 	yaml "gopkg.in/yaml.v2"
 )
@@ -43,6 +45,14 @@ var (
 	writers  = make(Writers, common.DefaultWorkersCount)
 	level    = WarningLevel
 	service  *Service
+
+	// количество записей, отправленных писателям, но еще не записанных
+	pending int64
+)
+
+const (
+	// пауза между проверками записанных логов при завершении приложения
+	flushInterval = 10 * time.Millisecond
 )
 
 // Message запись логирования
@@ -99,7 +109,7 @@ func Inst() common.SendingService {
 func (s *Service) OnInit(event *common.ApplicationEvent) {
 	err := yaml.Unmarshal(event.Data, s)
 	if err == nil {
-		s.OnFinish()
+		close(messages)
 		// устанавливаем уровень логирования
 		if existsLevel, ok := logLevelByName[s.LevelName]; ok {
 			level = existsLevel
@@ -121,7 +131,6 @@ func (s *Service) Events() chan *common.SendEvent {
 	return nil
 }
 
-// OnFinish закрывает канал логирования
-func (s *Service) OnFinish() {
-	close(messages)
-}
+// OnFinish не закрывает канал логирования, чтобы остальные сервисы могли записать в лог свою остановку
+// писатели логов завершатся вместе с приложением
+func (s *Service) OnFinish() {}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"time"
 
 	"github.com/boreevyuri/postmanq/common"
@@ -78,6 +79,7 @@ func (w Writers) write() {
 func (w *Writers) listenMessages(writer Writer) {
 	for message := range messages {
 		w.writeMessage(writer, message, time.Now().Format(time.StampMicro))
+		atomic.AddInt64(&pending, -1)
 	}
 }
 
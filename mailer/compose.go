@@ -0,0 +1,237 @@
+package mailer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boreevyuri/postmanq/common"
+)
+
+const (
+	// максимальная длина строки base64 в теле письма
+	base64LineLength = 76
+)
+
+// часть письма
+type part struct {
+	// заголовки части
+	header textproto.MIMEHeader
+
+	// закодированное содержимое части
+	body []byte
+}
+
+// собирает тело письма из содержимого
+// тело состоит из заголовков письма и дерева частей:
+// multipart/mixed с вложениями, внутри multipart/related с картинками, внутри multipart/alternative с текстом и HTML
+func compose(message *common.MailMessage) (string, error) {
+	content := message.MailContent
+
+	body, err := composeBody(content)
+	if err != nil {
+		return "", err
+	}
+
+	from := content.From
+	if len(from) == 0 {
+		from = message.Envelope
+	}
+	fromAddress, err := mail.ParseAddress(from)
+	if err != nil {
+		return "", err
+	}
+	to := content.To
+	if len(to) == 0 {
+		to = message.AllRecipients()
+	}
+	toAddresses, err := formatAddresses(strings.Join(to, ", "))
+	if err != nil {
+		return "", err
+	}
+
+	headers := map[string]string{
+		"Date":       time.Now().Format(time.RFC1123Z),
+		"Message-Id": fmt.Sprintf("<%s@%s>", message.ID, message.HostnameFrom),
+	}
+	for name, value := range content.Headers {
+		if common.IsAddressHeader(name) {
+			value, err = formatAddresses(value)
+			if err != nil {
+				return "", err
+			}
+		} else {
+			value = encodeHeader(value)
+		}
+		headers[textproto.CanonicalMIMEHeaderKey(name)] = value
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := new(bytes.Buffer)
+	writeHeader(buf, "From", fromAddress.String())
+	writeHeader(buf, "To", toAddresses)
+	if len(content.Subject) > 0 {
+		writeHeader(buf, "Subject", encodeHeader(content.Subject))
+	}
+	for _, name := range names {
+		writeHeader(buf, name, headers[name])
+	}
+	writeHeader(buf, "MIME-Version", "1.0")
+	writeHeader(buf, "Content-Type", body.header.Get("Content-Type"))
+	if encoding := body.header.Get("Content-Transfer-Encoding"); len(encoding) > 0 {
+		writeHeader(buf, "Content-Transfer-Encoding", encoding)
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body.body)
+	return buf.String(), nil
+}
+
+// собирает дерево частей письма
+func composeBody(content *common.MailContent) (*part, error) {
+	var body *part
+	var err error
+	switch {
+	case len(content.Text) > 0 && len(content.HTML) > 0:
+		body, err = multipartPart("alternative", textPart("text/plain", content.Text), textPart("text/html", content.HTML))
+	case len(content.HTML) > 0:
+		body = textPart("text/html", content.HTML)
+	default:
+		body = textPart("text/plain", content.Text)
+	}
+
+	if err == nil && len(content.Inline) > 0 {
+		parts := []*part{body}
+		for _, attachment := range content.Inline {
+			parts = append(parts, attachmentPart(attachment, "inline"))
+		}
+		body, err = multipartPart("related", parts...)
+	}
+
+	if err == nil && len(content.Attachments) > 0 {
+		parts := []*part{body}
+		for _, attachment := range content.Attachments {
+			parts = append(parts, attachmentPart(attachment, "attachment"))
+		}
+		body, err = multipartPart("mixed", parts...)
+	}
+	return body, err
+}
+
+// создает текстовую часть в quoted-printable
+func textPart(contentType, text string) *part {
+	buf := new(bytes.Buffer)
+	writer := quotedprintable.NewWriter(buf)
+	writer.Write([]byte(text))
+	writer.Close()
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", contentType+"; charset=utf-8")
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+	return &part{header, buf.Bytes()}
+}
+
+// создает часть с файлом в base64
+func attachmentPart(attachment *common.MailAttachment, disposition string) *part {
+	contentType := attachment.ContentType
+	if len(contentType) == 0 {
+		contentType = mime.TypeByExtension(filepath.Ext(attachment.Filename))
+	}
+	if len(contentType) == 0 {
+		contentType = "application/octet-stream"
+	}
+	header := make(textproto.MIMEHeader)
+	if len(attachment.Filename) > 0 {
+		filename := quoteParam(attachment.Filename)
+		header.Set("Content-Type", fmt.Sprintf("%s; name=%s", contentType, filename))
+		header.Set("Content-Disposition", fmt.Sprintf("%s; filename=%s", disposition, filename))
+	} else {
+		header.Set("Content-Type", contentType)
+		header.Set("Content-Disposition", disposition)
+	}
+	if len(attachment.ContentID) > 0 {
+		header.Set("Content-Id", fmt.Sprintf("<%s>", strings.Trim(attachment.ContentID, "<>")))
+	}
+	header.Set("Content-Transfer-Encoding", "base64")
+
+	encoded := base64.StdEncoding.EncodeToString(attachment.Content)
+	buf := new(bytes.Buffer)
+	for len(encoded) > base64LineLength {
+		buf.WriteString(encoded[:base64LineLength])
+		buf.WriteString("\r\n")
+		encoded = encoded[base64LineLength:]
+	}
+	buf.WriteString(encoded)
+	return &part{header, buf.Bytes()}
+}
+
+// создает составную часть
+func multipartPart(subtype string, parts ...*part) (*part, error) {
+	buf := new(bytes.Buffer)
+	writer := multipart.NewWriter(buf)
+	for _, child := range parts {
+		partWriter, err := writer.CreatePart(child.header)
+		if err != nil {
+			return nil, err
+		}
+		_, err = partWriter.Write(child.body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", fmt.Sprintf("multipart/%s; boundary=\"%s\"", subtype, writer.Boundary()))
+	return &part{header, buf.Bytes()}, nil
+}
+
+// кодирует значение заголовка в encoded-word, если в нем есть не ASCII символы
+// длинное значение кодируется несколькими словами, которые переносятся на новые строки
+func encodeHeader(value string) string {
+	return strings.Replace(mime.BEncoding.Encode("utf-8", value), "?= =?", "?=\r\n =?", -1)
+}
+
+// кодирует имена в списке адресов, каждый адрес переносится на новую строку
+func formatAddresses(value string) (string, error) {
+	addresses, err := mail.ParseAddressList(value)
+	if err != nil {
+		return "", err
+	}
+	formatted := make([]string, len(addresses))
+	for i, address := range addresses {
+		formatted[i] = address.String()
+	}
+	return strings.Join(formatted, ",\r\n "), nil
+}
+
+// заключает параметр заголовка в кавычки, имя файла с не ASCII символами кодируется в encoded-word
+func quoteParam(value string) string {
+	encoded := mime.BEncoding.Encode("utf-8", value)
+	if encoded == value {
+		encoded = strings.Replace(encoded, `\`, `\\`, -1)
+		encoded = strings.Replace(encoded, `"`, `\"`, -1)
+	}
+	return fmt.Sprintf(`"%s"`, encoded)
+}
+
+// пишет заголовок письма
+func writeHeader(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name)
+	buf.WriteString(": ")
+	buf.WriteString(value)
+	buf.WriteString("\r\n")
+}
@@ -2,6 +2,9 @@ package mailer
 
 import (
 	"fmt"
+	"net/smtp"
+	"net/textproto"
+	"strings"
 
 	"github.com/boreevyuri/dkim"
 	"github.com/boreevyuri/postmanq/common"
@@ -30,17 +33,61 @@ func (m *Mailer) run() {
 // подписывает dkim и отправляет письмо
 func (m *Mailer) sendMail(event *common.SendEvent) {
 	message := event.Message
-	if common.EmailRegexp.MatchString(message.Envelope) && common.EmailRegexp.MatchString(message.Recipient) {
-		m.prepare(message)
-		m.send(event)
+	err := message.Validate()
+	if err == nil {
+		err = m.render(message)
+		if err == nil {
+			err = m.prepare(message)
+			if err == nil && event.Delivery != nil {
+				m.deliver(event)
+			} else if err == nil {
+				m.send(event)
+			} else {
+				m.returnMail(event, fmt.Errorf("554 service#%d can't compose mail#%s, %v", m.id, message.ID, err))
+			}
+		} else {
+			m.returnMail(event, fmt.Errorf("554 service#%d can't render template for mail#%s, %v", m.id, message.ID, err))
+		}
 	} else {
-		// common.ReturnMail(event, errors.New(fmt.Sprintf("511 service#%d can't send mail#%d, envelope or ricipient is invalid", m.id, message.ID)))
-		common.ReturnMail(event, fmt.Errorf("511 service#%d can't send mail#%d, envelope or ricipient is invalid", m.id, message.ID))
+		m.returnMail(event, fmt.Errorf("511 service#%d can't send mail#%s, %v", m.id, message.ID, err))
 	}
 }
 
-// подписывает dkim
-func (m *Mailer) prepare(message *common.MailMessage) {
+// возвращает письмо, которое не дошло до отправки, и отпускает клиента
+// клиент уже получен от почтового сервера, поэтому без возврата в очередь соединение и место в пуле были бы потеряны
+func (m *Mailer) returnMail(event *common.SendEvent, err error) {
+	common.ReturnMail(event, err)
+	if event.Client != nil {
+		event.Client.Wait()
+		event.Queue.Push(event.Client)
+	}
+}
+
+// заполняет содержимое письма по шаблону
+func (m *Mailer) render(message *common.MailMessage) error {
+	if message.MailContent == nil || len(message.Template) == 0 {
+		return nil
+	}
+	err := service.Templates.render(message.MailContent)
+	if err == nil {
+		logger.Debug("mailer#%d-%s success render template %s", m.id, message.ID, message.Template)
+	}
+	return err
+}
+
+// собирает тело письма из содержимого и подписывает dkim
+func (m *Mailer) prepare(message *common.MailMessage) error {
+	if message.MailContent != nil {
+		body, err := compose(message)
+		if err != nil {
+			return err
+		}
+		// при повторной отправке письмо уйдет с уже собранным телом
+		message.Body = body
+		message.MailContent = nil
+		logger.Debug("mailer#%d-%s success compose mail", m.id, message.ID)
+	}
+
 	conf, err := dkim.NewConf(message.HostnameFrom, service.DkimSelector)
 	if err == nil {
 		conf[dkim.AUIDKey] = message.Envelope
@@ -50,16 +97,17 @@ func (m *Mailer) prepare(message *common.MailMessage) {
 			signed, err := signer.Sign([]byte(message.Body))
 			if err == nil {
 				message.Body = string(signed)
-				logger.Debug("mailer#%d-%d success sign mail", m.id, message.ID)
+				logger.Debug("mailer#%d-%s success sign mail", m.id, message.ID)
 			} else {
-				logger.Warn("mailer#%d-%d can't sign mail, error - %v", m.id, message.ID, err)
+				logger.Warn("mailer#%d-%s can't sign mail, error - %v", m.id, message.ID, err)
 			}
 		} else {
-			logger.Warn("mailer#%d-%d can't create dkim signer, error - %v", m.id, message.ID, err)
+			logger.Warn("mailer#%d-%s can't create dkim signer, error - %v", m.id, message.ID, err)
 		}
 	} else {
-		logger.Warn("mailer#%d-%d can't create dkim config, error - %v", m.id, message.ID, err)
+		logger.Warn("mailer#%d-%s can't create dkim config, error - %v", m.id, message.ID, err)
 	}
+	return nil
 }
 
 // отправляет письмо
@@ -67,62 +115,74 @@ func (m *Mailer) send(event *common.SendEvent) {
 	message := event.Message
 	worker := event.Client.Worker
 
-	logger.Info("mailer#%d-%d begin sending mail", m.id, message.ID)
-	logger.Debug("mailer#%d-%d receive smtp client#%d", m.id, message.ID, event.Client.ID)
+	logger.Info("mailer#%d-%s begin sending mail", m.id, message.ID)
+	logger.Debug("mailer#%d-%s receive smtp client#%d", m.id, message.ID, event.Client.ID)
 
 	success := false
 	var sendErr error = nil
 	event.Client.SetTimeout(common.App.Timeout().Mail)
 	err := worker.Mail(message.Envelope)
 	if err == nil {
-		logger.Debug("mailer#%d-%d sent command MAIL FROM: %s", m.id, message.ID, message.Envelope)
+		logger.Debug("mailer#%d-%s sent command MAIL FROM: %s", m.id, message.ID, message.Envelope)
 
-		event.Client.SetTimeout(common.App.Timeout().Rcpt)
-		err = worker.Rcpt(message.Recipient)
+		err = m.rcpt(event)
 		if err == nil {
-			logger.Debug("mailer#%d-%d sent command RCPT TO: %s", m.id, message.ID, message.Recipient)
 
 			event.Client.SetTimeout(common.App.Timeout().Data)
-			wc, err := worker.Data()
+			err = m.data(worker)
 			if err == nil {
-				logger.Debug("mailer#%d-%d sent command DATA", m.id, message.ID)
+				logger.Debug("mailer#%d-%s sent command DATA", m.id, message.ID)
 
+				wc := worker.Text.DotWriter()
 				_, err = fmt.Fprint(wc, message.Body)
 				if err == nil {
 					err = wc.Close()
+					if err == nil {
+						// запоминаем ответ почтового сервиса, обычно в нем указан идентификатор письма на стороне сервиса
+						var code int
+						var reply string
+						if event.Client.LMTP {
+							code, reply, err = m.readLMTPResponses(event)
+						} else {
+							code, reply, err = worker.Text.ReadResponse(250)
+						}
+						if err == nil {
+							event.AddAttempt(code, reply)
+						}
+					}
 					if err == nil {
 						// logger.Debug("%s", message.Body)
-						logger.Debug("mailer#%d-%d body sent successful. Sent command . ", m.id, message.ID)
+						logger.Debug("mailer#%d-%s body sent successful. Sent command . ", m.id, message.ID)
 
 						// Успешная отправка. Не закрываем соединение, но отсылаем RSET.
 						err = worker.Reset()
 						if err == nil {
-							logger.Debug("mailer#%d-%d sent command RSET", m.id, message.ID)
-							logger.Info("mailer#%d-%d success send mail for %s", m.id, message.ID, message.Recipient)
+							logger.Debug("mailer#%d-%s sent command RSET", m.id, message.ID)
+							logger.Info("mailer#%d-%s success send mail for %s", m.id, message.ID, strings.Join(message.AllRecipients(), ", "))
 
 							success = true
 						} else {
-							logger.Info("mailer#%d-%d error after RSET. Error: %+v", m.id, message.ID, err)
+							logger.Info("mailer#%d-%s error after RSET. Error: %+v", m.id, message.ID, err)
 							sendErr = err
 						}
 					} else {
-						logger.Info("mailer#%d-%d error after sent body. Error: %+v", m.id, message.ID, err)
+						logger.Info("mailer#%d-%s error after sent body. Error: %+v", m.id, message.ID, err)
 						sendErr = err
 					}
 				} else {
-					logger.Info("mailer#%d-%d error during body send. Error: %+v", m.id, message.ID, err)
+					logger.Info("mailer#%d-%s error during body send. Error: %+v", m.id, message.ID, err)
 					sendErr = err
 				}
 			} else {
-				logger.Info("mailer#%d-%d error after DATA. Error: %+v", m.id, message.ID, err)
+				logger.Info("mailer#%d-%s error after DATA. Error: %+v", m.id, message.ID, err)
 				sendErr = err
 			}
 		} else {
-			logger.Info("mailer#%d-%d error after RCPT TO. Error: %+v", m.id, message.ID, err)
+			logger.Info("mailer#%d-%s error after RCPT TO. Error: %+v", m.id, message.ID, err)
 			sendErr = err
 		}
 	} else {
-		logger.Info("mailer#%d-%d error after MAIL FROM. Error: %+v", m.id, message.ID, err)
+		logger.Info("mailer#%d-%s error after MAIL FROM. Error: %+v", m.id, message.ID, err)
 		sendErr = err
 	}
 
@@ -136,3 +196,128 @@ func (m *Mailer) send(event *common.SendEvent) {
 		common.ReturnMail(event, sendErr)
 	}
 }
+
+// отправляет команду RCPT TO для каждого получателя письма
+// если у письма несколько получателей, отклоненные получатели запоминаются в событии, а письмо отправляется остальным
+// ошибка возвращается, если почтовый сервис не принял ни одного получателя
+func (m *Mailer) rcpt(event *common.SendEvent) error {
+	message := event.Message
+	worker := event.Client.Worker
+	recipients := message.AllRecipients()
+	accepted := make([]string, 0, len(recipients))
+	var err error
+	for _, recipient := range recipients {
+		event.Client.SetTimeout(common.App.Timeout().Rcpt)
+		err = worker.Rcpt(recipient)
+		if err == nil {
+			logger.Debug("mailer#%d-%s sent command RCPT TO: %s", m.id, message.ID, recipient)
+			accepted = append(accepted, recipient)
+		} else if len(recipients) > 1 {
+			logger.Info("mailer#%d-%s recipient %s rejected. Error: %+v", m.id, message.ID, recipient, err)
+			event.Reject(recipient, err)
+		} else {
+			return err
+		}
+	}
+	if len(recipients) > 1 {
+		message.Recipients = accepted
+		if len(accepted) > 0 {
+			message.Recipient = accepted[0]
+		}
+	}
+	if len(accepted) == 0 {
+		return err
+	}
+	return nil
+}
+
+// читает ответы LMTP сервера после передачи письма, RFC 2033 4.2
+// LMTP сервер отвечает за каждого принятого получателя, отклоненные получатели запоминаются в событии
+// возвращает первый успешный ответ или ошибку, если письмо не принято ни для одного получателя
+func (m *Mailer) readLMTPResponses(event *common.SendEvent) (int, string, error) {
+	message := event.Message
+	recipients := message.AllRecipients()
+	accepted := make([]string, 0, len(recipients))
+	var code int
+	var reply string
+	var err error
+	for _, recipient := range recipients {
+		recipientCode, recipientReply, recipientErr := event.Client.Worker.Text.ReadResponse(250)
+		if recipientErr == nil {
+			if len(accepted) == 0 {
+				code, reply = recipientCode, recipientReply
+			}
+			accepted = append(accepted, recipient)
+		} else if _, ok := recipientErr.(*textproto.Error); !ok {
+			// соединение разорвано, остальные ответы уже не прочитать
+			return 0, "", recipientErr
+		} else if len(recipients) > 1 {
+			logger.Info("mailer#%d-%s recipient %s rejected after DATA. Error: %+v", m.id, message.ID, recipient, recipientErr)
+			event.Reject(recipient, recipientErr)
+			err = recipientErr
+		} else {
+			err = recipientErr
+		}
+	}
+	if len(accepted) == 0 {
+		return 0, "", err
+	}
+	if len(recipients) > 1 {
+		message.Recipients = accepted
+		message.Recipient = accepted[0]
+	}
+	return code, reply, nil
+}
+
+// доставляет письмо без SMTP, например, сохраняет в maildir
+// письмо доставляется каждому получателю отдельно, получатели, которым не удалось доставить письмо, запоминаются в событии,
+// поэтому повторно письмо отправляется только им
+func (m *Mailer) deliver(event *common.SendEvent) {
+	message := event.Message
+	recipients := message.AllRecipients()
+	accepted := make([]string, 0, len(recipients))
+	var reply string
+	var err error
+	for _, recipient := range recipients {
+		recipientReply, recipientErr := event.Delivery.Deliver(message, recipient)
+		if recipientErr == nil {
+			if len(accepted) == 0 {
+				reply = recipientReply
+			}
+			accepted = append(accepted, recipient)
+		} else if len(recipients) > 1 {
+			logger.Info("mailer#%d-%s can't deliver mail for %s. Error: %+v", m.id, message.ID, recipient, recipientErr)
+			event.Reject(recipient, recipientErr)
+			err = recipientErr
+		} else {
+			err = recipientErr
+		}
+	}
+	// если письмо не доставлено ни одному из нескольких получателей, каждый получатель уже запомнен в событии
+	if len(recipients) > 1 {
+		message.Recipients = accepted
+		if len(accepted) > 0 {
+			message.Recipient = accepted[0]
+		}
+	}
+	if len(accepted) == 0 {
+		logger.Info("mailer#%d-%s can't deliver mail. Error: %+v", m.id, message.ID, err)
+		common.ReturnMail(event, err)
+		return
+	}
+	event.AddAttempt(250, reply)
+	logger.Info("mailer#%d-%s success deliver mail for %s, %s", m.id, message.ID, strings.Join(message.AllRecipients(), ", "), reply)
+	event.Result <- common.SuccessSendEventResult
+}
+
+// отправляет команду DATA
+// в отличие от smtp.Client.Data позволяет прочитать ответ почтового сервиса после передачи письма
+func (m *Mailer) data(worker *smtp.Client) error {
+	id, err := worker.Text.Cmd("DATA")
+	if err == nil {
+		worker.Text.StartResponse(id)
+		_, _, err = worker.Text.ReadResponse(354)
+		worker.Text.EndResponse(id)
+	}
+	return err
+}
@@ -30,6 +30,9 @@ type Service struct {
 	// селектор
 	DkimSelector string `yaml:"dkimSelector"`
 
+	// шаблоны писем
+	Templates Templates `yaml:"templates"`
+
 	// содержимое приватного ключа
 	privateKey *rsa.PrivateKey
 }
@@ -75,6 +78,12 @@ func (s *Service) OnInit(event *common.ApplicationEvent) {
 		if s.MailersCount == 0 {
 			s.MailersCount = common.DefaultWorkersCount
 		}
+		if s.Templates.isEnabled() {
+			err = s.Templates.init()
+			if err != nil {
+				logger.FailExit("mailer service can't read templates dir %s, error - %v", s.Templates.Dir, err)
+			}
+		}
 	} else {
 		logger.FailExitWithErr(err)
 	}
@@ -83,6 +92,9 @@ func (s *Service) OnInit(event *common.ApplicationEvent) {
 // OnRun запускает отправителей и прием сообщений из очереди
 func (s *Service) OnRun() {
 	logger.Debug("run mailers apps...")
+	if s.Templates.isEnabled() {
+		go s.Templates.watch()
+	}
 	for i := 0; i < s.MailersCount; i++ {
 		go newMailer(i + 1)
 	}
@@ -94,6 +106,6 @@ func (s *Service) Events() chan *common.SendEvent {
 }
 
 // OnFinish завершает работу сервиса отправки писем
-func (s *Service) OnFinish() {
-	close(events)
-}
+// канал событий не закрывается: письма, не успевшие отправиться до истечения таймаута остановки,
+// уже возвращены в очередь, а отправка события в закрытый канал привела бы к панике
+func (s *Service) OnFinish() {}
@@ -0,0 +1,227 @@
+package mailer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/boreevyuri/postmanq/common"
+	"github.com/boreevyuri/postmanq/logger"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	// расширение файлов шаблонов
+	templateExt = ".yaml"
+
+	// период проверки изменений шаблонов по умолчанию
+	defaultTemplatesReload = 10 * time.Second
+)
+
+// Templates шаблоны писем
+// каждый шаблон хранится в отдельном файле <идентификатор>.yaml в каталоге шаблонов
+type Templates struct {
+	// каталог с шаблонами
+	Dir string `yaml:"dir"`
+
+	// период проверки изменений шаблонов
+	Reload time.Duration `yaml:"reload"`
+
+	// загруженные шаблоны, в качестве ключа используется идентификатор шаблона
+	templates map[string]*Template
+
+	// даты изменения загруженных файлов шаблонов
+	modTimes map[string]time.Time
+
+	// семафор для шаблонов
+	mutex *sync.RWMutex
+}
+
+// Template шаблон письма
+type Template struct {
+	// шаблон темы
+	subject *texttemplate.Template
+
+	// шаблон текстовой версии
+	text *texttemplate.Template
+
+	// шаблон HTML версии
+	html *htmltemplate.Template
+}
+
+// файл шаблона
+type templateFile struct {
+	// тема письма
+	Subject string `yaml:"subject"`
+
+	// текстовая версия письма, переменные вставляются как есть
+	Text string `yaml:"text"`
+
+	// HTML версия письма, переменные экранируются
+	HTML string `yaml:"html"`
+}
+
+// загружает шаблоны
+func (t *Templates) init() error {
+	t.templates = make(map[string]*Template)
+	t.modTimes = make(map[string]time.Time)
+	t.mutex = new(sync.RWMutex)
+	if t.Reload == 0 {
+		t.Reload = defaultTemplatesReload
+	}
+	return t.load()
+}
+
+// сигнализирует, что каталог шаблонов указан
+func (t *Templates) isEnabled() bool {
+	return len(t.Dir) > 0
+}
+
+// периодически перезагружает измененные шаблоны
+func (t *Templates) watch() {
+	for range time.Tick(t.Reload) {
+		err := t.load()
+		if err != nil {
+			logger.Warn("mailer service can't read templates dir %s, error - %v", t.Dir, err)
+		}
+	}
+}
+
+// загружает новые и измененные шаблоны и удаляет шаблоны, файлы которых удалены
+// если измененный шаблон не удалось разобрать, продолжает использоваться предыдущая версия шаблона
+func (t *Templates) load() error {
+	files, err := ioutil.ReadDir(t.Dir)
+	if err != nil {
+		return err
+	}
+
+	exists := make(map[string]bool)
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != templateExt {
+			continue
+		}
+		id := strings.TrimSuffix(file.Name(), templateExt)
+		exists[id] = true
+
+		t.mutex.RLock()
+		modTime, ok := t.modTimes[id]
+		t.mutex.RUnlock()
+		if ok && modTime.Equal(file.ModTime()) {
+			continue
+		}
+
+		template, err := parseTemplate(filepath.Join(t.Dir, file.Name()))
+		t.mutex.Lock()
+		// запоминаем дату изменения и для ошибочного файла, чтобы не выводить ошибку при каждой проверке
+		t.modTimes[id] = file.ModTime()
+		if err == nil {
+			t.templates[id] = template
+		}
+		t.mutex.Unlock()
+		if err == nil {
+			logger.Info("mailer service load template %s", id)
+		} else {
+			logger.Warn("mailer service can't load template %s, error - %v", id, err)
+		}
+	}
+
+	t.mutex.Lock()
+	for id := range t.modTimes {
+		if !exists[id] {
+			delete(t.modTimes, id)
+			delete(t.templates, id)
+			logger.Info("mailer service remove template %s", id)
+		}
+	}
+	t.mutex.Unlock()
+	return nil
+}
+
+// читает и разбирает файл шаблона
+func parseTemplate(filename string) (*Template, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	file := new(templateFile)
+	err = yaml.Unmarshal(data, file)
+	if err != nil {
+		return nil, err
+	}
+	if len(file.Text) == 0 && len(file.HTML) == 0 {
+		return nil, errors.New("template has neither text nor html")
+	}
+
+	template := new(Template)
+	if len(file.Subject) > 0 {
+		template.subject, err = texttemplate.New("subject").Option("missingkey=error").Parse(file.Subject)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(file.Text) > 0 {
+		template.text, err = texttemplate.New("text").Option("missingkey=error").Parse(file.Text)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(file.HTML) > 0 {
+		template.html, err = htmltemplate.New("html").Option("missingkey=error").Parse(file.HTML)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return template, nil
+}
+
+// заполняет тему и текст письма по шаблону с переменными письма
+// тема и текст, указанные в самом письме, не заменяются
+func (t *Templates) render(content *common.MailContent) error {
+	if !t.isEnabled() {
+		return errors.New("templates dir is not configured")
+	}
+	t.mutex.RLock()
+	template, ok := t.templates[content.Template]
+	t.mutex.RUnlock()
+	if !ok {
+		return fmt.Errorf("template %s not found", content.Template)
+	}
+
+	subject, text, html := content.Subject, content.Text, content.HTML
+	var err error
+	if len(subject) == 0 && template.subject != nil {
+		subject, err = execute(template.subject, content.Vars)
+		// тема пишется в заголовок, поэтому не должна содержать переносов строк
+		subject = strings.Join(strings.Fields(subject), " ")
+	}
+	if err == nil && len(text) == 0 && template.text != nil {
+		text, err = execute(template.text, content.Vars)
+	}
+	if err == nil && len(html) == 0 && template.html != nil {
+		html, err = execute(template.html, content.Vars)
+	}
+	if err == nil {
+		content.Subject, content.Text, content.HTML = subject, text, html
+	}
+	return err
+}
+
+// шаблон, который можно заполнить переменными
+type executor interface {
+	Execute(wr io.Writer, data interface{}) error
+}
+
+// заполняет шаблон переменными
+func execute(template executor, vars map[string]interface{}) (string, error) {
+	buf := new(bytes.Buffer)
+	err := template.Execute(buf, vars)
+	return buf.String(), err
+}
@@ -0,0 +1,243 @@
+package msa
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/boreevyuri/postmanq/common"
+	"github.com/boreevyuri/postmanq/consumer"
+	"github.com/boreevyuri/postmanq/logger"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	// максимальный размер письма по умолчанию
+	defaultMaxSize = 32 << 20
+
+	// максимальное количество получателей в одной транзакции по умолчанию
+	defaultMaxRecipients = 100
+
+	// время ожидания команды от клиента
+	commandTimeout = 5 * time.Minute
+)
+
+var (
+	// сервис приема писем по SMTP
+	service *Service
+
+	// канал для приема событий отправки писем
+	events = make(chan *common.SendEvent)
+)
+
+// Service сервис приема писем по SMTP от локальных приложений
+type Service struct {
+	Config Config `yaml:"msa"`
+
+	// домен, которым сервис представляется клиентам
+	Domain string `yaml:"domain"`
+
+	// путь до файла с закрытым ключом
+	PrivateKeyFilename string `yaml:"privateKey"`
+
+	// путь до файла с сертификатом
+	CertFilename string `yaml:"certificate"`
+
+	// сервис, который кладет письма в очередь
+	publisher common.MailPublisher
+
+	// настройки TLS для команды STARTTLS
+	tlsConfig *tls.Config
+
+	// слушатель подключений
+	listener net.Listener
+
+	// флаг, сигнализирующий, что сервис остановлен
+	stopped bool
+
+	// открытые подключения клиентов
+	conns map[net.Conn]bool
+
+	// семафор для подключений
+	mutex *sync.Mutex
+
+	// работающие сессии, используется для ожидания при остановке
+	group *sync.WaitGroup
+}
+
+// Config настройки сервиса приема писем по SMTP
+type Config struct {
+	// адрес, на котором принимаются подключения, если не указан, сервис не запускается
+	Listen string `yaml:"listen"`
+
+	// разрешает команду STARTTLS, используются certificate и privateKey
+	StartTLS bool `yaml:"starttls"`
+
+	// пользователи и пароли для AUTH PLAIN, если указаны, письма принимаются только после авторизации
+	Users map[string]string `yaml:"users"`
+
+	// точка обмена, в которую кладутся письма, по умолчанию точка обмена первой связки
+	Exchange string `yaml:"exchange"`
+
+	// максимальный размер письма в байтах
+	MaxSize int `yaml:"maxSize"`
+
+	// максимальное количество получателей в одной транзакции
+	MaxRecipients int `yaml:"maxRecipients"`
+}
+
+// Inst создает новый сервис приема писем по SMTP
+func Inst() common.SendingService {
+	if service == nil {
+		service = new(Service)
+		service.publisher = consumer.Inst().(common.MailPublisher)
+		service.conns = make(map[net.Conn]bool)
+		service.mutex = new(sync.Mutex)
+		service.group = new(sync.WaitGroup)
+	}
+	return service
+}
+
+// OnInit инициализирует сервис
+func (s *Service) OnInit(event *common.ApplicationEvent) {
+	logger.Debug("init msa service")
+	err := yaml.Unmarshal(event.Data, s)
+	if err == nil {
+		if s.Config.MaxSize == 0 {
+			s.Config.MaxSize = defaultMaxSize
+		}
+		if s.Config.MaxRecipients == 0 {
+			s.Config.MaxRecipients = defaultMaxRecipients
+		}
+		// без пользователей сервис принимает письма от любого клиента,
+		// поэтому на внешнем адресе он превратился бы в открытый релей
+		if len(s.Config.Listen) > 0 && len(s.Config.Users) == 0 && !isLoopback(s.Config.Listen) {
+			logger.FailExit("msa service can't listen %s without users, users should be defined for non-loopback address", s.Config.Listen)
+			return
+		}
+		if s.Config.StartTLS {
+			cert, err := tls.LoadX509KeyPair(s.CertFilename, s.PrivateKeyFilename)
+			if err == nil {
+				s.tlsConfig = &tls.Config{
+					Certificates: []tls.Certificate{cert},
+					ServerName:   s.Domain,
+				}
+			} else {
+				logger.FailExit("msa service can't load cert from %s and %s, error - %v", s.CertFilename, s.PrivateKeyFilename, err)
+			}
+		}
+	} else {
+		logger.FailExit("msa service can't unmarshal config, error - %v", err)
+	}
+}
+
+// сигнализирует, что адрес доступен только с этого хоста
+func isLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// OnRun запускает прием подключений
+func (s *Service) OnRun() {
+	if len(s.Config.Listen) == 0 {
+		return
+	}
+	listener, err := net.Listen("tcp", s.Config.Listen)
+	if err != nil {
+		logger.FailExit("msa service can't listen %s, error - %v", s.Config.Listen, err)
+		return
+	}
+	s.mutex.Lock()
+	if s.stopped {
+		s.mutex.Unlock()
+		listener.Close()
+		return
+	}
+	s.listener = listener
+	s.mutex.Unlock()
+	logger.Info("msa service listen %s", s.Config.Listen)
+
+	for id := 1; ; id++ {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.isStopped() {
+				return
+			}
+			logger.Warn("msa service can't accept connection, error - %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		s.mutex.Lock()
+		s.conns[conn] = true
+		s.group.Add(1)
+		s.mutex.Unlock()
+		go s.serve(newSession(id, conn), conn)
+	}
+}
+
+// обслуживает клиента и удаляет подключение после его закрытия
+func (s *Service) serve(session *session, conn net.Conn) {
+	session.run()
+	s.mutex.Lock()
+	delete(s.conns, conn)
+	s.mutex.Unlock()
+	s.group.Done()
+}
+
+// сигнализирует, что сервис остановлен
+func (s *Service) isStopped() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.stopped
+}
+
+// продлевает ожидание следующей команды клиента, если сервис не остановлен
+// проверка и продление идут под семафором, поэтому продление не отменит таймаут, выставленный при остановке
+func (s *Service) extendDeadline(conn net.Conn) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stopped {
+		return false
+	}
+	conn.SetDeadline(time.Now().Add(commandTimeout))
+	return true
+}
+
+// Events канал для приема событий отправки писем
+func (s *Service) Events() chan *common.SendEvent {
+	return events
+}
+
+// OnFinish перестает принимать подключения и закрывает сессии клиентов
+// письмо, для которого клиент не получил ответ 250, клиент отправит повторно
+func (s *Service) OnFinish() {
+	s.mutex.Lock()
+	s.stopped = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	// прерываем ожидание следующей команды, сессии завершатся после ответа на текущую
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mutex.Unlock()
+
+	finished := make(chan bool)
+	go func() {
+		s.group.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(common.App.Timeout().Shutdown):
+		logger.Warn("msa service didn't finish sessions in %v", common.App.Timeout().Shutdown)
+	}
+}
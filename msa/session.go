@@ -0,0 +1,316 @@
+package msa
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"regexp"
+	"strings"
+
+	"github.com/boreevyuri/postmanq/common"
+	"github.com/boreevyuri/postmanq/logger"
+)
+
+var (
+	// адрес в командах MAIL FROM и RCPT TO, параметры после адреса игнорируются
+	pathRegex = regexp.MustCompile(`(?i)^(?:FROM|TO):\s*<([^>]*)>`)
+)
+
+// session сессия клиента
+type session struct {
+	// идентификатор для логов
+	id int
+
+	// подключение клиента
+	conn net.Conn
+
+	// чтение команд и запись ответов
+	text *textproto.Conn
+
+	// клиент представился командой HELO или EHLO
+	hello bool
+
+	// подключение защищено TLS
+	tls bool
+
+	// клиент прошел авторизацию
+	authorized bool
+
+	// отправитель текущей транзакции
+	envelope string
+
+	// получатели текущей транзакции
+	recipients []string
+}
+
+// создает сессию клиента
+func newSession(id int, conn net.Conn) *session {
+	return &session{
+		id:   id,
+		conn: conn,
+		text: textproto.NewConn(conn),
+	}
+}
+
+// принимает команды клиента, пока клиент не отключится
+func (s *session) run() {
+	defer s.text.Close()
+	logger.Debug("msa session#%d open connection from %s", s.id, s.conn.RemoteAddr())
+	s.reply(220, "%s ESMTP PostmanQ", service.Domain)
+	for service.extendDeadline(s.conn) {
+		line, err := s.text.ReadLine()
+		if err != nil {
+			if err != io.EOF && !service.isStopped() {
+				logger.Debug("msa session#%d can't read command, error - %v", s.id, err)
+			}
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i > 0 {
+			verb, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			s.hello = true
+			s.reset()
+			s.reply(250, "%s", service.Domain)
+		case "EHLO":
+			s.hello = true
+			s.reset()
+			s.ehlo()
+		case "STARTTLS":
+			if !s.startTLS() {
+				return
+			}
+		case "AUTH":
+			s.auth(arg)
+		case "MAIL":
+			s.mail(arg)
+		case "RCPT":
+			s.rcpt(arg)
+		case "DATA":
+			if !s.data() {
+				return
+			}
+		case "RSET":
+			s.reset()
+			s.reply(250, "2.0.0 OK")
+		case "NOOP":
+			s.reply(250, "2.0.0 OK")
+		case "QUIT":
+			s.reply(221, "2.0.0 Bye")
+			return
+		default:
+			s.reply(502, "5.5.2 Command not recognized")
+		}
+	}
+	s.reply(421, "4.3.2 Service shutting down")
+}
+
+// отвечает клиенту
+func (s *session) reply(code int, format string, args ...interface{}) {
+	s.text.PrintfLine("%d %s", code, fmt.Sprintf(format, args...))
+}
+
+// сбрасывает текущую транзакцию
+func (s *session) reset() {
+	s.envelope = ""
+	s.recipients = nil
+}
+
+// сигнализирует, что клиент может передавать письма
+func (s *session) isAuthorized() bool {
+	return len(service.Config.Users) == 0 || s.authorized
+}
+
+// сигнализирует, что клиент может авторизоваться, пароль не передается по открытому соединению, если доступен TLS
+func (s *session) canAuth() bool {
+	return len(service.Config.Users) > 0 && (s.tls || service.tlsConfig == nil)
+}
+
+// отвечает на EHLO списком расширений
+func (s *session) ehlo() {
+	extensions := []string{
+		service.Domain,
+		"8BITMIME",
+		fmt.Sprintf("SIZE %d", service.Config.MaxSize),
+	}
+	if service.tlsConfig != nil && !s.tls {
+		extensions = append(extensions, "STARTTLS")
+	}
+	if s.canAuth() {
+		extensions = append(extensions, "AUTH PLAIN")
+	}
+	for i, extension := range extensions {
+		if i < len(extensions)-1 {
+			s.text.PrintfLine("250-%s", extension)
+		} else {
+			s.text.PrintfLine("250 %s", extension)
+		}
+	}
+}
+
+// переводит подключение в TLS
+func (s *session) startTLS() bool {
+	if service.tlsConfig == nil || s.tls {
+		s.reply(502, "5.5.1 STARTTLS not available")
+		return true
+	}
+	s.reply(220, "2.0.0 Ready to start TLS")
+	conn := tls.Server(s.conn, service.tlsConfig)
+	err := conn.Handshake()
+	if err != nil {
+		logger.Warn("msa session#%d can't start tls, error - %v", s.id, err)
+		return false
+	}
+	s.conn = conn
+	s.text = textproto.NewConn(conn)
+	s.tls = true
+	// после STARTTLS клиент должен заново представиться
+	s.hello = false
+	s.authorized = false
+	s.reset()
+	return true
+}
+
+// авторизует клиента по AUTH PLAIN
+func (s *session) auth(arg string) {
+	if !s.canAuth() {
+		s.reply(503, "5.5.1 AUTH not available")
+		return
+	}
+	if s.authorized {
+		s.reply(503, "5.5.1 Already authenticated")
+		return
+	}
+	parts := strings.Fields(arg)
+	if len(parts) == 0 || strings.ToUpper(parts[0]) != "PLAIN" {
+		s.reply(504, "5.5.4 Unrecognized authentication type")
+		return
+	}
+	var response string
+	if len(parts) > 1 {
+		response = parts[1]
+	} else {
+		s.reply(334, "")
+		line, err := s.text.ReadLine()
+		if err != nil {
+			return
+		}
+		response = line
+	}
+	decoded, err := base64.StdEncoding.DecodeString(response)
+	if err != nil {
+		s.reply(501, "5.5.2 Can't decode response")
+		return
+	}
+	// authzid\x00authcid\x00password
+	fields := strings.Split(string(decoded), "\x00")
+	if len(fields) == 3 {
+		if password, ok := service.Config.Users[fields[1]]; ok && subtle.ConstantTimeCompare([]byte(password), []byte(fields[2])) == 1 {
+			s.authorized = true
+			logger.Debug("msa session#%d authorized %s", s.id, fields[1])
+			s.reply(235, "2.7.0 Authentication successful")
+			return
+		}
+	}
+	logger.Warn("msa session#%d reject credentials from %s", s.id, s.conn.RemoteAddr())
+	s.reply(535, "5.7.8 Authentication credentials invalid")
+}
+
+// начинает транзакцию
+func (s *session) mail(arg string) {
+	if !s.hello {
+		s.reply(503, "5.5.1 Send HELO or EHLO first")
+		return
+	}
+	if !s.isAuthorized() {
+		s.reply(530, "5.7.0 Authentication required")
+		return
+	}
+	if len(s.envelope) > 0 {
+		s.reply(503, "5.5.1 Nested MAIL command")
+		return
+	}
+	matches := pathRegex.FindStringSubmatch(arg)
+	if matches == nil || !common.EmailRegexp.MatchString(matches[1]) {
+		s.reply(553, "5.1.7 Invalid sender address")
+		return
+	}
+	s.envelope = matches[1]
+	s.reply(250, "2.1.0 OK")
+}
+
+// добавляет получателя в транзакцию
+func (s *session) rcpt(arg string) {
+	if len(s.envelope) == 0 {
+		s.reply(503, "5.5.1 Send MAIL first")
+		return
+	}
+	if len(s.recipients) >= service.Config.MaxRecipients {
+		s.reply(452, "4.5.3 Too many recipients")
+		return
+	}
+	matches := pathRegex.FindStringSubmatch(arg)
+	if matches == nil || !common.EmailRegexp.MatchString(matches[1]) {
+		s.reply(553, "5.1.3 Invalid recipient address")
+		return
+	}
+	s.recipients = append(s.recipients, matches[1])
+	s.reply(250, "2.1.5 OK")
+}
+
+// принимает письмо и кладет его в очередь
+// возвращает false, если сессию надо закрыть
+func (s *session) data() bool {
+	if len(s.recipients) == 0 {
+		s.reply(503, "5.5.1 Send RCPT first")
+		return true
+	}
+	s.reply(354, "Start mail input; end with <CRLF>.<CRLF>")
+	reader := s.text.DotReader()
+	body, err := ioutil.ReadAll(io.LimitReader(reader, int64(service.Config.MaxSize)+1))
+	if err == nil && len(body) > service.Config.MaxSize {
+		// дочитываем письмо, чтобы не сбить последовательность команд
+		_, err = io.Copy(ioutil.Discard, reader)
+		if err == nil {
+			s.reset()
+			s.reply(552, "5.3.4 Message size exceeds fixed limit")
+			return true
+		}
+	}
+	if err != nil {
+		logger.Debug("msa session#%d can't read mail, error - %v", s.id, err)
+		return false
+	}
+
+	// DotReader заменяет CRLF на LF, а письмо передается почтовым серверам с CRLF
+	body = bytes.Replace(body, []byte("\n"), []byte("\r\n"), -1)
+	message := &common.MailMessage{
+		ID:       common.NewID(),
+		Envelope: s.envelope,
+		Body:     string(body),
+	}
+	if len(s.recipients) == 1 {
+		message.Recipient = s.recipients[0]
+	} else {
+		message.Recipients = s.recipients
+	}
+	s.reset()
+
+	err = service.publisher.PublishMail(service.Config.Exchange, message)
+	if err == nil {
+		logger.Info("msa session#%d publish mail#%s: envelope - %s, recipient - %s", s.id, message.ID, message.Envelope, strings.Join(message.AllRecipients(), ", "))
+		s.reply(250, "2.0.0 OK queued as %s", message.ID)
+	} else {
+		logger.Warn("msa session#%d can't publish mail#%s, error - %v", s.id, message.ID, err)
+		s.reply(451, "4.3.0 Temporary failure, try again later")
+	}
+	return true
+}
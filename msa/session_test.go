@@ -0,0 +1,136 @@
+package msa
+
+import (
+	"net"
+	"net/textproto"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boreevyuri/postmanq/common"
+	"github.com/boreevyuri/postmanq/logger"
+)
+
+func TestMain(m *testing.M) {
+	// без запущенных писателей логов запись в лог блокирует сессию
+	logger.Inst()
+	os.Exit(m.Run())
+}
+
+// сервис, который запоминает положенные в очередь письма
+type testPublisher struct {
+	messages []*common.MailMessage
+}
+
+// PublishMail запоминает письмо
+func (p *testPublisher) PublishMail(exchange string, message *common.MailMessage) error {
+	p.messages = append(p.messages, message)
+	return nil
+}
+
+// подставляет сервис на время теста и запускает сессию клиента
+func startTestSession(t *testing.T, publisher common.MailPublisher) (*textproto.Conn, net.Conn, <-chan struct{}) {
+	previous := service
+	service = &Service{
+		Domain:    "msa.example.com",
+		Config:    Config{MaxSize: defaultMaxSize, MaxRecipients: defaultMaxRecipients},
+		publisher: publisher,
+		conns:     make(map[net.Conn]bool),
+		mutex:     new(sync.Mutex),
+		group:     new(sync.WaitGroup),
+	}
+	t.Cleanup(func() { service = previous })
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		newSession(1, server).run()
+	}()
+	text := textproto.NewConn(client)
+	t.Cleanup(func() { text.Close() })
+	if _, _, err := text.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	return text, server, done
+}
+
+// отправляет команду и проверяет код ответа
+func command(t *testing.T, text *textproto.Conn, code int, format string, args ...interface{}) {
+	t.Helper()
+	id, err := text.Cmd(format, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text.StartResponse(id)
+	defer text.EndResponse(id)
+	if _, message, err := text.ReadResponse(code); err != nil {
+		t.Fatalf("%s: %v, %s", format, err, message)
+	}
+}
+
+func TestSessionData(t *testing.T) {
+	publisher := new(testPublisher)
+	text, _, done := startTestSession(t, publisher)
+	command(t, text, 250, "EHLO client.example.com")
+	command(t, text, 250, "MAIL FROM:<sender@example.com>")
+	command(t, text, 250, "RCPT TO:<user@example.com>")
+	command(t, text, 354, "DATA")
+	writer := text.DotWriter()
+	writer.Write([]byte("Subject: test\r\n\r\n.line\r\ntest\r\n"))
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := text.ReadResponse(250); err != nil {
+		t.Fatal(err)
+	}
+	command(t, text, 221, "QUIT")
+	<-done
+
+	if len(publisher.messages) != 1 {
+		t.Fatalf("%d mails are published, want 1", len(publisher.messages))
+	}
+	// строки письма разделяются CRLF, как при передаче клиентом
+	if body, want := publisher.messages[0].Body, "Subject: test\r\n\r\n.line\r\ntest\r\n"; body != want {
+		t.Errorf("body = %q, want %q", body, want)
+	}
+}
+
+func TestSessionStop(t *testing.T) {
+	text, server, done := startTestSession(t, new(testPublisher))
+	command(t, text, 250, "EHLO client.example.com")
+
+	// так же, как при остановке сервиса, прерываем ожидание следующей команды
+	service.mutex.Lock()
+	service.stopped = true
+	server.SetReadDeadline(time.Now())
+	service.mutex.Unlock()
+	// сессия отвечает 421, если остановка случилась до ожидания команды, или просто закрывает подключение
+	go text.ReadResponse(421)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session isn't finished after stop")
+	}
+}
+
+func TestExtendDeadlineAfterStop(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	s := &Service{mutex: new(sync.Mutex)}
+	if !s.extendDeadline(server) {
+		t.Fatal("deadline isn't extended before stop")
+	}
+	s.stopped = true
+	server.SetReadDeadline(time.Now())
+	// таймаут, выставленный при остановке, не продлевается
+	if s.extendDeadline(server) {
+		t.Error("deadline is extended after stop")
+	}
+	if _, err := server.Read(make([]byte, 1)); err == nil {
+		t.Error("read doesn't time out after stop")
+	} else if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("read error = %v, want timeout", err)
+	}
+}